@@ -2,36 +2,238 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"context"
 	"crypto/md5"
+	"crypto/subtle"
+	"crypto/tls"
 	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"html"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
 	"io"
 	"log"
+	"maps"
+	"math"
+	"math/rand/v2"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
+	"os"
+	"path"
 	"regexp"
 	"runtime"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
 
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
 	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/hashicorp/golang-lru/v2/expirable"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/publicsuffix"
 	"golang.org/x/sync/singleflight"
 )
 
 type Preview struct {
-	URL         string `json:"url"`
-	Title       string `json:"title"`
+	URL   string `json:"url"`
+	Title string `json:"title"`
+	// HasTitle is false when the page has no title of its own, and Title is
+	// the host or empty
+	HasTitle    bool   `json:"has_title"`
 	Description string `json:"description"`
 	Image       string `json:"image"`
 	SiteName    string `json:"site_name"`
 	Favicon     string `json:"favicon"`
-	Domain      string `json:"domain"`
-	Error       string `json:"error,omitempty"`
-	OriginalURL string `json:"original_url,omitempty"`
+	Logo        string `json:"logo"`
+	// AppleTouchIcon is the largest apple-touch-icon, for iOS web clips
+	AppleTouchIcon string    `json:"apple_touch_icon,omitempty"`
+	Images         []OGImage `json:"images,omitempty"`
+	Type           string    `json:"type,omitempty"`
+
+	Locale           string   `json:"locale,omitempty"`
+	LocaleAlternates []string `json:"locale_alternates,omitempty"`
+	Determiner       string   `json:"determiner,omitempty"`
+
+	DominantColor string `json:"dominant_color,omitempty"`
+	// ManifestThemeColor and ManifestBackgroundColor come from the web app
+	// manifest when FETCH_MANIFEST is set
+	ManifestThemeColor      string `json:"manifest_theme_color,omitempty"`
+	ManifestBackgroundColor string `json:"manifest_background_color,omitempty"`
+	// ImageReachable and ImageContentType report a HEAD check of Image for
+	// ?verify_image=1; ImageReachable is unset otherwise
+	ImageReachable   *bool  `json:"image_reachable,omitempty"`
+	ImageContentType string `json:"image_content_type,omitempty"`
+
+	Video         string `json:"video,omitempty"`
+	VideoDuration int    `json:"video_duration,omitempty"`
+	VideoPoster   string `json:"video_poster,omitempty"`
+	// PlayerAspectRatio is the embed player's width:height, e.g. "16:9"
+	PlayerAspectRatio string `json:"player_aspect_ratio,omitempty"`
+	// Screenshot is set when Image is a rendering from SCREENSHOT_SERVICE,
+	// served through /proxy-image
+	Screenshot bool `json:"screenshot,omitempty"`
+
+	AuthorLinks []string `json:"author_links,omitempty"`
+
+	FullTitle       string `json:"full_title,omitempty"`
+	FullDescription string `json:"full_description,omitempty"`
+
+	// Price, Currency and Availability are only set for product pages
+	Price        string `json:"price,omitempty"`
+	Currency     string `json:"currency,omitempty"`
+	Availability string `json:"availability,omitempty"`
+
+	PublishedTime      string `json:"published_time,omitempty"`
+	ReadingTimeMinutes int    `json:"reading_time_minutes,omitempty"`
+
+	Feeds []string `json:"feeds,omitempty"`
+	// FeedTitle and FeedType ("rss", "atom" or "json-feed") describe the
+	// first of Feeds when FETCH_FEED_INFO is set
+	FeedTitle string `json:"feed_title,omitempty"`
+	FeedType  string `json:"feed_type,omitempty"`
+	// Alternates maps each hreflang to the URL of that language's version
+	Alternates  map[string]string `json:"alternates,omitempty"`
+	Domain      string            `json:"domain"`
+	ContentHash string            `json:"content_hash,omitempty"`
+
+	// CachedAt is when the preview was fetched, and Age how many seconds ago
+	CachedAt *time.Time `json:"cached_at,omitempty"`
+	Age      int        `json:"age"`
+
+	// Unsafe is set when Google Safe Browsing lists the URL, with the
+	// threat type it is listed for
+	Unsafe     bool   `json:"unsafe,omitempty"`
+	ThreatType string `json:"threat_type,omitempty"`
+
+	UpstreamStatus    int    `json:"upstream_status,omitempty"`
+	UpstreamFinalURL  string `json:"upstream_final_url,omitempty"`
+	RedirectedToLogin bool   `json:"redirected_to_login,omitempty"`
+	// RetryAfter is the upstream's Retry-After, in seconds, when it answered
+	// 429, or our own wait for a rate_limited error on /ws. The HTTP endpoints
+	// have no rate limit of their own, so never answer 429 themselves.
+	RetryAfter  int     `json:"retry_after,omitempty"`
+	ContentType string  `json:"content_type,omitempty"`
+	Error       string  `json:"error,omitempty"`
+	ErrorCode   string  `json:"error_code,omitempty"`
+	OriginalURL string  `json:"original_url,omitempty"`
+	Timing      *Timing `json:"timing,omitempty"`
+	// Debug is only returned with ?debug=1
+	Debug *DebugInfo `json:"debug,omitempty"`
+
+	// cacheTTL is how long to cache this preview, derived from the upstream's
+	// caching headers; it isn't part of the response
+	cacheTTL time.Duration
+}
+
+// Timing is the upstream round-trip breakdown returned with ?debug_timing=1
+type Timing struct {
+	DNSMs     float64 `json:"dns_ms"`
+	ConnectMs float64 `json:"connect_ms"`
+	TLSMs     float64 `json:"tls_ms"`
+	TTFBMs    float64 `json:"ttfb_ms"`
+	TotalMs   float64 `json:"total_ms"`
+}
+
+// serverTimings is the /preview breakdown sent as a Server-Timing header. Fetch
+// runs to the upstream response headers; parse covers the body scan, which
+// includes reading the body as it streams in. Both add up over retries and
+// fallback user agents, and stay zero for cache hits and shared fetches.
+type serverTimings struct {
+	CacheHit bool
+	Fetch    time.Duration
+	Parse    time.Duration
+}
+
+func (t *serverTimings) header() string {
+	cache := "miss"
+	if t.CacheHit {
+		cache = "hit"
+	}
+	return fmt.Sprintf("cache;desc=%s, fetch;dur=%.1f, parse;dur=%.1f", cache,
+		float64(t.Fetch.Microseconds())/1000, float64(t.Parse.Microseconds())/1000)
+}
+
+// DebugInfo explains how a preview was extracted, for ?debug=1
+type DebugInfo struct {
+	ScanTruncated bool `json:"scan_truncated"`
+	BytesScanned  int  `json:"bytes_scanned"`
+	// CacheKey is the preview cache key for the requested URL and namespace
+	CacheKey string `json:"cache_key,omitempty"`
+	// Protocol is the upstream response's HTTP version, e.g. "HTTP/2.0"
+	Protocol string `json:"protocol,omitempty"`
+	// RawHead is the scanned head HTML as parsed, only kept with DEBUG set
+	RawHead string `json:"raw_head,omitempty"`
+	// Descriptions lists every description the page declares, by source,
+	// for clients that prefer another one than Description
+	Descriptions []SourcedText `json:"descriptions,omitempty"`
+}
+
+// SourcedText is a metadata value together with the source it came from
+type SourcedText struct {
+	Source string `json:"source"`
+	Text   string `json:"text"`
+}
+
+// OGImage is one og:image together with its structured og:image:* properties
+type OGImage struct {
+	URL    string `json:"url"`
+	Width  int    `json:"width,omitempty"`
+	Height int    `json:"height,omitempty"`
+	Type   string `json:"type,omitempty"`
+	Alt    string `json:"alt,omitempty"`
+}
+
+// previewOptions holds per-request settings that change how a preview is fetched
+type previewOptions struct {
+	DebugTiming bool
+	// Debug returns the DebugInfo kept with every preview
+	Debug bool
+	// Namespace gives a front-end its own cache entries; "" is shared
+	Namespace string
+	// Refresh skips the cache read but stores the refetched preview;
+	// NoStore skips both the read and the write
+	Refresh bool
+	NoStore bool
+	// ExtractColor adds the preview image's dominant color
+	ExtractColor bool
+	// VerifyImage checks that the preview image loads, without downloading it
+	VerifyImage bool
+	// ReadingTime scans the body too, to estimate the reading time
+	ReadingTime bool
+	// NoImage skips image extraction for clients that don't show images;
+	// such previews aren't cached since they are incomplete
+	NoImage bool
+	// TTL overrides the cache TTL of the fetched preview, within the
+	// PREVIEW_CACHE_MIN_TTL and PREVIEW_CACHE_MAX_TTL bounds
+	TTL time.Duration
+	// BaseURL is where the client reached us, for links back to the service
+	BaseURL string
+	// Timings, if set, collects durations for the Server-Timing header
+	Timings *serverTimings
+	// Trace, if set, records the upstream round trips of the page fetch
+	// for ?debug_timing=1
+	Trace *timingTrace
+	// OnField receives fields as the scan finds them, for streaming; fallback
+	// user agent fetches may send a field again with a newer value
+	OnField func(name, value string)
 }
 
 type CacheMetrics struct {
@@ -42,13 +244,60 @@ type CacheMetrics struct {
 	PreviewSize   int   `json:"preview_cache_size"`
 	ImageSize     int   `json:"image_cache_size"`
 	MemoryUsageMB int64 `json:"memory_usage_mb"`
+
+	TotalBytesDownloaded int64 `json:"total_bytes_downloaded"`
+
+	// ActiveConnections are the upstream connections open now, in use or
+	// idle in the pool; TotalDials counts every connection ever opened
+	ActiveConnections int64 `json:"active_connections"`
+	TotalDials        int64 `json:"total_dials"`
+
+	// ImageProxyInFlight are the /proxy-image requests holding a slot now
+	ImageProxyInFlight int64 `json:"image_proxy_in_flight"`
+
+	// FetchErrors counts failed preview fetches by errorCategory
+	FetchErrors map[string]int64 `json:"fetch_errors"`
+
+	StartedAt     time.Time `json:"started_at"`
+	UptimeSeconds float64   `json:"uptime_seconds"`
+}
+
+// CheckResult is the /check response: whether a link resolves, without its body
+type CheckResult struct {
+	URL         string `json:"url"`
+	OK          bool   `json:"ok"`
+	Status      int    `json:"status"`
+	ContentType string `json:"content_type"`
+	Error       string `json:"error,omitempty"`
+}
+
+// PreviewCacheEntry holds a cached preview as-is, or as gzipped JSON in
+// Compressed when COMPRESS_PREVIEW_CACHE trades CPU for memory
+type PreviewCacheEntry struct {
+	Preview    Preview
+	Compressed []byte
+	ExpiresAt  time.Time
 }
 
 type ImageCacheEntry struct {
 	Data        []byte
 	ContentType string
+	// ETag is derived from Data; LastModified is forwarded from upstream
+	ETag         string
+	LastModified string
+}
+
+// fetchError carries a machine-readable code, and the upstream HTTP status
+// when there was one, alongside the underlying error
+type fetchError struct {
+	Code   string
+	Status int
+	Err    error
 }
 
+func (e *fetchError) Error() string { return e.Err.Error() }
+func (e *fetchError) Unwrap() error { return e.Err }
+
 var (
 	metaPropertyContentRe = regexp.MustCompile(`(?i)<meta[^>]+property=["']([^"']+)["'][^>]+content=["']([^"']+)["']`)
 	metaContentPropertyRe = regexp.MustCompile(`(?i)<meta[^>]+content=["']([^"']+)["'][^>]+property=["']([^"']+)["']`)
@@ -56,405 +305,4287 @@ var (
 	metaContentNameRe     = regexp.MustCompile(`(?i)<meta[^>]+content=["']([^"']+)["'][^>]+name=["']([^"']+)["']`)
 	titleRe               = regexp.MustCompile(`(?i)<title[^>]*>([^<]+)</title>`)
 	faviconRe             = regexp.MustCompile(`(?i)<link[^>]+rel=["'][^"']*icon[^"']*["'][^>]+href=["']([^"']+)["']`)
+	metaTagRe             = regexp.MustCompile(`(?i)<meta\s[^>]*>`)
+	linkTagRe             = regexp.MustCompile(`(?i)<(?:link|a)\s[^>]*>`)
+	attrRe                = regexp.MustCompile(`(?i)([a-z][a-z0-9_:.-]*)\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+	timeDatetimeRe        = regexp.MustCompile(`(?i)<time[^>]+datetime=["']([^"']+)["']`)
+	jsonLDRe              = regexp.MustCompile(`(?is)<script[^>]+type=["']application/ld\+json["'][^>]*>(.*?)</script>`)
+	itempropRe            = regexp.MustCompile(`(?i)(<[a-z][a-z0-9]*\s[^>]*\bitemprop\s*=\s*["'][^"']+["'][^>]*>)([^<]*)`)
 )
 
 var (
-	previewCache *lru.Cache[string, Preview]
+	previewCache *shardedCache[PreviewCacheEntry]
 	imageCache   *lru.Cache[string, ImageCacheEntry]
-	requestGroup singleflight.Group
-	metrics      CacheMetrics
-	metricsMu    sync.RWMutex
+	checkCache   *expirable.LRU[string, CheckResult]
+	imageHosts   *lru.Cache[string, struct{}]
+
+	// imageKeys maps image cache keys to content hashes when images are
+	// deduplicated, and imageCache is then keyed by those hashes
+	imageKeys *lru.Cache[string, string]
+
+	imageVariants   *lru.Cache[string, *lru.Cache[string, struct{}]]
+	imageVariantsMu sync.Mutex
+	faviconCache    *expirable.LRU[string, ImageCacheEntry]
+
+	// safeBrowsingCache maps URLs to their threat type, "" when safe
+	safeBrowsingCache *expirable.LRU[string, string]
+	requestGroup      singleflight.Group
+	imageGroup        singleflight.Group
+	metrics           = CacheMetrics{FetchErrors: make(map[string]int64)}
+	metricsMu         sync.RWMutex
+	startTime         = time.Now()
 
 	client = &http.Client{
 		Timeout: 10 * time.Second,
 		Transport: &http.Transport{
-			MaxIdleConns:        100,
-			MaxIdleConnsPerHost: 10,
-			IdleConnTimeout:     90 * time.Second,
-			DisableCompression:  false,
-			ForceAttemptHTTP2:   true,
-			DialContext: (&net.Dialer{
+			MaxIdleConns:           100,
+			MaxIdleConnsPerHost:    10,
+			MaxResponseHeaderBytes: int64(maxResponseHeaderBytes),
+			IdleConnTimeout:        90 * time.Second,
+			DisableCompression:     false,
+			ForceAttemptHTTP2:      true,
+			DialContext: countDials((&net.Dialer{
 				Timeout:   5 * time.Second,
 				KeepAlive: 30 * time.Second,
-			}).DialContext,
+			}).DialContext),
 		},
+		CheckRedirect: checkRedirect,
 	}
 
+	// maxResponseHeaderBytes rejects upstream responses with oversized
+	// headers before they are buffered
+	maxResponseHeaderBytes = envInt("MAX_RESPONSE_HEADER_BYTES", 64*1024)
+
 	userAgent = "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36"
 
+	// fallbackUserAgents are tried in order when userAgent gets no metadata,
+	// up to MaxUserAgentAttempts fetches in total; the list is |-separated
+	// since user agents contain commas
+	fallbackUserAgents = envList("FALLBACK_USER_AGENTS", "|", []string{
+		"facebookexternalhit/1.1 (+http://www.facebook.com/externalhit_uatext.php)",
+		"Twitterbot/1.0",
+	})
+
 	maxPreviewCacheEntries = 5000
+	previewCacheShards     = envInt("PREVIEW_CACHE_SHARDS", 16)
 	maxImageCacheEntries   = 50
 	imageCacheTTL          = 5 * time.Minute
-	cleanupInterval        = 5 * time.Minute
-)
+	maxImageBytes          = 2 * 1024 * 1024
+	maxCachedImageBytes    = 500 * 1024
+	maxImageWidth          = 2048
+	// maxImagePixels refuses images that would decode to more than 16
+	// megapixels; a small compressed file can declare huge dimensions
+	maxImagePixels   = 16 << 20
+	maxImageVariants = envInt("MAX_IMAGE_VARIANTS", 4)
+	// dedupeImages stores byte-identical images, e.g. CDN variants of one
+	// URL, once; keys are small, so many more of them are kept than images
+	dedupeImages        = envBool("DEDUPE_IMAGES", false)
+	maxImageKeysEntries = 4 * maxImageCacheEntries
+	// Cache sizes are refreshed every metricsInterval; the forced GC and
+	// stop-the-world MemStats read only every cleanupInterval
+	cleanupInterval = envDuration("MEMORY_STATS_INTERVAL", 5*time.Minute)
+	metricsInterval = envDuration("METRICS_INTERVAL", 15*time.Second)
 
-func init() {
-	var err error
+	// Above memoryHighWaterMB of heap the cleanup routine evicts the oldest
+	// cache entries until usage drops under memoryLowWaterMB; 0 disables it
+	memoryHighWaterMB    = envInt("MEMORY_HIGH_WATER_MB", 0)
+	memoryLowWaterMB     = envInt("MEMORY_LOW_WATER_MB", memoryHighWaterMB*8/10)
+	maxCheckCacheEntries = 1000
+	checkCacheTTL        = envDuration("CHECK_CACHE_TTL", 5*time.Minute)
+	compressPreviewCache = envBool("COMPRESS_PREVIEW_CACHE", false)
+	maxExtractBytes      = envInt("MAX_EXTRACT_BYTES", 1024*1024)
 
-	previewCache, err = lru.New[string, Preview](maxPreviewCacheEntries)
-	if err != nil {
-		log.Fatal("Failed to create preview cache:", err)
-	}
+	// imageRefererMode is "origin" to send the image's own origin as Referer
+	// when no ?referer= is given, or "none" to send nothing
+	imageRefererMode = envString("IMAGE_REFERER", "origin")
 
-	imageCache, err = lru.New[string, ImageCacheEntry](maxImageCacheEntries)
-	if err != nil {
-		log.Fatal("Failed to create image cache:", err)
-	}
+	// defaultImage replaces an og:image that can't be resolved to an absolute
+	// URL; by default such images are dropped
+	defaultImage = envString("DEFAULT_IMAGE", "")
 
-	go cleanupRoutine()
+	// stripTitleSiteName drops a trailing " | Site Name" from titles when it
+	// repeats og:site_name; the original title is kept in FullTitle
+	stripTitleSiteName = envBool("STRIP_TITLE_SITE_NAME", false)
 
-	log.Printf("Initialized with limits: %d preview entries, %d image entries", maxPreviewCacheEntries, maxImageCacheEntries)
-}
+	// titleHostFallback titles pages that have none with their host; without
+	// it their title is left empty for clients to fill in
+	titleHostFallback = envBool("TITLE_HOST_FALLBACK", true)
 
-func cleanupRoutine() {
-	ticker := time.NewTicker(cleanupInterval)
-	defer ticker.Stop()
+	// metadataSources are consulted in this order for the title, description
+	// and image; sources left out are ignored, and jsonld also stops JSON-LD
+	// logo and publish date fallbacks
+	metadataSources = envList("METADATA_SOURCES", ",", []string{"og", "twitter", "meta-name", "title-tag", "jsonld", "microdata"})
 
-	for range ticker.C {
-		runtime.GC()
-		var m runtime.MemStats
-		runtime.ReadMemStats(&m)
+	// debugMode enables debug logging, and keeps up to rawHeadMaxBytes of
+	// each scanned head for ?debug=1; that can expose page content, and costs
+	// cache memory, so it is never on by default
+	debugMode       = envBool("DEBUG", false)
+	rawHeadMaxBytes = 8 * 1024
 
-		metricsMu.Lock()
-		metrics.MemoryUsageMB = int64(m.Alloc / 1024 / 1024)
-		metrics.PreviewSize = previewCache.Len()
-		metrics.ImageSize = imageCache.Len()
-		metricsMu.Unlock()
+	listenAddr = envString("LISTEN_ADDR", ":5000")
 
-		log.Printf("Cache status: %d previews, %d images, %dMB memory",
-			previewCache.Len(), imageCache.Len(), m.Alloc/1024/1024)
-	}
-}
+	// trustedProxies may set X-Forwarded-* headers; by default only the
+	// local nginx
+	trustedProxies = envCIDRList("TRUSTED_PROXIES", "127.0.0.0/8,::1/128")
 
-func hashURL(u string) string {
-	h := md5.Sum([]byte(u))
-	return hex.EncodeToString(h[:])
-}
+	// adminToken guards /admin/config as a bearer token; unset disables it
+	adminToken = envString("ADMIN_TOKEN", "")
 
-// extractMetaTags parses HTML line-by-line and stops early when meta tags are found
-func extractMetaTags(reader io.Reader, maxBytes int) (title, description, image, siteName, favicon string) {
-	scanner := bufio.NewScanner(reader)
-	scanner.Buffer(make([]byte, 4096), maxBytes)
+	// With both set, the service serves HTTPS directly, checking the files
+	// for a renewed certificate at most every tlsReloadInterval
+	tlsCertFile       = envString("TLS_CERT_FILE", "")
+	tlsKeyFile        = envString("TLS_KEY_FILE", "")
+	tlsReloadInterval = envDuration("TLS_RELOAD_INTERVAL", 10*time.Second)
 
-	var htmlBuffer strings.Builder
-	var foundTitle, foundDesc, foundImage, foundSite, foundFavicon bool
-	bytesRead := 0
-	const maxScan = 50000
+	allowedPorts = envIntList("ALLOWED_PORTS", []int{80, 443})
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		bytesRead += len(line)
-		htmlBuffer.WriteString(line)
-		htmlBuffer.WriteString("\n")
+	// allowedDomains, when set, restricts fetches to these domains and their
+	// subdomains; blockedDomains are refused even if allowed
+	allowedDomains = envList("ALLOWED_DOMAINS", ",", nil)
+	blockedDomains = envList("BLOCKED_DOMAINS", ",", nil)
 
-		if !foundTitle && (strings.Contains(line, "og:title") || strings.Contains(line, "twitter:title") || strings.Contains(line, "<title")) {
-			if t := extractMetaFromBuffer(htmlBuffer.String(), "og:title"); t != "" {
-				title = t
-				foundTitle = true
-			} else if t := extractMetaFromBuffer(htmlBuffer.String(), "twitter:title"); t != "" {
-				title = t
-				foundTitle = true
-			} else if m := titleRe.FindStringSubmatch(htmlBuffer.String()); len(m) > 1 {
-				title = strings.TrimSpace(m[1])
-				foundTitle = true
-			}
-		}
+	// sameSiteRedirects rejects redirects that leave the registrable domain
+	// of the first non-shortener host, unless the target is in
+	// redirectAllowedDomains
+	sameSiteRedirects      = envBool("SAME_SITE_REDIRECTS", false)
+	redirectAllowedDomains = envList("REDIRECT_ALLOWED_DOMAINS", ",", nil)
 
-		if !foundDesc && (strings.Contains(line, "og:description") || strings.Contains(line, "twitter:description") || strings.Contains(line, `name="description"`)) {
-			if d := extractMetaFromBuffer(htmlBuffer.String(), "og:description"); d != "" {
-				description = d
-				foundDesc = true
-			} else if d := extractMetaFromBuffer(htmlBuffer.String(), "twitter:description"); d != "" {
-				description = d
-				foundDesc = true
-			} else if d := extractMetaFromBuffer(htmlBuffer.String(), "description"); d != "" {
-				description = d
-				foundDesc = true
-			}
-		}
+	// shortenerDomains only redirect elsewhere, so their hops don't count
+	// against MaxRedirects, up to maxShortenerRedirects of them
+	shortenerDomains = envList("SHORTENER_DOMAINS", ",", []string{
+		"t.co", "bit.ly", "goo.gl", "tinyurl.com", "ow.ly", "buff.ly", "is.gd",
+		"lnkd.in", "dlvr.it", "t.ly", "rebrand.ly", "tiny.cc", "shorturl.at",
+	})
+	maxShortenerRedirects = 10
 
-		if !foundImage && (strings.Contains(line, "og:image") || strings.Contains(line, "twitter:image")) {
-			if i := extractMetaFromBuffer(htmlBuffer.String(), "og:image"); i != "" {
-				image = i
-				foundImage = true
-			} else if i := extractMetaFromBuffer(htmlBuffer.String(), "twitter:image"); i != "" {
-				image = i
-				foundImage = true
-			}
-		}
+	// proxyKnownImageHostsOnly limits the image proxy to hosts that served
+	// images for previously previewed pages, so it can't be used as an open
+	// proxy; up to maxImageHosts hosts are remembered
+	proxyKnownImageHostsOnly = envBool("PROXY_KNOWN_IMAGE_HOSTS_ONLY", false)
+	maxImageHosts            = 1000
 
-		if !foundSite && strings.Contains(line, "og:site_name") {
-			if s := extractMetaFromBuffer(htmlBuffer.String(), "og:site_name"); s != "" {
-				siteName = s
-				foundSite = true
-			}
-		}
+	// extractOnStatus lists non-200 statuses whose HTML is still scanned for
+	// metadata, e.g. 404,410; the preview keeps the upstream status
+	extractOnStatus = envIntList("EXTRACT_ON_STATUS", nil)
 
-		if !foundFavicon && strings.Contains(line, "icon") {
-			if m := faviconRe.FindStringSubmatch(htmlBuffer.String()); len(m) > 1 {
-				favicon = strings.TrimSpace(m[1])
-				foundFavicon = true
-			}
-		}
+	// Page fetches answered with a status in retryOnStatus are retried once
+	// after the upstream's Retry-After (1s without one), unless it asks for
+	// longer than retryMaxWait or the wait wouldn't fit in the deadline
+	retryOnStatus = envIntList("RETRY_ON_STATUS", []int{429, 503})
+	retryMaxWait  = envDuration("RETRY_MAX_WAIT", 3*time.Second)
 
-		if (foundTitle && foundDesc && foundImage && foundSite && foundFavicon) || bytesRead > maxScan {
-			break
-		}
-	}
+	// scanBufferSize is the scanner's initial buffer, sized so typical heads
+	// don't trigger repeated reallocations; at least 1KB
+	scanBufferSize = max(1024, envInt("SCAN_BUFFER_SIZE", 16*1024))
+
+	// fetchManifest reads the web app manifest for its colors, and for icons
+	// when the page declares no icon links
+	fetchManifest     = envBool("FETCH_MANIFEST", false)
+	manifestMaxBytes  = envInt("MANIFEST_MAX_BYTES", 64*1024)
+	preferredIconSize = 192
+
+	// fetchFeedInfo reads the start of the first discovered feed for its
+	// title and format; feedMaxBytes bounds the read
+	fetchFeedInfo = envBool("FETCH_FEED_INFO", false)
+	feedMaxBytes  = envInt("FEED_MAX_BYTES", 16*1024)
 
-	return
+	// verifyIcons fetches favicon and logo candidates to check they are real
+	// images, falling back when they aren't; fetches are capped at iconMaxBytes
+	verifyIcons  = envBool("VERIFY_ICONS", false)
+	iconMaxBytes = envInt("ICON_MAX_BYTES", 256*1024)
+
+	// probeIcons looks for an icon at iconProbePaths, in order, when a page
+	// declares none and /favicon.ico is missing; probes are HEAD requests
+	// bounded together by FaviconTimeout
+	probeIcons     = envBool("PROBE_ICONS", false)
+	iconProbePaths = envList("ICON_PROBE_PATHS", ",", []string{"/apple-touch-icon.png", "/apple-touch-icon-precomposed.png", "/favicon.png"})
+
+	// /proxy-favicon keeps icons longer than images; faviconService is the
+	// last fallback, with {domain} replaced by the icon's host ("" disables it)
+	maxFaviconCacheEntries = 500
+	faviconCacheTTL        = envDuration("FAVICON_CACHE_TTL", 24*time.Hour)
+	faviconService         = envString("FAVICON_SERVICE", "https://www.google.com/s2/favicons?domain={domain}&sz=64")
+
+	// screenshotService, when set, renders pages without an image, with {url}
+	// replaced by the page URL. Previews get a /proxy-image?screenshot=1 URL
+	// as their image, so clients never see the backend; it is only requested
+	// once a client loads the image, and cached like any other image.
+	screenshotService = envString("SCREENSHOT_SERVICE", "")
+
+	colorSampleSize = 64
+
+	wordsPerMinute = 200.0
+
+	// With safeBrowsingKey set, previews are checked against Google Safe
+	// Browsing; safeBrowsingURL can point at a compatible mock
+	safeBrowsingKey             = envString("SAFE_BROWSING_API_KEY", "")
+	safeBrowsingURL             = envString("SAFE_BROWSING_URL", "https://safebrowsing.googleapis.com/v4/threatMatches:find")
+	safeBrowsingCacheTTL        = envDuration("SAFE_BROWSING_CACHE_TTL", 30*time.Minute)
+	maxSafeBrowsingCacheEntries = 5000
+
+	// Response policy headers for previews and proxied images; "off" omits one
+	referrerPolicy            = envString("REFERRER_POLICY", "no-referrer")
+	crossOriginResourcePolicy = envString("CROSS_ORIGIN_RESOURCE_POLICY", "cross-origin")
+
+	// With http3Enabled, which is experimental, origins advertising h3 in
+	// Alt-Svc are fetched over HTTP/3 for http3HostsTTL, falling back to
+	// HTTP/2 or 1.1 when it fails
+	http3Enabled  = envBool("HTTP3_ENABLED", false)
+	http3HostsTTL = envDuration("HTTP3_HOSTS_TTL", time.Hour)
+	maxHTTP3Hosts = 1000
+
+	// Limits per /ws connection: concurrent fetches, and URLs accepted per minute
+	wsConcurrency     = envInt("WS_CONCURRENCY", 4)
+	wsURLsPerMinute   = envInt("WS_URLS_PER_MINUTE", 60)
+	wsMaxMessageBytes = 8 * 1024
+
+	// proxyImageConcurrency caps concurrent /proxy-image requests; a request
+	// waiting longer than proxyImageQueueTimeout for a slot gets a 503
+	proxyImageConcurrency  = envInt("PROXY_IMAGE_CONCURRENCY", 32)
+	proxyImageQueueTimeout = envDuration("PROXY_IMAGE_QUEUE_TIMEOUT", 2*time.Second)
+)
+
+// upstreamOptions are the per-request settings of an upstream fetch. They are
+// applied to the *http.Request and its context, never to the shared client:
+// concurrent fetches can't see each other's settings, and all of them reuse
+// client's transport and its connection pool. client.Timeout still caps
+// every request.
+type upstreamOptions struct {
+	UserAgent string // defaults to userAgent
+	Referer   string
+	Accept    string
+	Range     string
+	// Body is sent with ContentType, e.g. for POSTs to APIs
+	Body        io.Reader
+	ContentType string
+	// Timeout, if set, bounds this request including reading its body
+	Timeout time.Duration
 }
 
-func extractMetaFromBuffer(htmlStr, property string) string {
-	if matches := metaPropertyContentRe.FindAllStringSubmatch(htmlStr, -1); len(matches) > 0 {
-		for _, m := range matches {
-			if len(m) > 2 && strings.EqualFold(m[1], property) {
-				return strings.TrimSpace(m[2])
-			}
-		}
+// doUpstream sends a request built from opts through the shared client
+func doUpstream(ctx context.Context, method, targetURL string, opts upstreamOptions) (*http.Response, error) {
+	cancel := context.CancelFunc(func() {})
+	if opts.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
 	}
 
-	if matches := metaContentPropertyRe.FindAllStringSubmatch(htmlStr, -1); len(matches) > 0 {
-		for _, m := range matches {
-			if len(m) > 2 && strings.EqualFold(m[2], property) {
-				return strings.TrimSpace(m[1])
-			}
+	req, err := http.NewRequestWithContext(ctx, method, targetURL, opts.Body)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	req.Header.Set("User-Agent", cmp.Or(opts.UserAgent, userAgent))
+	for name, value := range map[string]string{"Referer": opts.Referer, "Accept": opts.Accept, "Range": opts.Range, "Content-Type": opts.ContentType} {
+		if value != "" {
+			req.Header.Set(name, value)
 		}
 	}
 
-	if matches := metaNameContentRe.FindAllStringSubmatch(htmlStr, -1); len(matches) > 0 {
-		for _, m := range matches {
-			if len(m) > 2 && strings.EqualFold(m[1], property) {
-				return strings.TrimSpace(m[2])
-			}
+	resp, err := client.Do(req)
+	if err != nil {
+		cancel()
+		if isHeaderLimitError(err) {
+			return nil, &fetchError{Code: "headers_too_large", Err: err}
 		}
+		return nil, err
 	}
+	resp.Body = &cancelOnClose{resp.Body, cancel}
+	return resp, nil
+}
 
-	if matches := metaContentNameRe.FindAllStringSubmatch(htmlStr, -1); len(matches) > 0 {
-		for _, m := range matches {
-			if len(m) > 2 && strings.EqualFold(m[2], property) {
-				return strings.TrimSpace(m[1])
+// isHeaderLimitError reports whether the transport gave up on a response for
+// exceeding maxResponseHeaderBytes; neither HTTP/1 nor HTTP/2 exports a
+// sentinel for it
+func isHeaderLimitError(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "response headers exceeded") || strings.Contains(msg, "header list larger than")
+}
+
+// altSvcTransport sends HTTPS requests over HTTP/3 to hosts that advertised
+// it on the same port, and everything else, including requests whose HTTP/3
+// attempt failed, over base
+type altSvcTransport struct {
+	base  http.RoundTripper
+	h3    *http3.Transport
+	hosts *expirable.LRU[string, struct{}]
+}
+
+func (t *altSvcTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	if req.URL.Scheme == "https" && t.hosts.Contains(host) {
+		resp, err := t.h3.RoundTrip(req)
+		if err == nil {
+			return resp, nil
+		}
+		t.hosts.Remove(host)
+		if req.Body != nil && req.Body != http.NoBody {
+			if req.GetBody == nil {
+				return nil, err
 			}
+			body, bodyErr := req.GetBody()
+			if bodyErr != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
 		}
 	}
 
-	return ""
+	resp, err := t.base.RoundTrip(req)
+	if err == nil && req.URL.Scheme == "https" {
+		switch altSvc := resp.Header.Get("Alt-Svc"); {
+		case altSvc == "clear":
+			t.hosts.Remove(host)
+		case advertisesHTTP3(altSvc, cmp.Or(req.URL.Port(), "443")):
+			t.hosts.Add(host, struct{}{})
+		}
+	}
+	return resp, err
 }
 
-func resolveURL(href, base string) string {
-	if strings.HasPrefix(href, "http") {
-		return href
+// CloseIdleConnections closes idle connections of both transports, so
+// client.CloseIdleConnections still reaches them
+func (t *altSvcTransport) CloseIdleConnections() {
+	if closer, ok := t.base.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
 	}
-	if u, err := url.Parse(base); err == nil {
-		if ref, err := url.Parse(href); err == nil {
-			return u.ResolveReference(ref).String()
+	t.h3.CloseIdleConnections()
+}
+
+// advertisesHTTP3 reports whether an Alt-Svc header offers h3 on port of the
+// same host, the only alternative the HTTP/3 transport can reach
+func advertisesHTTP3(altSvc, port string) bool {
+	for _, service := range strings.Split(altSvc, ",") {
+		protocol, authority, _ := strings.Cut(strings.TrimSpace(service), "=")
+		authority, _, _ = strings.Cut(authority, ";")
+		if protocol == "h3" && strings.Trim(strings.TrimSpace(authority), `"`) == ":"+port {
+			return true
 		}
 	}
-	return href
+	return false
 }
 
-func truncate(s string, maxLen int) string {
-	if len(s) > maxLen {
-		return s[:maxLen]
-	}
-	return s
+// cancelOnClose releases a request's timeout context once its body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
 }
 
-func fetchPreview(targetURL string) Preview {
-	cacheKey := hashURL(targetURL)
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
 
-	if cached, ok := previewCache.Get(cacheKey); ok {
-		metricsMu.Lock()
-		metrics.PreviewHits++
-		metricsMu.Unlock()
-		return cached
+// shardedCache spreads entries over independent LRUs picked by key hash, so
+// concurrent writers don't all serialize on a single cache lock. Eviction is
+// per shard, which approximates a global LRU for evenly hashed keys.
+type shardedCache[V any] struct {
+	shards []*lru.Cache[string, V]
+}
+
+func newShardedCache[V any](size, shards int) (*shardedCache[V], error) {
+	shards = max(1, shards)
+	perShard := max(1, (size+shards-1)/shards)
+
+	c := &shardedCache[V]{shards: make([]*lru.Cache[string, V], shards)}
+	for i := range c.shards {
+		shard, err := lru.New[string, V](perShard)
+		if err != nil {
+			return nil, err
+		}
+		c.shards[i] = shard
 	}
+	return c, nil
+}
 
-	metricsMu.Lock()
-	metrics.PreviewMisses++
-	metricsMu.Unlock()
+func (c *shardedCache[V]) shard(key string) *lru.Cache[string, V] {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return c.shards[h.Sum32()%uint32(len(c.shards))]
+}
 
-	result, err, _ := requestGroup.Do(targetURL, func() (interface{}, error) {
-		return fetchPreviewInternal(targetURL)
-	})
+func (c *shardedCache[V]) Get(key string) (V, bool) { return c.shard(key).Get(key) }
+func (c *shardedCache[V]) Add(key string, value V)  { c.shard(key).Add(key, value) }
+func (c *shardedCache[V]) Remove(key string)        { c.shard(key).Remove(key) }
 
-	if err != nil {
-		return Preview{URL: targetURL, Error: err.Error()}
+// RemoveOldest evicts up to n of the oldest entries, spread evenly over the
+// shards, and returns how many were removed
+func (c *shardedCache[V]) RemoveOldest(n int) int {
+	removed := 0
+	for removed < n {
+		progress := false
+		for _, shard := range c.shards {
+			if removed == n {
+				break
+			}
+			if _, _, ok := shard.RemoveOldest(); ok {
+				removed++
+				progress = true
+			}
+		}
+		if !progress {
+			break
+		}
 	}
-
-	preview := result.(Preview)
-	previewCache.Add(cacheKey, preview)
-	return preview
+	return removed
 }
 
-func fetchPreviewInternal(targetURL string) (Preview, error) {
-	parsed, err := url.Parse(targetURL)
-	if err != nil {
-		return Preview{URL: targetURL, Error: "Invalid URL"}, err
+func (c *shardedCache[V]) Len() int {
+	n := 0
+	for _, shard := range c.shards {
+		n += shard.Len()
 	}
+	return n
+}
 
-	req, _ := http.NewRequest("GET", targetURL, nil)
-	req.Header.Set("User-Agent", userAgent)
-	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+func envString(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
 
-	resp, err := client.Do(req)
+func envInt(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
 	if err != nil {
-		return Preview{URL: targetURL, Error: "Failed to fetch"}, err
+		log.Printf("Invalid %s=%q, using default %d", key, v, def)
+		return def
 	}
-	defer resp.Body.Close()
+	return n
+}
 
-	if resp.StatusCode != 200 {
-		return Preview{URL: targetURL, Error: "HTTP " + resp.Status}, fmt.Errorf("HTTP %d", resp.StatusCode)
+func envBool(key string, def bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
 	}
-
-	title, description, image, siteName, favicon := extractMetaTags(resp.Body, 100000)
-
-	if title == "" {
-		title = parsed.Host
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Printf("Invalid %s=%q, using default %t", key, v, def)
+		return def
 	}
-	title = html.UnescapeString(title)
+	return b
+}
 
-	if description != "" {
-		description = html.UnescapeString(description)
+func envDuration(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
 	}
-
-	if image != "" {
-		image = resolveURL(image, targetURL)
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Printf("Invalid %s=%q, using default %s", key, v, def)
+		return def
 	}
+	return d
+}
 
-	if siteName == "" {
-		siteName = parsed.Host
+func envList(key, sep string, def []string) []string {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
 	}
-
-	if favicon == "" {
-		favicon = parsed.Scheme + "://" + parsed.Host + "/favicon.ico"
-	} else {
-		favicon = resolveURL(favicon, targetURL)
+	var list []string
+	for _, part := range strings.Split(v, sep) {
+		if part = strings.TrimSpace(part); part != "" {
+			list = append(list, part)
+		}
 	}
+	return list
+}
 
-	preview := Preview{
-		URL:         targetURL,
-		Title:       truncate(title, 200),
-		Description: truncate(description, 300),
-		Image:       image,
-		SiteName:    siteName,
-		Favicon:     favicon,
-		Domain:      parsed.Host,
+// envCIDRList parses a comma-separated list of CIDRs or bare IPs
+func envCIDRList(key, def string) []*net.IPNet {
+	parse := func(v string) ([]*net.IPNet, error) {
+		var list []*net.IPNet
+		for _, part := range strings.Split(v, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			if !strings.Contains(part, "/") {
+				if ip := net.ParseIP(part); ip != nil && ip.To4() != nil {
+					part += "/32"
+				} else {
+					part += "/128"
+				}
+			}
+			_, cidr, err := net.ParseCIDR(part)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, cidr)
+		}
+		return list, nil
 	}
 
-	return preview, nil
+	list, _ := parse(def)
+	if v := os.Getenv(key); v != "" {
+		parsed, err := parse(v)
+		if err != nil {
+			log.Printf("Invalid %s=%q, using default %s", key, v, def)
+			return list
+		}
+		list = parsed
+	}
+	return list
 }
 
-func corsMiddleware(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
-		if r.Method == "OPTIONS" {
-			return
+func envIntList(key string, def []int) []int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	var list []int
+	for _, part := range strings.Split(v, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			log.Printf("Invalid %s=%q, using default %v", key, v, def)
+			return def
 		}
-		next(w, r)
+		list = append(list, n)
 	}
+	return list
 }
 
-func cacheHeadersMiddleware(next http.HandlerFunc, maxAge int) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", maxAge))
-		next(w, r)
-	}
+// runtimeConfig holds the settings that can be changed while running via
+// /admin/config; cache sizes aren't among them since the caches are sized once
+type runtimeConfig struct {
+	// RequestDeadline bounds a whole preview fetch, including redirects and
+	// body reads, independently of the per-attempt client timeout
+	RequestDeadline time.Duration
+	// ScanLimit is how many bytes of a page are scanned for metadata
+	ScanLimit int
+	// MaxRepeatedFields caps list fields like Images so a page declaring
+	// thousands of tags can't bloat its cache entry
+	MaxRepeatedFields    int
+	MaxRedirects         int
+	MaxUserAgentAttempts int
+	ManifestTimeout      time.Duration
+	FeedTimeout          time.Duration
+	// ColorTimeout bounds the image fetch for ?extract_color=1
+	ColorTimeout        time.Duration
+	FaviconTimeout      time.Duration
+	SafeBrowsingTimeout time.Duration
+
+	PreviewCacheTTL    time.Duration
+	PreviewCacheMinTTL time.Duration
+	PreviewCacheMaxTTL time.Duration
+	// PreviewCacheTTLJitter is the percentage by which entry TTLs are spread
+	PreviewCacheTTLJitter int
 }
 
-func handlePreview(w http.ResponseWriter, r *http.Request) {
-	targetURL := r.URL.Query().Get("url")
+// liveConfig is swapped whole on updates, so readers never see a mix of old
+// and new values
+var (
+	liveConfig   atomic.Pointer[runtimeConfig]
+	liveConfigMu sync.Mutex
+)
+
+func cfg() *runtimeConfig {
+	return liveConfig.Load()
+}
+
+func loadRuntimeConfig() *runtimeConfig {
+	return &runtimeConfig{
+		RequestDeadline:       envDuration("REQUEST_DEADLINE", 15*time.Second),
+		ScanLimit:             envInt("SCAN_LIMIT", 50000),
+		MaxRepeatedFields:     envInt("MAX_REPEATED_FIELDS", 10),
+		MaxRedirects:          envInt("MAX_REDIRECTS", 5),
+		MaxUserAgentAttempts:  envInt("MAX_USER_AGENT_ATTEMPTS", 3),
+		ManifestTimeout:       envDuration("MANIFEST_TIMEOUT", 3*time.Second),
+		FeedTimeout:           envDuration("FEED_TIMEOUT", 3*time.Second),
+		ColorTimeout:          envDuration("COLOR_TIMEOUT", 5*time.Second),
+		FaviconTimeout:        envDuration("FAVICON_TIMEOUT", 5*time.Second),
+		SafeBrowsingTimeout:   envDuration("SAFE_BROWSING_TIMEOUT", 3*time.Second),
+		PreviewCacheTTL:       envDuration("PREVIEW_CACHE_TTL", time.Hour),
+		PreviewCacheMinTTL:    envDuration("PREVIEW_CACHE_MIN_TTL", time.Minute),
+		PreviewCacheMaxTTL:    envDuration("PREVIEW_CACHE_MAX_TTL", 24*time.Hour),
+		PreviewCacheTTLJitter: envInt("PREVIEW_CACHE_TTL_JITTER", 10),
+	}
+}
+
+// configField exposes one runtimeConfig setting to /admin/config; exactly one
+// of duration and number is set, with number values required to be >= min
+type configField struct {
+	name     string
+	duration func(*runtimeConfig) *time.Duration
+	number   func(*runtimeConfig) *int
+	min      int
+}
+
+var configFields = []configField{
+	{name: "request_deadline", duration: func(c *runtimeConfig) *time.Duration { return &c.RequestDeadline }},
+	{name: "scan_limit", number: func(c *runtimeConfig) *int { return &c.ScanLimit }, min: 1024},
+	{name: "max_repeated_fields", number: func(c *runtimeConfig) *int { return &c.MaxRepeatedFields }, min: 1},
+	{name: "max_redirects", number: func(c *runtimeConfig) *int { return &c.MaxRedirects }},
+	{name: "max_user_agent_attempts", number: func(c *runtimeConfig) *int { return &c.MaxUserAgentAttempts }, min: 1},
+	{name: "manifest_timeout", duration: func(c *runtimeConfig) *time.Duration { return &c.ManifestTimeout }},
+	{name: "feed_timeout", duration: func(c *runtimeConfig) *time.Duration { return &c.FeedTimeout }},
+	{name: "color_timeout", duration: func(c *runtimeConfig) *time.Duration { return &c.ColorTimeout }},
+	{name: "favicon_timeout", duration: func(c *runtimeConfig) *time.Duration { return &c.FaviconTimeout }},
+	{name: "safe_browsing_timeout", duration: func(c *runtimeConfig) *time.Duration { return &c.SafeBrowsingTimeout }},
+	{name: "preview_cache_ttl", duration: func(c *runtimeConfig) *time.Duration { return &c.PreviewCacheTTL }},
+	{name: "preview_cache_min_ttl", duration: func(c *runtimeConfig) *time.Duration { return &c.PreviewCacheMinTTL }},
+	{name: "preview_cache_max_ttl", duration: func(c *runtimeConfig) *time.Duration { return &c.PreviewCacheMaxTTL }},
+	{name: "preview_cache_ttl_jitter", number: func(c *runtimeConfig) *int { return &c.PreviewCacheTTLJitter }},
+}
+
+// values renders c as served by GET /admin/config, durations as Go duration strings
+func (c *runtimeConfig) values() map[string]any {
+	values := make(map[string]any, len(configFields))
+	for _, f := range configFields {
+		if f.duration != nil {
+			values[f.name] = f.duration(c).String()
+		} else {
+			values[f.name] = *f.number(c)
+		}
+	}
+	return values
+}
+
+// apply sets the fields in update on c, failing on unknown names and values
+// out of range so a bad update changes nothing
+func (c *runtimeConfig) apply(update map[string]json.RawMessage) error {
+	for name, raw := range update {
+		i := slices.IndexFunc(configFields, func(f configField) bool { return f.name == name })
+		if i < 0 {
+			return fmt.Errorf("unknown setting %q", name)
+		}
+		f := configFields[i]
+		if f.duration != nil {
+			var s string
+			if err := json.Unmarshal(raw, &s); err != nil {
+				return fmt.Errorf("%s: expected a duration string like \"5s\"", name)
+			}
+			d, err := time.ParseDuration(s)
+			if err != nil || d <= 0 {
+				return fmt.Errorf("%s: invalid duration %q", name, s)
+			}
+			*f.duration(c) = d
+			continue
+		}
+		var n int
+		if err := json.Unmarshal(raw, &n); err != nil {
+			return fmt.Errorf("%s: expected an integer", name)
+		}
+		if n < f.min {
+			return fmt.Errorf("%s: must be at least %d", name, f.min)
+		}
+		*f.number(c) = n
+	}
+	if c.PreviewCacheMinTTL > c.PreviewCacheMaxTTL {
+		return fmt.Errorf("preview_cache_min_ttl exceeds preview_cache_max_ttl")
+	}
+	return nil
+}
+
+func init() {
+	var err error
+
+	liveConfig.Store(loadRuntimeConfig())
+
+	if http3Enabled {
+		client.Transport = &altSvcTransport{
+			base:  client.Transport,
+			h3:    &http3.Transport{MaxResponseHeaderBytes: int64(maxResponseHeaderBytes)},
+			hosts: expirable.NewLRU[string, struct{}](maxHTTP3Hosts, nil, http3HostsTTL),
+		}
+	}
+
+	for _, source := range metadataSources {
+		if _, ok := sourceProperties[source]; !ok && !slices.Contains([]string{"title-tag", "jsonld", "microdata"}, source) {
+			log.Printf("Ignoring unknown metadata source %q in METADATA_SOURCES", source)
+		}
+	}
+
+	previewCache, err = newShardedCache[PreviewCacheEntry](maxPreviewCacheEntries, previewCacheShards)
+	if err != nil {
+		log.Fatal("Failed to create preview cache:", err)
+	}
+
+	imageCache, err = lru.New[string, ImageCacheEntry](maxImageCacheEntries)
+	if err != nil {
+		log.Fatal("Failed to create image cache:", err)
+	}
+
+	imageKeys, err = lru.New[string, string](maxImageKeysEntries)
+	if err != nil {
+		log.Fatal("Failed to create image key index:", err)
+	}
+
+	checkCache = expirable.NewLRU[string, CheckResult](maxCheckCacheEntries, nil, checkCacheTTL)
+
+	faviconCache = expirable.NewLRU[string, ImageCacheEntry](maxFaviconCacheEntries, nil, faviconCacheTTL)
+	safeBrowsingCache = expirable.NewLRU[string, string](maxSafeBrowsingCacheEntries, nil, safeBrowsingCacheTTL)
+
+	imageVariants, err = lru.New[string, *lru.Cache[string, struct{}]](maxImageCacheEntries)
+	if err != nil {
+		log.Fatal("Failed to create image variant index:", err)
+	}
+
+	imageHosts, err = lru.New[string, struct{}](maxImageHosts)
+	if err != nil {
+		log.Fatal("Failed to create image host cache:", err)
+	}
+
+	go cleanupRoutine()
+
+	log.Printf("Initialized with limits: %d preview entries, %d image entries", maxPreviewCacheEntries, maxImageCacheEntries)
+}
+
+func cleanupRoutine() {
+	sizeTicker := time.NewTicker(metricsInterval)
+	defer sizeTicker.Stop()
+	memoryTicker := time.NewTicker(cleanupInterval)
+	defer memoryTicker.Stop()
+
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	updateMemoryMetrics(&m)
+	updateCacheMetrics()
+
+	for {
+		select {
+		case <-sizeTicker.C:
+			updateCacheMetrics()
+		case <-memoryTicker.C:
+			runtime.GC()
+			runtime.ReadMemStats(&m)
+			if memoryHighWaterMB > 0 && m.Alloc/1024/1024 > uint64(memoryHighWaterMB) {
+				evictUnderPressure(&m)
+			}
+			updateMemoryMetrics(&m)
+			updateCacheMetrics()
+
+			log.Printf("Cache status: %d previews, %d images, %dMB memory",
+				previewCache.Len(), imageCache.Len(), m.Alloc/1024/1024)
+		}
+	}
+}
+
+// updateCacheMetrics refreshes the cache sizes, which is cheap
+func updateCacheMetrics() {
+	previews, images := previewCache.Len(), imageCache.Len()
+	metricsMu.Lock()
+	metrics.PreviewSize = previews
+	metrics.ImageSize = images
+	metricsMu.Unlock()
+}
+
+func updateMemoryMetrics(m *runtime.MemStats) {
+	metricsMu.Lock()
+	metrics.MemoryUsageMB = int64(m.Alloc / 1024 / 1024)
+	metricsMu.Unlock()
+}
+
+// evictUnderPressure drops the oldest tenth of both caches at a time until
+// heap usage falls below the low-water mark or the caches are empty
+func evictUnderPressure(m *runtime.MemStats) {
+	startMB := m.Alloc / 1024 / 1024
+	previews, images := 0, 0
+	for m.Alloc/1024/1024 >= uint64(memoryLowWaterMB) {
+		if previewCache.Len() == 0 && imageCache.Len() == 0 {
+			break
+		}
+		previews += previewCache.RemoveOldest(max(1, previewCache.Len()/10))
+		for range max(1, imageCache.Len()/10) {
+			if _, _, ok := imageCache.RemoveOldest(); ok {
+				images++
+			}
+		}
+		runtime.GC()
+		runtime.ReadMemStats(m)
+	}
+	log.Printf("Memory %dMB above high-water mark %dMB: evicted %d previews and %d images, now %dMB",
+		startMB, memoryHighWaterMB, previews, images, m.Alloc/1024/1024)
+}
+
+func debugf(format string, args ...any) {
+	if debugMode {
+		log.Printf(format, args...)
+	}
+}
+
+// Upstream connection counters, kept outside metrics since every dial and
+// close updates them
+var activeConnections, totalDials atomic.Int64
+
+var (
+	proxyImageSlots    = make(chan struct{}, max(1, proxyImageConcurrency))
+	imageProxyInFlight atomic.Int64
+)
+
+// countDials wraps a dial function to count the connections it opens and
+// that are still open
+func countDials(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		totalDials.Add(1)
+		activeConnections.Add(1)
+		return &countedConn{Conn: conn}, nil
+	}
+}
+
+// countedConn decrements activeConnections on its first Close
+type countedConn struct {
+	net.Conn
+	closed atomic.Bool
+}
+
+func (c *countedConn) Close() error {
+	if c.closed.CompareAndSwap(false, true) {
+		activeConnections.Add(-1)
+	}
+	return c.Conn.Close()
+}
+
+// countingBody tallies the bytes read from an upstream response body
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingBody) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// countDownload wraps resp.Body to count the bytes read from it; call the
+// returned func once the body is done to add them to the metrics
+func countDownload(resp *http.Response, kind, u string) func() {
+	body := &countingBody{ReadCloser: resp.Body}
+	resp.Body = body
+	return func() {
+		metricsMu.Lock()
+		metrics.TotalBytesDownloaded += body.n
+		metricsMu.Unlock()
+		debugf("Downloaded %d bytes for %s %s", body.n, kind, u)
+	}
+}
+
+func hashURL(u string) string {
+	h := md5.Sum([]byte(u))
+	return hex.EncodeToString(h[:])
+}
+
+// contentHash fingerprints the normalized metadata so mirrors and aliases of
+// the same page can be deduplicated by clients regardless of their URL. The
+// host filled in for a missing title or site name is left out, since it
+// differs between mirrors.
+func contentHash(p Preview) string {
+	normalize := func(s string) string {
+		return strings.ToLower(strings.Join(strings.Fields(s), " "))
+	}
+	title, siteName := p.Title, p.SiteName
+	if !p.HasTitle {
+		title = ""
+	}
+	if siteName == p.Domain {
+		siteName = ""
+	}
+	h := md5.Sum([]byte(strings.Join([]string{
+		normalize(title),
+		normalize(p.Description),
+		p.Image,
+		normalize(siteName),
+	}, "\x00")))
+	return hex.EncodeToString(h[:])
+}
+
+var isoDurationRe = regexp.MustCompile(`(?i)^P(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+(?:\.\d+)?)S)?)?$`)
+
+// playerDimensions returns the embed player's declared size, preferring the
+// twitter:player card over og:video; both width and height must be present
+func playerDimensions(html string) (width, height string) {
+	for _, prefix := range []string{"twitter:player", "og:video"} {
+		width, height = extractMetaFromBuffer(html, prefix+":width"), extractMetaFromBuffer(html, prefix+":height")
+		if width != "" && height != "" {
+			return width, height
+		}
+	}
+	return "", ""
+}
+
+// aspectRatio reduces pixel dimensions to a ratio like "16:9", or "" when
+// they aren't positive integers
+func aspectRatio(width, height string) string {
+	w, err := strconv.Atoi(strings.TrimSpace(width))
+	if err != nil || w <= 0 {
+		return ""
+	}
+	h, err := strconv.Atoi(strings.TrimSpace(height))
+	if err != nil || h <= 0 {
+		return ""
+	}
+	a, b := w, h
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return fmt.Sprintf("%d:%d", w/a, h/a)
+}
+
+// parseVideoDuration converts plain seconds, ISO 8601 (PT1M30S), clock
+// (1:30) or Go-style (1m30s) durations to whole seconds; 0 means unknown
+func parseVideoDuration(s string) int {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0
+	}
+
+	if f, err := strconv.ParseFloat(s, 64); err == nil && f > 0 {
+		return int(math.Round(f))
+	}
+
+	if m := isoDurationRe.FindStringSubmatch(s); m != nil {
+		days, _ := strconv.Atoi(m[1])
+		hours, _ := strconv.Atoi(m[2])
+		minutes, _ := strconv.Atoi(m[3])
+		seconds, _ := strconv.ParseFloat(m[4], 64)
+		return days*86400 + hours*3600 + minutes*60 + int(math.Round(seconds))
+	}
+
+	if strings.Contains(s, ":") {
+		total := 0
+		for _, part := range strings.Split(s, ":") {
+			n, err := strconv.Atoi(part)
+			if err != nil || n < 0 {
+				return 0
+			}
+			total = total*60 + n
+		}
+		return total
+	}
+
+	if d, err := time.ParseDuration(s); err == nil && d > 0 {
+		return int(d.Round(time.Second).Seconds())
+	}
+	return 0
+}
+
+// dateLayouts are the publication date formats seen in the wild, most common first
+var dateLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05Z0700",
+	"2006-01-02T15:04:05.000Z0700",
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04:05Z07:00",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+	"2006/01/02",
+	time.RFC1123Z,
+	time.RFC1123,
+	time.RFC850,
+	time.RFC822Z,
+	time.RFC822,
+	"January 2, 2006",
+	"Jan 2, 2006",
+	"2 January 2006",
+	"2 Jan 2006",
+}
+
+// parseDate normalizes a publication date to RFC3339, or returns "" if no
+// known layout matches
+func parseDate(s string) string {
+	s = strings.TrimSpace(s)
+	for _, layout := range dateLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.Format(time.RFC3339)
+		}
+	}
+	return ""
+}
+
+// publishedTime tries article:published_time, JSON-LD datePublished,
+// <meta name="date"> and <time datetime> in that order, returning the first
+// parseable date
+func publishedTime(htmlStr string, jsonLD []map[string]any) string {
+	candidates := []string{extractMetaFromBuffer(htmlStr, "article:published_time")}
+	for _, obj := range jsonLD {
+		if date, ok := obj["datePublished"].(string); ok {
+			candidates = append(candidates, date)
+		}
+	}
+	candidates = append(candidates, extractMetaFromBuffer(htmlStr, "date"))
+	if m := timeDatetimeRe.FindStringSubmatch(htmlStr); len(m) > 1 {
+		candidates = append(candidates, m[1])
+	}
+
+	for _, candidate := range candidates {
+		if date := parseDate(candidate); date != "" {
+			return date
+		}
+	}
+	return ""
+}
+
+// rawHead cuts scanned HTML after </head>, bounded by rawHeadMaxBytes
+func rawHead(htmlStr string) string {
+	if i := strings.Index(strings.ToLower(htmlStr), "</head>"); i >= 0 {
+		htmlStr = htmlStr[:i+len("</head>")]
+	}
+	if len(htmlStr) > rawHeadMaxBytes {
+		htmlStr = strings.ToValidUTF8(htmlStr[:rawHeadMaxBytes], "")
+	}
+	return htmlStr
+}
+
+// productOffer reads a product's price, currency and availability from
+// product:* and og:* tags, falling back to a JSON-LD Product's offers. Pages
+// that are neither og:type product nor carry a Product yield nothing.
+func productOffer(htmlStr, ogType string, jsonLD []map[string]any) (price, currency, availability string) {
+	var product map[string]any
+	for _, obj := range jsonLD {
+		if jsonLDType(obj, "Product") {
+			product = obj
+			break
+		}
+	}
+	if product == nil && !strings.HasPrefix(strings.ToLower(ogType), "product") {
+		return "", "", ""
+	}
+
+	price = cmp.Or(extractMetaFromBuffer(htmlStr, "product:price:amount"), extractMetaFromBuffer(htmlStr, "og:price:amount"))
+	currency = cmp.Or(extractMetaFromBuffer(htmlStr, "product:price:currency"), extractMetaFromBuffer(htmlStr, "og:price:currency"))
+	availability = cmp.Or(extractMetaFromBuffer(htmlStr, "og:availability"), extractMetaFromBuffer(htmlStr, "product:availability"))
+
+	// offers may be a single Offer, an AggregateOffer or a list of offers
+	offer, _ := product["offers"].(map[string]any)
+	if offers, ok := product["offers"].([]any); ok && len(offers) > 0 {
+		offer, _ = offers[0].(map[string]any)
+	}
+	if offer != nil {
+		price = cmp.Or(price, jsonLDString(offer["price"]), jsonLDString(offer["lowPrice"]))
+		currency = cmp.Or(currency, jsonLDString(offer["priceCurrency"]))
+		// Availability is a schema.org URL like https://schema.org/InStock
+		if a := jsonLDString(offer["availability"]); a != "" {
+			availability = cmp.Or(availability, path.Base(a))
+		}
+	}
+	return price, currency, availability
+}
+
+// jsonLDString reads a JSON-LD scalar, which may be a string or a number
+func jsonLDString(v any) string {
+	switch s := v.(type) {
+	case string:
+		return strings.TrimSpace(s)
+	case float64:
+		return strconv.FormatFloat(s, 'f', -1, 64)
+	}
+	return ""
+}
+
+// metaTags holds the raw values extractMetaTags pulls out of a page
+type metaTags struct {
+	Title            string
+	Description      string
+	Image            string
+	SiteName         string
+	Favicon          string
+	Logo             string
+	AppleTouchIcon   string
+	Type             string
+	Locale           string
+	LocaleAlternates []string
+	Determiner       string
+	Images           []OGImage
+	Video            string
+	VideoDuration    string
+	PlayerWidth      string
+	PlayerHeight     string
+	AuthorLinks      []string
+	PublishedTime    string
+	Price            string
+	Currency         string
+	Availability     string
+	Manifest         string
+	Feeds            []string
+	Alternates       map[string]string
+	WordCount        int
+	// ScanTruncated is set when the scan hit the byte limit (or a line too
+	// long to buffer) before finding every field
+	ScanTruncated bool
+	BytesScanned  int
+	RawHead       string
+	Descriptions  []SourcedText
+}
+
+// scanLinesKeepEnds is bufio.ScanLines without stripping the line endings, so
+// the scanned HTML is exactly what the page served
+func scanLinesKeepEnds(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		return i + 1, data[:i+1], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// extractMetaTags parses HTML line-by-line and stops early when meta tags are found.
+// A single line can overshoot the limit, so the scanner's token cap is twice it.
+// With opts.ReadingTime it scans on through the body, up to the limit, to
+// count words; so it does when JSON-LD or microdata, which can sit in the
+// body, outranks a tag source. With opts.NoImage it doesn't look for images.
+// opts.OnField, if set, is called with each core field (title, description,
+// image, site_name, favicon) as soon as it is found, as raw HTML attribute
+// text.
+func extractMetaTags(reader io.Reader, limit int, opts previewOptions) metaTags {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, min(scanBufferSize, 2*limit)), 2*limit)
+	scanner.Split(scanLinesKeepEnds)
+
+	var meta metaTags
+	var htmlBuffer strings.Builder
+	var foundTitle, foundDesc, foundImage, foundSite, foundFavicon, headClosed bool
+	bytesRead := 0
+	sent := make(map[string]bool)
+	scanBody := opts.ReadingTime || lateSourcesFirst()
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		bytesRead += len(line)
+		htmlBuffer.WriteString(line)
+
+		if !foundTitle && (strings.Contains(line, "og:title") || strings.Contains(line, "twitter:title") || strings.Contains(line, "<title")) {
+			if t := sourcedValue(htmlBuffer.String(), "title", nil); t != "" {
+				meta.Title = t
+				foundTitle = true
+			}
+		}
+
+		if !foundDesc && (strings.Contains(line, "og:description") || strings.Contains(line, "twitter:description") || strings.Contains(line, `name="description"`)) {
+			if d := sourcedValue(htmlBuffer.String(), "description", nil); d != "" {
+				meta.Description = d
+				foundDesc = true
+			}
+		}
+
+		if !foundImage && !opts.NoImage && (strings.Contains(line, "og:image") || strings.Contains(line, "twitter:image")) {
+			if i := sourcedValue(htmlBuffer.String(), "image", nil); i != "" {
+				meta.Image = i
+				foundImage = true
+			}
+		}
+
+		if !foundSite && strings.Contains(line, "og:site_name") {
+			if s := extractMetaFromBuffer(htmlBuffer.String(), "og:site_name"); s != "" {
+				meta.SiteName = s
+				foundSite = true
+			}
+		}
+
+		if !foundFavicon && strings.Contains(line, "icon") {
+			if m := faviconRe.FindStringSubmatch(htmlBuffer.String()); len(m) > 1 {
+				meta.Favicon = strings.TrimSpace(m[1])
+				foundFavicon = true
+			}
+		}
+
+		if meta.Logo == "" && strings.Contains(line, "og:logo") {
+			meta.Logo = extractMetaFromBuffer(htmlBuffer.String(), "og:logo")
+		}
+
+		if meta.Type == "" && strings.Contains(line, "og:type") {
+			meta.Type = extractMetaFromBuffer(htmlBuffer.String(), "og:type")
+		}
+
+		if meta.Locale == "" && strings.Contains(line, "og:locale") {
+			meta.Locale = extractMetaFromBuffer(htmlBuffer.String(), "og:locale")
+		}
+
+		if meta.Determiner == "" && strings.Contains(line, "og:determiner") {
+			meta.Determiner = extractMetaFromBuffer(htmlBuffer.String(), "og:determiner")
+		}
+
+		if meta.Video == "" && strings.Contains(line, "og:video") {
+			for _, property := range []string{"og:video:secure_url", "og:video", "og:video:url"} {
+				if v := extractMetaFromBuffer(htmlBuffer.String(), property); v != "" {
+					meta.Video = v
+					break
+				}
+			}
+		}
+
+		if meta.VideoDuration == "" && strings.Contains(line, "video:duration") {
+			meta.VideoDuration = extractMetaFromBuffer(htmlBuffer.String(), "og:video:duration")
+			if meta.VideoDuration == "" {
+				meta.VideoDuration = extractMetaFromBuffer(htmlBuffer.String(), "video:duration")
+			}
+		}
+
+		if strings.Contains(line, "</head>") {
+			headClosed = true
+		}
+
+		if opts.OnField != nil {
+			for _, f := range [...]struct{ name, value string }{
+				{"title", meta.Title},
+				{"description", meta.Description},
+				{"image", meta.Image},
+				{"site_name", meta.SiteName},
+				{"favicon", meta.Favicon},
+			} {
+				if f.value != "" && !sent[f.name] {
+					sent[f.name] = true
+					opts.OnField(f.name, f.value)
+				}
+			}
+		}
+
+		// Keep scanning to the end of the head once the core fields are found,
+		// so trailing structured properties like og:image:width aren't cut off
+		if bytesRead > limit {
+			meta.ScanTruncated = true
+			break
+		}
+		if !scanBody && foundTitle && foundDesc && (foundImage || opts.NoImage) && foundSite && foundFavicon && headClosed {
+			break
+		}
+	}
+	if scanner.Err() != nil {
+		meta.ScanTruncated = true
+	}
+	meta.BytesScanned = bytesRead
+	for _, candidate := range [...]struct{ source, property string }{
+		{"og", "og:description"},
+		{"twitter", "twitter:description"},
+		{"meta", "description"},
+	} {
+		if d := extractMetaFromBuffer(htmlBuffer.String(), candidate.property); d != "" {
+			meta.Descriptions = append(meta.Descriptions, SourcedText{candidate.source, d})
+		}
+	}
+	if debugMode {
+		meta.RawHead = rawHead(htmlBuffer.String())
+	}
+
+	if opts.ReadingTime {
+		meta.WordCount = countWords(htmlBuffer.String())
+	}
+
+	if !opts.NoImage {
+		meta.Images = ogImages(htmlBuffer.String())
+	}
+	meta.LocaleAlternates = metaValues(htmlBuffer.String(), "og:locale:alternate")
+	meta.PlayerWidth, meta.PlayerHeight = playerDimensions(htmlBuffer.String())
+	meta.AppleTouchIcon = appleTouchIcon(htmlBuffer.String())
+
+	for _, attrs := range relLinks(htmlBuffer.String(), "alternate") {
+		if len(meta.Feeds) >= cfg().MaxRepeatedFields {
+			break
+		}
+		href := strings.TrimSpace(attrs["href"])
+		if href != "" && feedTypes[strings.ToLower(attrs["type"])] && !slices.Contains(meta.Feeds, href) {
+			meta.Feeds = append(meta.Feeds, href)
+		}
+	}
+
+	for _, attrs := range relLinks(htmlBuffer.String(), "alternate") {
+		if len(meta.Alternates) >= cfg().MaxRepeatedFields {
+			break
+		}
+		lang := strings.TrimSpace(attrs["hreflang"])
+		href := strings.TrimSpace(attrs["href"])
+		if lang == "" || href == "" {
+			continue
+		}
+		if meta.Alternates == nil {
+			meta.Alternates = make(map[string]string)
+		}
+		if _, ok := meta.Alternates[lang]; !ok {
+			meta.Alternates[lang] = href
+		}
+	}
+
+	if links := relLinks(htmlBuffer.String(), "manifest"); len(links) > 0 {
+		meta.Manifest = strings.TrimSpace(links[0]["href"])
+	}
+
+	for _, attrs := range relLinks(htmlBuffer.String(), "me", "author") {
+		if len(meta.AuthorLinks) >= cfg().MaxRepeatedFields {
+			break
+		}
+		if href := strings.TrimSpace(attrs["href"]); href != "" && !slices.Contains(meta.AuthorLinks, href) {
+			meta.AuthorLinks = append(meta.AuthorLinks, href)
+		}
+	}
+
+	var jsonLD []map[string]any
+	if slices.Contains(metadataSources, "jsonld") {
+		jsonLD = jsonLDObjects(htmlBuffer.String())
+	}
+	if meta.Logo == "" {
+		meta.Logo = jsonLDLogo(jsonLD)
+	}
+	meta.PublishedTime = publishedTime(htmlBuffer.String(), jsonLD)
+	meta.Price, meta.Currency, meta.Availability = productOffer(htmlBuffer.String(), meta.Type, jsonLD)
+
+	// JSON-LD and microdata need the whole scanned document, so the fields
+	// are resolved again once it is in, in case one of them ranks first
+	late := make(map[string]map[string]string)
+	if len(jsonLD) > 0 {
+		late["jsonld"] = jsonLDFields(jsonLD)
+	}
+	if slices.Contains(metadataSources, "microdata") {
+		props := microdata(htmlBuffer.String())
+		late["microdata"] = map[string]string{
+			"title":       cmp.Or(props["name"], props["headline"]),
+			"description": props["description"],
+			"image":       props["image"],
+		}
+	}
+	if len(late) > 0 {
+		meta.Title = sourcedValue(htmlBuffer.String(), "title", late)
+		meta.Description = sourcedValue(htmlBuffer.String(), "description", late)
+		if !opts.NoImage {
+			meta.Image = sourcedValue(htmlBuffer.String(), "image", late)
+		}
+	}
+
+	return meta
+}
+
+// sourceProperties maps each tag-based metadata source to the meta property
+// it provides for each field
+var sourceProperties = map[string]map[string]string{
+	"og":        {"title": "og:title", "description": "og:description", "image": "og:image"},
+	"twitter":   {"title": "twitter:title", "description": "twitter:description", "image": "twitter:image"},
+	"meta-name": {"description": "description"},
+}
+
+// lateSourcesFirst reports whether JSON-LD or microdata comes before a
+// tag-based source in metadataSources
+func lateSourcesFirst() bool {
+	late := false
+	for _, source := range metadataSources {
+		if source == "jsonld" || source == "microdata" {
+			late = true
+		} else if late {
+			return true
+		}
+	}
+	return false
+}
+
+// sourcedValue returns field from the first of metadataSources that has it.
+// late holds the values of sources only known after the scan, by source.
+func sourcedValue(htmlStr, field string, late map[string]map[string]string) string {
+	for _, source := range metadataSources {
+		var v string
+		switch {
+		case source == "title-tag" && field == "title":
+			if m := titleRe.FindStringSubmatch(htmlStr); len(m) > 1 {
+				v = strings.TrimSpace(m[1])
+			}
+		case sourceProperties[source][field] != "":
+			v = extractMetaFromBuffer(htmlStr, sourceProperties[source][field])
+		default:
+			v = late[source][field]
+		}
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// jsonLDFields picks the title, description and image from JSON-LD. Only a
+// headline, or the name of something other than a site or organization,
+// counts as a title, since those names are the site's.
+func jsonLDFields(objects []map[string]any) map[string]string {
+	fields := make(map[string]string)
+	for _, obj := range objects {
+		headline, _ := obj["headline"].(string)
+		name, _ := obj["name"].(string)
+		if jsonLDType(obj, "WebSite") || jsonLDType(obj, "Organization") || jsonLDType(obj, "Person") {
+			name = ""
+		}
+		description, _ := obj["description"].(string)
+		fields["title"] = cmp.Or(fields["title"], strings.TrimSpace(cmp.Or(headline, name)))
+		fields["description"] = cmp.Or(fields["description"], strings.TrimSpace(description))
+		fields["image"] = cmp.Or(fields["image"], jsonLDURL(obj["image"]), jsonLDURL(obj["thumbnailUrl"]))
+	}
+	return fields
+}
+
+// microdata collects the first value of each schema.org itemprop: the
+// content attribute, src for media, href for links, or else the element's
+// text. Nesting isn't tracked, so a nested item's props can win when they
+// come first.
+func microdata(htmlStr string) map[string]string {
+	props := make(map[string]string)
+	for _, m := range itempropRe.FindAllStringSubmatch(htmlStr, -1) {
+		attrs := parseAttrs(m[1])
+		value := attrs["content"]
+		if value == "" {
+			value = cmp.Or(attrs["src"], attrs["href"], m[2])
+		}
+		if value = strings.TrimSpace(value); value == "" {
+			continue
+		}
+		for _, prop := range strings.Fields(attrs["itemprop"]) {
+			if _, ok := props[prop]; !ok {
+				props[prop] = value
+			}
+		}
+	}
+	return props
+}
+
+var (
+	nonTextRe = regexp.MustCompile(`(?is)<(script|style|noscript|template)[^>]*>.*?</(script|style|noscript|template)>`)
+	tagRe     = regexp.MustCompile(`(?s)<[^>]*>`)
+)
+
+// countWords counts the words of visible text in the page body
+func countWords(htmlStr string) int {
+	if i := strings.Index(strings.ToLower(htmlStr), "<body"); i >= 0 {
+		htmlStr = htmlStr[i:]
+	}
+	text := tagRe.ReplaceAllString(nonTextRe.ReplaceAllString(htmlStr, " "), " ")
+	return len(strings.Fields(html.UnescapeString(text)))
+}
+
+// parseAttrs maps the lowercased attribute names of a single tag to their values
+func parseAttrs(tag string) map[string]string {
+	attrs := make(map[string]string)
+	for _, m := range attrRe.FindAllStringSubmatch(tag, -1) {
+		name := strings.ToLower(m[1])
+		if _, ok := attrs[name]; !ok {
+			attrs[name] = m[2] + m[3]
+		}
+	}
+	return attrs
+}
+
+// feedTypes are the rel="alternate" link types announcing a feed
+var feedTypes = map[string]bool{
+	"application/rss+xml":   true,
+	"application/atom+xml":  true,
+	"application/feed+json": true,
+}
+
+// relLinks returns the attributes of every <link> or <a> tag whose rel
+// attribute contains any of rels
+func relLinks(htmlStr string, rels ...string) []map[string]string {
+	var links []map[string]string
+	for _, tag := range linkTagRe.FindAllString(htmlStr, -1) {
+		attrs := parseAttrs(tag)
+		for _, rel := range strings.Fields(strings.ToLower(attrs["rel"])) {
+			if slices.Contains(rels, rel) {
+				links = append(links, attrs)
+				break
+			}
+		}
+	}
+	return links
+}
+
+// metaValues collects the distinct contents of a repeatable meta property,
+// at most MaxRepeatedFields of them
+func metaValues(htmlStr, property string) []string {
+	var values []string
+	for _, tag := range metaTagRe.FindAllString(htmlStr, -1) {
+		if len(values) >= cfg().MaxRepeatedFields {
+			break
+		}
+		attrs := parseAttrs(tag)
+		if !strings.EqualFold(cmp.Or(attrs["property"], attrs["name"]), property) {
+			continue
+		}
+		if content := strings.TrimSpace(attrs["content"]); content != "" && !slices.Contains(values, content) {
+			values = append(values, content)
+		}
+	}
+	return values
+}
+
+// ogImages walks meta tags in document order so each og:image:* property is
+// attached to the og:image that precedes it; at most MaxRepeatedFields are kept
+func ogImages(htmlStr string) []OGImage {
+	var images []OGImage
+	var skipping bool
+	for _, tag := range metaTagRe.FindAllString(htmlStr, -1) {
+		attrs := parseAttrs(tag)
+		property := strings.ToLower(attrs["property"])
+		if property == "" {
+			property = strings.ToLower(attrs["name"])
+		}
+		content := strings.TrimSpace(attrs["content"])
+		if content == "" {
+			continue
+		}
+
+		switch property {
+		case "og:image", "og:image:url":
+			// og:image:url directly after og:image usually repeats the same image
+			if property == "og:image:url" && len(images) > 0 && images[len(images)-1].URL == content {
+				continue
+			}
+			// Past the cap, skip the image along with its sub-properties
+			if skipping = len(images) >= cfg().MaxRepeatedFields; !skipping {
+				images = append(images, OGImage{URL: content})
+			}
+		case "og:image:secure_url":
+			if len(images) == 0 {
+				images = append(images, OGImage{URL: content})
+			}
+		}
+
+		if len(images) == 0 || skipping {
+			continue
+		}
+		current := &images[len(images)-1]
+		switch property {
+		case "og:image:width":
+			current.Width, _ = strconv.Atoi(content)
+		case "og:image:height":
+			current.Height, _ = strconv.Atoi(content)
+		case "og:image:type":
+			current.Type = content
+		case "og:image:alt":
+			current.Alt = html.UnescapeString(content)
+		}
+	}
+	return images
+}
+
+// jsonLDObjects decodes every JSON-LD block in htmlStr, flattening arrays and @graph
+func jsonLDObjects(htmlStr string) []map[string]any {
+	var objects []map[string]any
+	for _, m := range jsonLDRe.FindAllStringSubmatch(htmlStr, -1) {
+		var data any
+		if err := json.Unmarshal([]byte(strings.TrimSpace(m[1])), &data); err != nil {
+			continue
+		}
+		objects = appendJSONLD(objects, data)
+	}
+	return objects
+}
+
+func appendJSONLD(objects []map[string]any, data any) []map[string]any {
+	switch v := data.(type) {
+	case []any:
+		for _, item := range v {
+			objects = appendJSONLD(objects, item)
+		}
+	case map[string]any:
+		objects = append(objects, v)
+		if graph, ok := v["@graph"]; ok {
+			objects = appendJSONLD(objects, graph)
+		}
+	}
+	return objects
+}
+
+// jsonLDType reports whether obj's @type (a string or array) ends with suffix,
+// so "Organization" also matches "NewsMediaOrganization"
+func jsonLDType(obj map[string]any, suffix string) bool {
+	switch t := obj["@type"].(type) {
+	case string:
+		return strings.HasSuffix(t, suffix)
+	case []any:
+		for _, item := range t {
+			if s, ok := item.(string); ok && strings.HasSuffix(s, suffix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// jsonLDURL reads a URL-valued property that may be a plain string, an
+// ImageObject with a url, or an array of either
+func jsonLDURL(v any) string {
+	switch u := v.(type) {
+	case string:
+		return strings.TrimSpace(u)
+	case map[string]any:
+		return jsonLDURL(u["url"])
+	case []any:
+		if len(u) > 0 {
+			return jsonLDURL(u[0])
+		}
+	}
+	return ""
+}
+
+// jsonLDLogo finds an Organization logo, either top-level or as an article's publisher
+func jsonLDLogo(objects []map[string]any) string {
+	for _, obj := range objects {
+		if jsonLDType(obj, "Organization") {
+			if logo := jsonLDURL(obj["logo"]); logo != "" {
+				return logo
+			}
+		}
+	}
+	for _, obj := range objects {
+		if publisher, ok := obj["publisher"].(map[string]any); ok {
+			if logo := jsonLDURL(publisher["logo"]); logo != "" {
+				return logo
+			}
+		}
+	}
+	return ""
+}
+
+func extractMetaFromBuffer(htmlStr, property string) string {
+	if matches := metaPropertyContentRe.FindAllStringSubmatch(htmlStr, -1); len(matches) > 0 {
+		for _, m := range matches {
+			if len(m) > 2 && strings.EqualFold(m[1], property) {
+				return strings.TrimSpace(m[2])
+			}
+		}
+	}
+
+	if matches := metaContentPropertyRe.FindAllStringSubmatch(htmlStr, -1); len(matches) > 0 {
+		for _, m := range matches {
+			if len(m) > 2 && strings.EqualFold(m[2], property) {
+				return strings.TrimSpace(m[1])
+			}
+		}
+	}
+
+	if matches := metaNameContentRe.FindAllStringSubmatch(htmlStr, -1); len(matches) > 0 {
+		for _, m := range matches {
+			if len(m) > 2 && strings.EqualFold(m[1], property) {
+				return strings.TrimSpace(m[2])
+			}
+		}
+	}
+
+	if matches := metaContentNameRe.FindAllStringSubmatch(htmlStr, -1); len(matches) > 0 {
+		for _, m := range matches {
+			if len(m) > 2 && strings.EqualFold(m[2], property) {
+				return strings.TrimSpace(m[1])
+			}
+		}
+	}
+
+	return ""
+}
+
+func resolveURL(href, base string) string {
+	if strings.HasPrefix(href, "http") {
+		return href
+	}
+	if u, err := url.Parse(base); err == nil {
+		if ref, err := url.Parse(href); err == nil {
+			return u.ResolveReference(ref).String()
+		}
+	}
+	return href
+}
+
+// isAbsoluteHTTP reports whether s is an absolute http(s) URL with a host,
+// which resolveURL can fail to produce for relative URLs
+func isAbsoluteHTTP(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// validateTarget rejects URLs the service must not fetch: non-HTTP schemes
+// and ports outside the allowlist, so it can't be used to probe internal services
+func validateTarget(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return &fetchError{Code: "blocked", Err: fmt.Errorf("scheme %q not allowed", u.Scheme)}
+	}
+	if u.Hostname() == "" {
+		return &fetchError{Code: "blocked", Err: errors.New("missing host")}
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	if n, err := strconv.Atoi(port); err != nil || !slices.Contains(allowedPorts, n) {
+		return &fetchError{Code: "blocked", Err: fmt.Errorf("port %s not allowed", port)}
+	}
+
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	if matchesDomain(host, blockedDomains) {
+		return &fetchError{Code: "blocked", Err: fmt.Errorf("domain %s is blocked", host)}
+	}
+	if len(allowedDomains) > 0 && !matchesDomain(host, allowedDomains) {
+		return &fetchError{Code: "blocked", Err: fmt.Errorf("domain %s not allowed", host)}
+	}
+	return nil
+}
+
+// matchesDomain reports whether host is one of domains or a subdomain of one
+func matchesDomain(host string, domains []string) bool {
+	for _, d := range domains {
+		d = strings.ToLower(strings.TrimPrefix(d, "."))
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// rememberImageHosts records the hosts of a preview's images for
+// PROXY_KNOWN_IMAGE_HOSTS_ONLY
+func rememberImageHosts(p Preview) {
+	urls := []string{p.Image, p.Favicon, p.Logo, p.VideoPoster}
+	for _, img := range p.Images {
+		urls = append(urls, img.URL)
+	}
+	for _, raw := range urls {
+		if u, err := url.Parse(raw); err == nil && u.Host != "" {
+			imageHosts.Add(strings.ToLower(u.Hostname()), struct{}{})
+		}
+	}
+}
+
+// checkRedirect enforces the hop limit, not counting shortener hops, stops
+// redirect loops early, and validates every hop like the original target
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	shortened := 0
+	for _, prev := range via {
+		if matchesDomain(strings.ToLower(prev.URL.Hostname()), shortenerDomains) {
+			shortened++
+		}
+	}
+	// A URL seen before will redirect the same way again, so a loop is
+	// reported as soon as it closes rather than when the hops run out
+	for _, prev := range via {
+		if prev.URL.String() == req.URL.String() {
+			return &fetchError{Code: "redirect_loop", Err: fmt.Errorf("redirect loop at %s", req.URL)}
+		}
+	}
+	if len(via)-min(shortened, maxShortenerRedirects) > cfg().MaxRedirects {
+		return &fetchError{Code: "too_many_redirects", Err: fmt.Errorf("stopped after %d redirects", cfg().MaxRedirects)}
+	}
+	if sameSiteRedirects {
+		if err := checkRedirectSite(req.URL, via); err != nil {
+			return err
+		}
+	}
+	return validateTarget(req.URL)
+}
+
+// checkRedirectSite rejects a redirect to a different registrable domain
+// than the chain started on. Shortener hops don't set the site, since
+// leaving their domain is all they do.
+func checkRedirectSite(target *url.URL, via []*http.Request) error {
+	host := strings.ToLower(target.Hostname())
+	if matchesDomain(host, redirectAllowedDomains) {
+		return nil
+	}
+	for _, prev := range via {
+		origin := strings.ToLower(prev.URL.Hostname())
+		if matchesDomain(origin, shortenerDomains) {
+			continue
+		}
+		if registrableDomain(origin) != registrableDomain(host) {
+			return &fetchError{Code: "cross_domain_redirect", Err: fmt.Errorf("redirect from %s to %s leaves the site", origin, host)}
+		}
+		return nil
+	}
+	return nil
+}
+
+// registrableDomain returns the public suffix plus one label of host, or
+// host itself for IPs and hosts that are a public suffix
+func registrableDomain(host string) string {
+	if net.ParseIP(host) != nil {
+		return host
+	}
+	if d, err := publicsuffix.EffectiveTLDPlusOne(host); err == nil {
+		return d
+	}
+	return host
+}
+
+func truncate(s string, maxLen int) string {
+	if len(s) > maxLen {
+		return s[:maxLen]
+	}
+	return s
+}
+
+func msSince(t time.Time) float64 {
+	return float64(time.Since(t).Microseconds()) / 1000
+}
+
+// timingTrace records a Timing from httptrace callbacks. They can run
+// concurrently, e.g. ConnectStart and ConnectDone once per address family
+// when Happy Eyeballs dials both, and a losing dial may report after the
+// request is done, so every field is guarded by mu.
+type timingTrace struct {
+	mu            sync.Mutex
+	timing        Timing
+	start         time.Time
+	dnsStart      time.Time
+	tlsStart      time.Time
+	connectStarts map[string]time.Time
+}
+
+func newTimingTrace() *timingTrace {
+	return &timingTrace{start: time.Now(), connectStarts: make(map[string]time.Time)}
+}
+
+// withTrace attaches the trace to ctx. DNS, connect and TLS durations
+// accumulate across redirect hops; only successful connects count.
+func (tt *timingTrace) withTrace(ctx context.Context) context.Context {
+	record := func(f func()) {
+		tt.mu.Lock()
+		defer tt.mu.Unlock()
+		f()
+	}
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { record(func() { tt.dnsStart = time.Now() }) },
+		DNSDone:  func(httptrace.DNSDoneInfo) { record(func() { tt.timing.DNSMs += msSince(tt.dnsStart) }) },
+		ConnectStart: func(network, addr string) {
+			record(func() { tt.connectStarts[network+" "+addr] = time.Now() })
+		},
+		ConnectDone: func(network, addr string, err error) {
+			record(func() {
+				if start, ok := tt.connectStarts[network+" "+addr]; ok && err == nil {
+					tt.timing.ConnectMs += msSince(start)
+				}
+				delete(tt.connectStarts, network+" "+addr)
+			})
+		},
+		TLSHandshakeStart:    func() { record(func() { tt.tlsStart = time.Now() }) },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { record(func() { tt.timing.TLSMs += msSince(tt.tlsStart) }) },
+		GotFirstResponseByte: func() { record(func() { tt.timing.TTFBMs = msSince(tt.start) }) },
+	})
+}
+
+// result snapshots the timing so far, with TotalMs measured from the
+// trace's creation
+func (tt *timingTrace) result() *Timing {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	t := tt.timing
+	t.TotalMs = msSince(tt.start)
+	return &t
+}
+
+func compressPreview(preview Preview) ([]byte, error) {
+	var buf bytes.Buffer
+	zw, _ := gzip.NewWriterLevel(&buf, gzip.BestSpeed)
+	if err := json.NewEncoder(zw).Encode(preview); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decompressPreview(data []byte) (Preview, error) {
+	var preview Preview
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return preview, err
+	}
+	defer zr.Close()
+	err = json.NewDecoder(zr).Decode(&preview)
+	return preview, err
+}
+
+func getCachedPreview(cacheKey string) (Preview, bool) {
+	entry, ok := previewCache.Get(cacheKey)
+	if !ok {
+		return Preview{}, false
+	}
+	if time.Now().After(entry.ExpiresAt) {
+		previewCache.Remove(cacheKey)
+		return Preview{}, false
+	}
+	if entry.Compressed == nil {
+		return entry.Preview, true
+	}
+
+	preview, err := decompressPreview(entry.Compressed)
+	if err != nil {
+		previewCache.Remove(cacheKey)
+		return Preview{}, false
+	}
+	return preview, true
+}
+
+func addCachedPreview(cacheKey string, preview Preview) {
+	ttl := preview.cacheTTL
+	if ttl == 0 {
+		ttl = cfg().PreviewCacheTTL
+	}
+	storeCachedPreview(cacheKey, preview, time.Now().Add(jitterTTL(ttl)))
+}
+
+// jitterTTL spreads ttl by up to ±PREVIEW_CACHE_TTL_JITTER percent, so entries
+// cached together (e.g. by a batch) don't all expire and refetch at once
+func jitterTTL(ttl time.Duration) time.Duration {
+	if cfg().PreviewCacheTTLJitter <= 0 || ttl <= 0 {
+		return ttl
+	}
+	spread := int64(ttl) * int64(min(cfg().PreviewCacheTTLJitter, 100)) / 100
+	return ttl + time.Duration(rand.Int64N(2*spread+1)-spread)
+}
+
+// updateCachedPreview applies update to a cached preview without extending
+// its expiry. Only the cached entry changes, so per-request fields such as
+// Timing never leak into it.
+func updateCachedPreview(cacheKey string, update func(*Preview)) {
+	entry, ok := previewCache.Get(cacheKey)
+	if !ok || !time.Now().Before(entry.ExpiresAt) {
+		return
+	}
+	preview := entry.Preview
+	if entry.Compressed != nil {
+		var err error
+		if preview, err = decompressPreview(entry.Compressed); err != nil {
+			return
+		}
+	}
+	update(&preview)
+	storeCachedPreview(cacheKey, preview, entry.ExpiresAt)
+}
+
+func storeCachedPreview(cacheKey string, preview Preview, expiresAt time.Time) {
+	entry := PreviewCacheEntry{Preview: preview, ExpiresAt: expiresAt}
+	if compressPreviewCache {
+		if data, err := compressPreview(preview); err == nil {
+			entry.Preview, entry.Compressed = Preview{}, data
+		}
+	}
+	previewCache.Add(cacheKey, entry)
+}
+
+// upstreamCacheTTL derives a preview TTL from the upstream's Cache-Control
+// (s-maxage, then max-age) or Expires headers, clamped to the configured
+// bounds; without either it returns the default TTL
+func upstreamCacheTTL(header http.Header) time.Duration {
+	noStore, maxAge, sMaxAge := false, -1, -1
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		name, value, _ := strings.Cut(strings.ToLower(strings.TrimSpace(directive)), "=")
+		seconds, err := strconv.Atoi(strings.Trim(value, `"`))
+		switch {
+		case name == "no-store" || name == "no-cache":
+			noStore = true
+		case name == "max-age" && err == nil:
+			maxAge = seconds
+		case name == "s-maxage" && err == nil:
+			sMaxAge = seconds
+		}
+	}
+
+	var ttl time.Duration
+	switch {
+	case noStore:
+		ttl = 0
+	case sMaxAge >= 0:
+		ttl = time.Duration(sMaxAge) * time.Second
+	case maxAge >= 0:
+		ttl = time.Duration(maxAge) * time.Second
+	default:
+		expires, err := http.ParseTime(header.Get("Expires"))
+		if err != nil {
+			return cfg().PreviewCacheTTL
+		}
+		now := time.Now()
+		if date, err := http.ParseTime(header.Get("Date")); err == nil {
+			now = date
+		}
+		ttl = expires.Sub(now)
+	}
+	return min(max(ttl, cfg().PreviewCacheMinTTL), cfg().PreviewCacheMaxTTL)
+}
+
+// retryAfterSeconds reads a Retry-After header given either as seconds or
+// as an HTTP date; it is 0 when missing, invalid or already past
+func retryAfterSeconds(header string) int {
+	header = strings.TrimSpace(header)
+	if seconds, err := strconv.Atoi(header); err == nil {
+		return max(seconds, 0)
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		return max(int(math.Ceil(time.Until(date).Seconds())), 0)
+	}
+	return 0
+}
+
+// retryWait is how long to wait before retrying a response with the given
+// Retry-After header, and whether a retry is worth it at all
+func retryWait(ctx context.Context, retryAfter string) (time.Duration, bool) {
+	wait := time.Second
+	if strings.TrimSpace(retryAfter) != "" {
+		wait = time.Duration(retryAfterSeconds(retryAfter)) * time.Second
+	}
+	if wait > retryMaxWait {
+		return 0, false
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= wait {
+		return 0, false
+	}
+	return wait, true
+}
+
+// previewCacheKey isolates namespaced entries; the shared namespace keeps
+// plain URL hashes
+func previewCacheKey(targetURL, namespace string) string {
+	if namespace == "" {
+		return hashURL(targetURL)
+	}
+	return hashURL(namespace + ":" + targetURL)
+}
+
+func fetchPreview(targetURL string, opts previewOptions) Preview {
+	if preview, ok := contactPreview(targetURL); ok {
+		return preview
+	}
+
+	cacheKey := previewCacheKey(targetURL, opts.Namespace)
+	preview := loadPreview(targetURL, opts)
+	if opts.NoImage {
+		preview.Image, preview.Images, preview.VideoPoster, preview.DominantColor = "", nil, "", ""
+		preview.Screenshot = false
+	}
+	if opts.ExtractColor && preview.Error == "" && preview.Image != "" && preview.DominantColor == "" {
+		preview = addDominantColor(cacheKey, preview, opts)
+	}
+	if opts.VerifyImage && preview.Error == "" && preview.Image != "" {
+		check := checkLink(context.Background(), preview.Image)
+		reachable := check.OK && isImageContentType(check.ContentType)
+		preview.ImageReachable, preview.ImageContentType = &reachable, check.ContentType
+	}
+	if preview.Screenshot {
+		preview.Image = opts.BaseURL + "/proxy-image?" + url.Values{"url": {targetURL}, "screenshot": {"1"}}.Encode()
+	}
+	if preview.CachedAt != nil {
+		preview.Age = int(time.Since(*preview.CachedAt).Seconds())
+	}
+	if opts.Debug {
+		// Copied, since the cached preview may share the pointer
+		var debug DebugInfo
+		if preview.Debug != nil {
+			debug = *preview.Debug
+		}
+		debug.CacheKey = cacheKey
+		preview.Debug = &debug
+	} else {
+		preview.Debug = nil
+	}
+	return preview
+}
+
+// contactPreview builds a synthetic preview for mailto: and tel: links,
+// which have nothing to fetch, so mixed links in a feed still render
+func contactPreview(targetURL string) (Preview, bool) {
+	u, err := url.Parse(strings.TrimSpace(targetURL))
+	if err != nil || u.Opaque == "" {
+		return Preview{}, false
+	}
+	value, err := url.PathUnescape(u.Opaque)
+	if err != nil {
+		value = u.Opaque
+	}
+
+	switch strings.ToLower(u.Scheme) {
+	case "mailto":
+		preview := Preview{URL: targetURL, Title: value, HasTitle: true, Type: "email"}
+		if _, domain, ok := strings.Cut(value, "@"); ok {
+			preview.Domain = domain
+		}
+		return preview, true
+	case "tel":
+		return Preview{URL: targetURL, Title: value, HasTitle: true, Type: "phone"}, true
+	}
+	return Preview{}, false
+}
+
+// loadPreview returns the cached preview or fetches a fresh one
+func loadPreview(targetURL string, opts previewOptions) Preview {
+	cacheKey := previewCacheKey(targetURL, opts.Namespace)
+
+	// Timing is only meaningful for a real upstream fetch, so bypass the
+	// cache read and singleflight; the refreshed entry is cached without it
+	if opts.DebugTiming {
+		opts.Trace = newTimingTrace()
+	}
+
+	// A cached preview scanned without the body has no reading time, so
+	// reading_time requests refetch it and share flights only among themselves
+	flightKey := cacheKey
+	if opts.ReadingTime {
+		flightKey += "|reading_time"
+	}
+	if opts.NoImage {
+		flightKey += "|no_image"
+	}
+
+	if !opts.Refresh && !opts.NoStore && !opts.DebugTiming {
+		if cached, ok := getCachedPreview(cacheKey); ok && (!opts.ReadingTime || cached.ReadingTimeMinutes > 0) {
+			metricsMu.Lock()
+			metrics.PreviewHits++
+			metricsMu.Unlock()
+			if opts.Timings != nil {
+				opts.Timings.CacheHit = true
+			}
+			return cached
+		}
+	}
+
+	metricsMu.Lock()
+	metrics.PreviewMisses++
+	metricsMu.Unlock()
+
+	fetch := func() (interface{}, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), cfg().RequestDeadline)
+		defer cancel()
+		return fetchPreviewInternal(ctx, targetURL, opts)
+	}
+
+	// Field callbacks and traces belong to a single request, so streaming
+	// and timed fetches aren't shared with concurrent ones
+	var result interface{}
+	var err error
+	if opts.OnField != nil || opts.Trace != nil {
+		result, err = fetch()
+	} else {
+		result, err, _ = requestGroup.Do(flightKey, fetch)
+	}
+
+	var preview Preview
+	if err != nil {
+		partial, _ := result.(Preview)
+		preview = errorPreview(partial, targetURL, err)
+	} else {
+		preview = result.(Preview)
+		fetchedAt := time.Now()
+		preview.CachedAt = &fetchedAt
+		if !opts.NoStore && !opts.NoImage {
+			if opts.TTL > 0 {
+				preview.cacheTTL = opts.TTL
+			}
+			addCachedPreview(cacheKey, preview)
+		}
+	}
+	if opts.Trace != nil {
+		preview.Timing = opts.Trace.result()
+	}
+	return preview
+}
+
+// errorPreview builds the response for a failed fetch, keeping whatever
+// upstream details the partial preview managed to record
+func errorPreview(partial Preview, targetURL string, err error) Preview {
+	preview := Preview{
+		URL:               targetURL,
+		Error:             err.Error(),
+		UpstreamStatus:    partial.UpstreamStatus,
+		UpstreamFinalURL:  partial.UpstreamFinalURL,
+		RedirectedToLogin: partial.RedirectedToLogin,
+		RetryAfter:        partial.RetryAfter,
+		ContentType:       partial.ContentType,
+		Debug:             partial.Debug,
+	}
+	var fe *fetchError
+	if errors.As(err, &fe) {
+		preview.ErrorCode = fe.Code
+	}
+	return preview
+}
+
+// challengeMarkers are body snippets of common bot-wall interstitials
+var challengeMarkers = []string{
+	"cf-chl",
+	"cf_chl_opt",
+	"challenge-platform",
+	"Just a moment...",
+	"Attention Required! | Cloudflare",
+	"DDoS-Guard",
+	"captcha-delivery.com",
+	"_Incapsula_Resource",
+	"px-captcha",
+}
+
+// isBotChallenge recognizes a challenge page served instead of the content,
+// so it's reported as such rather than previewed. It returns the start of
+// the body it read looking for markers, which the caller must scan first.
+func isBotChallenge(resp *http.Response) (bool, []byte) {
+	if resp.StatusCode != 403 && resp.StatusCode != 503 {
+		return false, nil
+	}
+	if resp.Header.Get("cf-mitigated") == "challenge" {
+		return true, nil
+	}
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	page := string(body)
+	for _, marker := range challengeMarkers {
+		if strings.Contains(page, marker) {
+			return true, body
+		}
+	}
+	return false, body
+}
+
+// verifyIcon accepts an icon only if it is an image no larger than
+// iconMaxBytes; HTML error pages served at icon URLs are rejected
+func verifyIcon(ctx context.Context, iconURL string) bool {
+	_, err := fetchIcon(ctx, iconURL)
+	return err == nil
+}
+
+// fetchIcon downloads an icon of at most iconMaxBytes, failing unless it is
+// an image by Content-Type or by sniffing
+func fetchIcon(ctx context.Context, iconURL string) (ImageCacheEntry, error) {
+	u, err := url.Parse(iconURL)
+	if err != nil {
+		return ImageCacheEntry{}, err
+	}
+	if err := validateTarget(u); err != nil {
+		return ImageCacheEntry{}, err
+	}
+
+	resp, err := doUpstream(ctx, "GET", iconURL, upstreamOptions{})
+	if err != nil {
+		return ImageCacheEntry{}, err
+	}
+	defer resp.Body.Close()
+	defer countDownload(resp, "icon", iconURL)()
+
+	if resp.StatusCode != 200 {
+		return ImageCacheEntry{}, &fetchError{Code: "http_error", Status: resp.StatusCode, Err: fmt.Errorf("HTTP %d", resp.StatusCode)}
+	}
+	if resp.ContentLength > int64(iconMaxBytes) {
+		return ImageCacheEntry{}, fmt.Errorf("icon exceeds %d bytes", iconMaxBytes)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, int64(iconMaxBytes)+1))
+	if err != nil {
+		return ImageCacheEntry{}, err
+	}
+	if len(data) == 0 || len(data) > iconMaxBytes {
+		return ImageCacheEntry{}, fmt.Errorf("icon is empty or exceeds %d bytes", iconMaxBytes)
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	if !strings.HasPrefix(contentType, "image/") {
+		contentType = http.DetectContentType(data)
+	}
+	if !strings.HasPrefix(contentType, "image/") {
+		return ImageCacheEntry{}, fmt.Errorf("icon is %s, not an image", contentType)
+	}
+	return ImageCacheEntry{Data: data, ContentType: contentType}, nil
+}
+
+// errorCategory buckets a failed fetch for the metrics: parse, dns, timeout,
+// http_4xx, http_5xx, the fetchError code (blocked, bot_challenge, ...),
+// or other
+func errorCategory(partial Preview, err error) string {
+	var ue *url.Error
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var fe *fetchError
+	switch {
+	case errors.As(err, &ue) && ue.Op == "parse":
+		return "parse"
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.As(err, &fe):
+		return fe.Code
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case partial.UpstreamStatus >= 500:
+		return "http_5xx"
+	case partial.UpstreamStatus >= 400:
+		return "http_4xx"
+	}
+	return "other"
+}
+
+func errDeadline() error {
+	return &fetchError{Code: "timeout", Err: fmt.Errorf("request deadline of %s exceeded", cfg().RequestDeadline)}
+}
+
+func fetchPreviewInternal(ctx context.Context, targetURL string, opts previewOptions) (preview Preview, err error) {
+	defer func() {
+		if err != nil {
+			metricsMu.Lock()
+			metrics.FetchErrors[errorCategory(preview, err)]++
+			metricsMu.Unlock()
+		}
+	}()
+
+	parsed, err := url.Parse(targetURL)
+	if err != nil {
+		return Preview{URL: targetURL, Error: "Invalid URL"}, err
+	}
+
+	if err := validateTarget(parsed); err != nil {
+		return Preview{URL: targetURL, Error: "Blocked"}, err
+	}
+
+	meta, upstream, err := fetchPage(ctx, targetURL, userAgent, opts)
+	if err != nil {
+		return upstream, err
+	}
+
+	// Some sites only serve rich metadata to known crawlers, so retry with
+	// fallback user agents while the page yields neither title nor image
+	fallbacks := fallbackUserAgents[:max(0, min(len(fallbackUserAgents), cfg().MaxUserAgentAttempts-1))]
+	fallbackOpts := opts
+	fallbackOpts.Trace = nil
+	for _, ua := range fallbacks {
+		if meta.Title != "" || meta.Image != "" || ctx.Err() != nil {
+			break
+		}
+		fallbackMeta, fallbackUpstream, err := fetchPage(ctx, targetURL, ua, fallbackOpts)
+		if err != nil {
+			break
+		}
+		if fallbackMeta.Title != "" || fallbackMeta.Image != "" {
+			meta, upstream = fallbackMeta, fallbackUpstream
+		}
+	}
+
+	preview = buildPreview(parsed, targetURL, meta, upstream)
+
+	// PWAs may declare icons only in their manifest
+	if fetchManifest && meta.Manifest != "" {
+		manifestURL := resolveURL(html.UnescapeString(meta.Manifest), targetURL)
+		if manifest, err := fetchWebManifest(ctx, manifestURL); err == nil {
+			preview.ManifestThemeColor = strings.TrimSpace(manifest.ThemeColor)
+			preview.ManifestBackgroundColor = strings.TrimSpace(manifest.BackgroundColor)
+			if icon := manifest.bestIcon(); icon != "" && meta.Favicon == "" {
+				logoIsFavicon := preview.Logo == preview.Favicon
+				preview.Favicon = resolveURL(icon, manifestURL)
+				if logoIsFavicon {
+					preview.Logo = preview.Favicon
+				}
+			}
+		} else {
+			debugf("Manifest %s: %v", manifestURL, err)
+		}
+	}
+
+	if fetchFeedInfo && len(preview.Feeds) > 0 {
+		if title, kind, err := fetchFeedSummary(ctx, preview.Feeds[0]); err == nil {
+			preview.FeedTitle, preview.FeedType = title, kind
+		} else {
+			debugf("Feed %s: %v", preview.Feeds[0], err)
+		}
+	}
+
+	if probeIcons && preview.Favicon == defaultFavicon(parsed) {
+		if icon := probeIconPaths(ctx, parsed); icon != "" {
+			if preview.Logo == preview.Favicon {
+				preview.Logo = icon
+			}
+			preview.Favicon = icon
+		}
+	}
+
+	// The image URL depends on how the client reached us, so fetchPreview
+	// sets it for each request
+	if screenshotService != "" && preview.Image == "" && !opts.NoImage {
+		preview.Screenshot = true
+	}
+	if verifyIcons {
+		verifyPreviewIcons(ctx, &preview, parsed)
+	}
+	if safeBrowsingKey != "" {
+		preview.ThreatType = safeBrowsingThreat(ctx, targetURL, preview.UpstreamFinalURL)
+		preview.Unsafe = preview.ThreatType != ""
+	}
+	rememberImageHosts(preview)
+	return preview, nil
+}
+
+// fetchPage fetches targetURL as the given user agent and scans it for
+// metadata; the returned Preview only carries the upstream response details
+func fetchPage(ctx context.Context, targetURL, ua string, opts previewOptions) (metaTags, Preview, error) {
+	reqOpts := upstreamOptions{
+		UserAgent: ua,
+		Accept:    "text/html,application/xhtml+xml",
+	}
+	// Only the page's own round trips are traced, not the manifest, feed or
+	// icon fetches that share ctx
+	pageCtx := ctx
+	if opts.Trace != nil {
+		pageCtx = opts.Trace.withTrace(ctx)
+	}
+	fetchStart := time.Now()
+	resp, err := doUpstream(pageCtx, "GET", targetURL, reqOpts)
+	if err == nil && slices.Contains(retryOnStatus, resp.StatusCode) {
+		if wait, ok := retryWait(ctx, resp.Header.Get("Retry-After")); ok {
+			resp.Body.Close()
+			select {
+			case <-time.After(wait):
+				resp, err = doUpstream(pageCtx, "GET", targetURL, reqOpts)
+			case <-ctx.Done():
+				err = ctx.Err()
+			}
+		}
+	}
+	if opts.Timings != nil {
+		opts.Timings.Fetch += time.Since(fetchStart)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return metaTags{}, Preview{URL: targetURL, Error: "Timed out"}, errDeadline()
+		}
+		return metaTags{}, Preview{URL: targetURL, Error: "Failed to fetch"}, err
+	}
+	defer resp.Body.Close()
+	defer countDownload(resp, "preview", targetURL)()
+
+	upstream := Preview{
+		URL:              targetURL,
+		UpstreamStatus:   resp.StatusCode,
+		UpstreamFinalURL: resp.Request.URL.String(),
+		ContentType:      resp.Header.Get("Content-Type"),
+		cacheTTL:         upstreamCacheTTL(resp.Header),
+		Debug:            &DebugInfo{Protocol: resp.Proto},
+	}
+
+	challenge, peeked := isBotChallenge(resp)
+	if challenge {
+		upstream.Error = "Blocked by bot challenge"
+		return metaTags{}, upstream, &fetchError{Code: "bot_challenge", Err: fmt.Errorf("HTTP %d bot challenge", resp.StatusCode)}
+	}
+
+	if requested, err := url.Parse(targetURL); err == nil && isLoginRedirect(requested, resp.Request.URL) {
+		upstream.RedirectedToLogin = true
+		upstream.Error = "Requires authentication"
+		return metaTags{}, upstream, &fetchError{Code: "requires_auth", Err: fmt.Errorf("redirected to login at %s", resp.Request.URL)}
+	}
+
+	// Soft 404s and similar quirks can still carry full metadata, so statuses
+	// in EXTRACT_ON_STATUS are scanned when they serve HTML
+	softStatus := slices.Contains(extractOnStatus, resp.StatusCode) &&
+		strings.Contains(strings.ToLower(upstream.ContentType), "html")
+	if resp.StatusCode == http.StatusTooManyRequests {
+		upstream.RetryAfter = retryAfterSeconds(resp.Header.Get("Retry-After"))
+	}
+	if resp.StatusCode != 200 && !softStatus {
+		upstream.Error = "HTTP " + resp.Status
+		return metaTags{}, upstream, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+
+	parseStart := time.Now()
+	meta := extractMetaTags(io.MultiReader(bytes.NewReader(peeked), resp.Body), cfg().ScanLimit, opts)
+	if opts.Timings != nil {
+		opts.Timings.Parse += time.Since(parseStart)
+	}
+	if resp.StatusCode != 200 && meta.Title == "" && meta.Image == "" {
+		upstream.Error = "HTTP " + resp.Status
+		return metaTags{}, upstream, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+
+	// A body that trickles in past the deadline leaves the scan with partial
+	// data; report the timeout rather than caching an incomplete preview
+	if ctx.Err() != nil {
+		upstream.Error = "Timed out"
+		return metaTags{}, upstream, errDeadline()
+	}
+
+	return meta, upstream, nil
+}
+
+var (
+	loginPathRe = regexp.MustCompile(`(?i)/(log-?in|sign-?in|auth|sso|session/new|oauth2?/authorize)(/|\.|$)`)
+	loginHostRe = regexp.MustCompile(`(?i)^(login|signin|auth|sso|accounts|id)\.`)
+)
+
+// isLoginRedirect is a heuristic for gated content: the request was
+// redirected and ended on a login-looking path (/login, /signin, /auth, ...)
+// or on a login-looking host (login., accounts., sso., ...) other than the
+// requested one. Requesting a login page directly isn't flagged.
+func isLoginRedirect(requested, final *url.URL) bool {
+	if final.String() == requested.String() {
+		return false
+	}
+	if loginPathRe.MatchString(final.Path) && !loginPathRe.MatchString(requested.Path) {
+		return true
+	}
+	return !strings.EqualFold(final.Hostname(), requested.Hostname()) && loginHostRe.MatchString(final.Hostname())
+}
+
+// safeBrowsingThreat looks the URLs up in Google Safe Browsing and returns
+// the threat type of the first match, or "" when none is listed or the
+// lookup fails. Verdicts are cached per URL for safeBrowsingCacheTTL.
+func safeBrowsingThreat(ctx context.Context, urls ...string) string {
+	var entries []map[string]string
+	for _, u := range urls {
+		if u == "" || slices.ContainsFunc(entries, func(e map[string]string) bool { return e["url"] == u }) {
+			continue
+		}
+		if threat, ok := safeBrowsingCache.Get(u); ok {
+			if threat != "" {
+				return threat
+			}
+			continue
+		}
+		entries = append(entries, map[string]string{"url": u})
+	}
+	if len(entries) == 0 {
+		return ""
+	}
+
+	body, _ := json.Marshal(map[string]any{
+		"client": map[string]string{"clientId": "glance-link-preview", "clientVersion": "1.0"},
+		"threatInfo": map[string]any{
+			"threatTypes":      []string{"MALWARE", "SOCIAL_ENGINEERING", "UNWANTED_SOFTWARE", "POTENTIALLY_HARMFUL_APPLICATION"},
+			"platformTypes":    []string{"ANY_PLATFORM"},
+			"threatEntryTypes": []string{"URL"},
+			"threatEntries":    entries,
+		},
+	})
+	resp, err := doUpstream(ctx, "POST", safeBrowsingURL+"?key="+url.QueryEscape(safeBrowsingKey), upstreamOptions{
+		Body:        bytes.NewReader(body),
+		ContentType: "application/json",
+		Timeout:     cfg().SafeBrowsingTimeout,
+	})
+	if err != nil {
+		// The request URL, and so the error, carries the API key
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		debugf("Safe Browsing lookup: %v", err)
+		return ""
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		debugf("Safe Browsing lookup: HTTP %d", resp.StatusCode)
+		return ""
+	}
+	var result struct {
+		Matches []struct {
+			ThreatType string `json:"threatType"`
+			Threat     struct {
+				URL string `json:"url"`
+			} `json:"threat"`
+		} `json:"matches"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1024*1024)).Decode(&result); err != nil {
+		debugf("Safe Browsing lookup: %v", err)
+		return ""
+	}
+
+	threats := make(map[string]string)
+	for _, m := range result.Matches {
+		if _, ok := threats[m.Threat.URL]; !ok {
+			threats[m.Threat.URL] = m.ThreatType
+		}
+	}
+	threat := ""
+	for _, e := range entries {
+		safeBrowsingCache.Add(e["url"], threats[e["url"]])
+		if threat == "" {
+			threat = threats[e["url"]]
+		}
+	}
+	return threat
+}
+
+// webManifest is the subset of a web app manifest used for previews
+type webManifest struct {
+	ThemeColor      string `json:"theme_color"`
+	BackgroundColor string `json:"background_color"`
+	Icons           []struct {
+		Src     string `json:"src"`
+		Sizes   string `json:"sizes"`
+		Purpose string `json:"purpose"`
+	} `json:"icons"`
+}
+
+// fetchWebManifest downloads and decodes a manifest, bounded in size and time
+func fetchWebManifest(ctx context.Context, manifestURL string) (webManifest, error) {
+	var manifest webManifest
+
+	u, err := url.Parse(manifestURL)
+	if err != nil {
+		return manifest, err
+	}
+	if err := validateTarget(u); err != nil {
+		return manifest, err
+	}
+
+	resp, err := doUpstream(ctx, "GET", manifestURL, upstreamOptions{
+		Accept:  "application/manifest+json,application/json",
+		Timeout: cfg().ManifestTimeout,
+	})
+	if err != nil {
+		return manifest, err
+	}
+	defer resp.Body.Close()
+	defer countDownload(resp, "manifest", manifestURL)()
+
+	if resp.StatusCode != 200 {
+		return manifest, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, int64(manifestMaxBytes)+1))
+	if err != nil {
+		return manifest, err
+	}
+	if len(data) > manifestMaxBytes {
+		return manifest, fmt.Errorf("manifest exceeds %d bytes", manifestMaxBytes)
+	}
+	err = json.Unmarshal(data, &manifest)
+	return manifest, err
+}
+
+// fetchFeedSummary reads the start of a feed, bounded in size and time, and
+// returns its title and format
+func fetchFeedSummary(ctx context.Context, feedURL string) (title, kind string, err error) {
+	u, err := url.Parse(feedURL)
+	if err != nil {
+		return "", "", err
+	}
+	if err := validateTarget(u); err != nil {
+		return "", "", err
+	}
+
+	resp, err := doUpstream(ctx, "GET", feedURL, upstreamOptions{
+		Accept:  "application/rss+xml,application/atom+xml,application/feed+json,application/xml;q=0.9,*/*;q=0.8",
+		Timeout: cfg().FeedTimeout,
+	})
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	defer countDownload(resp, "feed", feedURL)()
+
+	if resp.StatusCode != 200 {
+		return "", "", fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+
+	body := bufio.NewReader(io.LimitReader(resp.Body, int64(feedMaxBytes)))
+	first, err := skipSpace(body)
+	if err != nil {
+		return "", "", err
+	}
+	if first == '{' {
+		title, err = jsonFeedTitle(body)
+		return title, "json-feed", err
+	}
+	return xmlFeedSummary(body)
+}
+
+// skipSpace consumes leading whitespace and a byte order mark, returning
+// the next byte without consuming it
+func skipSpace(r *bufio.Reader) (byte, error) {
+	for {
+		c, _, err := r.ReadRune()
+		if err != nil {
+			return 0, err
+		}
+		if c != '\uFEFF' && !unicode.IsSpace(c) {
+			r.UnreadRune()
+			return byte(c), nil
+		}
+	}
+}
+
+// jsonFeedTitle streams the top-level object of a JSON Feed up to its title,
+// so a feed cut off by FEED_MAX_BYTES still yields one declared early
+func jsonFeedTitle(r io.Reader) (string, error) {
+	dec := json.NewDecoder(r)
+	if _, err := dec.Token(); err != nil {
+		return "", err
+	}
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return "", err
+		}
+		if key == "title" {
+			var title string
+			err := dec.Decode(&title)
+			return strings.TrimSpace(title), err
+		}
+		var skip json.RawMessage
+		if err := dec.Decode(&skip); err != nil {
+			return "", err
+		}
+	}
+	return "", nil
+}
+
+// xmlFeedSummary takes the format from the root element and the title from
+// the first <title>, which for RSS and Atom is the feed's own
+func xmlFeedSummary(r io.Reader) (title, kind string, err error) {
+	dec := xml.NewDecoder(r)
+	dec.Strict = false
+	dec.CharsetReader = func(_ string, input io.Reader) (io.Reader, error) { return input, nil }
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			// A feed cut off by FEED_MAX_BYTES still has a known format
+			if kind != "" {
+				err = nil
+			}
+			return "", kind, err
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if kind == "" {
+			switch start.Name.Local {
+			case "rss", "RDF":
+				kind = "rss"
+			case "feed":
+				kind = "atom"
+			default:
+				return "", "", fmt.Errorf("unknown feed root <%s>", start.Name.Local)
+			}
+			continue
+		}
+		if start.Name.Local == "title" {
+			var text string
+			if err := dec.DecodeElement(&text, &start); err != nil {
+				return "", kind, err
+			}
+			return strings.Join(strings.Fields(text), " "), kind, nil
+		}
+	}
+}
+
+// addDominantColor computes the color of the preview image and stores it in
+// the cached preview, so later extract_color requests don't refetch the image
+func addDominantColor(cacheKey string, preview Preview, opts previewOptions) Preview {
+	result, err, _ := imageGroup.Do("color:"+preview.Image, func() (interface{}, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), cfg().ColorTimeout)
+		defer cancel()
+		return dominantColor(ctx, preview.Image)
+	})
+	if err != nil {
+		debugf("Dominant color %s: %v", preview.Image, err)
+		return preview
+	}
+
+	preview.DominantColor = result.(string)
+	if !opts.NoStore {
+		updateCachedPreview(cacheKey, func(cached *Preview) { cached.DominantColor = preview.DominantColor })
+	}
+	return preview
+}
+
+// dominantColor fetches an image, bounded by maxImageBytes, and returns its
+// most common color as #rrggbb. Pixels are sampled on a grid of about
+// colorSampleSize² points and bucketed at 4 bits per channel; the pixels of
+// the largest bucket are averaged. Mostly transparent pixels are ignored.
+func dominantColor(ctx context.Context, imageURL string) (string, error) {
+	u, err := url.Parse(imageURL)
+	if err != nil {
+		return "", err
+	}
+	if err := validateTarget(u); err != nil {
+		return "", err
+	}
+
+	resp, err := doUpstream(ctx, "GET", imageURL, upstreamOptions{Referer: imageReferer(imageURL, "")})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	defer countDownload(resp, "image", imageURL)()
+
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, int64(maxImageBytes)))
+	if err != nil {
+		return "", err
+	}
+	img, _, err := decodeImage(data)
+	if err != nil {
+		return "", err
+	}
+
+	bounds := img.Bounds()
+	stepX := max(1, bounds.Dx()/colorSampleSize)
+	stepY := max(1, bounds.Dy()/colorSampleSize)
+
+	type bucket struct{ r, g, b, n uint64 }
+	buckets := make(map[uint32]*bucket)
+	var best *bucket
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += stepY {
+		for x := bounds.Min.X; x < bounds.Max.X; x += stepX {
+			r, g, b, a := img.At(x, y).RGBA()
+			if a < 0x8000 {
+				continue
+			}
+			// Undo alpha premultiplication and scale to 8 bits
+			r, g, b = r*0xff/a, g*0xff/a, b*0xff/a
+			key := (r>>4)<<8 | (g>>4)<<4 | b>>4
+			bk := buckets[key]
+			if bk == nil {
+				bk = &bucket{}
+				buckets[key] = bk
+			}
+			bk.r, bk.g, bk.b, bk.n = bk.r+uint64(r), bk.g+uint64(g), bk.b+uint64(b), bk.n+1
+			if best == nil || bk.n > best.n {
+				best = bk
+			}
+		}
+	}
+	if best == nil {
+		return "", errors.New("image has no opaque pixels")
+	}
+	return fmt.Sprintf("#%02x%02x%02x", best.r/best.n, best.g/best.n, best.b/best.n), nil
+}
+
+// bestIcon picks the general-purpose icon whose size is closest to
+// preferredIconSize, preferring the larger on ties; maskable and monochrome
+// only icons are skipped since they don't render well as favicons
+func (m webManifest) bestIcon() string {
+	best, bestDiff := "", -1
+	for _, icon := range m.Icons {
+		purpose := strings.Fields(icon.Purpose)
+		if icon.Src == "" || (len(purpose) > 0 && !slices.Contains(purpose, "any")) {
+			continue
+		}
+
+		diff := iconSize(icon.Sizes) - preferredIconSize
+		if diff < 0 {
+			diff = -diff*2 + 1
+		}
+		if bestDiff < 0 || diff < bestDiff {
+			best, bestDiff = icon.Src, diff
+		}
+	}
+	return best
+}
+
+// iconSize is the largest width in a sizes attribute like "16x16 32x32",
+// with "any" (scalable) counting as 512 and no usable size as 0
+func iconSize(sizes string) int {
+	size := 0
+	for _, dims := range strings.Fields(strings.ToLower(sizes)) {
+		if dims == "any" {
+			size = max(size, 512)
+			continue
+		}
+		if w, _, ok := strings.Cut(dims, "x"); ok {
+			if n, err := strconv.Atoi(w); err == nil {
+				size = max(size, n)
+			}
+		}
+	}
+	return size
+}
+
+// appleTouchIcon picks the largest apple-touch-icon link; unsized ones only
+// win when no link declares a size
+func appleTouchIcon(htmlStr string) string {
+	best, bestSize := "", -1
+	for _, attrs := range relLinks(htmlStr, "apple-touch-icon", "apple-touch-icon-precomposed") {
+		href := strings.TrimSpace(attrs["href"])
+		if size := iconSize(attrs["sizes"]); href != "" && size > bestSize {
+			best, bestSize = href, size
+		}
+	}
+	return best
+}
+
+func defaultFavicon(parsed *url.URL) string {
+	scheme := parsed.Scheme
+	if scheme == "" {
+		scheme = "https"
+	}
+	return scheme + "://" + parsed.Host + "/favicon.ico"
+}
+
+// probeIconPaths returns the first of iconProbePaths on parsed's origin that
+// serves an image, or "" when /favicon.ico itself does or nothing does
+func probeIconPaths(ctx context.Context, parsed *url.URL) string {
+	ctx, cancel := context.WithTimeout(ctx, cfg().FaviconTimeout)
+	defer cancel()
+
+	if check := checkLink(ctx, defaultFavicon(parsed)); check.OK && isImageContentType(check.ContentType) {
+		return ""
+	}
+	for _, p := range iconProbePaths {
+		if ctx.Err() != nil {
+			break
+		}
+		candidate := (&url.URL{Scheme: cmp.Or(parsed.Scheme, "https"), Host: parsed.Host, Path: "/" + strings.TrimPrefix(p, "/")}).String()
+		if check := checkLink(ctx, candidate); check.OK && isImageContentType(check.ContentType) {
+			return candidate
+		}
+	}
+	return ""
+}
+
+// verifyPreviewIcons replaces favicon and logo URLs that don't serve a real
+// image with the next fallback: the default favicon, then nothing
+func verifyPreviewIcons(ctx context.Context, preview *Preview, parsed *url.URL) {
+	logoIsFavicon := preview.Logo == preview.Favicon
+
+	faviconOK := verifyIcon(ctx, preview.Favicon)
+	if !faviconOK && preview.Favicon != defaultFavicon(parsed) {
+		preview.Favicon = defaultFavicon(parsed)
+		faviconOK = verifyIcon(ctx, preview.Favicon)
+	}
+	if !faviconOK {
+		preview.Favicon = ""
+	}
+
+	if logoIsFavicon || !verifyIcon(ctx, preview.Logo) {
+		preview.Logo = preview.Favicon
+	}
+}
+
+// siteNameSeparators join a page title and the site name in titles like
+// "Page Title | Site Name"
+var siteNameSeparators = []string{" | ", " - ", " — ", " – "}
+
+// trimSiteNameSuffix removes a trailing separator and siteName from title,
+// leaving titles that are only the site name alone
+func trimSiteNameSuffix(title, siteName string) string {
+	siteName = strings.TrimSpace(siteName)
+	if siteName == "" {
+		return title
+	}
+	for _, sep := range siteNameSeparators {
+		i := strings.LastIndex(title, sep)
+		if i <= 0 || !strings.EqualFold(strings.TrimSpace(title[i+len(sep):]), siteName) {
+			continue
+		}
+		if page := strings.TrimSpace(title[:i]); page != "" {
+			return page
+		}
+	}
+	return title
+}
+
+// buildPreview turns scanned metadata into a Preview, resolving relative URLs
+// against targetURL and filling fallbacks from the host. It makes no network
+// calls, so it also serves /extract.
+func buildPreview(parsed *url.URL, targetURL string, meta metaTags, upstream Preview) Preview {
+	title := meta.Title
+	if title == "" && titleHostFallback {
+		title = parsed.Host
+	}
+	title = html.UnescapeString(title)
+	displayTitle := title
+	if stripTitleSiteName {
+		displayTitle = trimSiteNameSuffix(title, html.UnescapeString(meta.SiteName))
+	}
+
+	description := meta.Description
+	if description != "" {
+		description = html.UnescapeString(description)
+	}
+
+	image := meta.Image
+	if image != "" {
+		image = resolveURL(image, targetURL)
+		if !isAbsoluteHTTP(image) {
+			image = defaultImage
+		}
+	}
+
+	siteName := meta.SiteName
+	if siteName == "" {
+		siteName = parsed.Host
+	}
+
+	favicon := meta.Favicon
+	if favicon == "" {
+		favicon = defaultFavicon(parsed)
+	} else {
+		favicon = resolveURL(favicon, targetURL)
+	}
+
+	var images []OGImage
+	for _, img := range meta.Images {
+		img.URL = resolveURL(html.UnescapeString(img.URL), targetURL)
+		if isAbsoluteHTTP(img.URL) {
+			images = append(images, img)
+		}
+	}
+
+	logo := favicon
+	if meta.Logo != "" {
+		logo = resolveURL(meta.Logo, targetURL)
+	}
+
+	preview := Preview{
+		URL:         targetURL,
+		Title:       truncate(displayTitle, 200),
+		HasTitle:    meta.Title != "",
+		Description: truncate(description, 300),
+		Image:       image,
+		SiteName:    siteName,
+		Favicon:     favicon,
+		Logo:        logo,
+		Images:      images,
+		Type:        strings.ToLower(meta.Type),
+
+		Locale:           meta.Locale,
+		LocaleAlternates: meta.LocaleAlternates,
+		Determiner:       meta.Determiner,
+
+		Price:        meta.Price,
+		Currency:     meta.Currency,
+		Availability: meta.Availability,
+
+		PublishedTime: meta.PublishedTime,
+		Domain:        parsed.Host,
+
+		UpstreamStatus:   upstream.UpstreamStatus,
+		UpstreamFinalURL: upstream.UpstreamFinalURL,
+		ContentType:      upstream.ContentType,
+		cacheTTL:         upstream.cacheTTL,
+
+		Debug: &DebugInfo{
+			ScanTruncated: meta.ScanTruncated,
+			BytesScanned:  meta.BytesScanned,
+			RawHead:       meta.RawHead,
+		},
+	}
+	// Kept with every cached preview, so bounded like Description
+	for _, d := range meta.Descriptions {
+		preview.Debug.Descriptions = append(preview.Debug.Descriptions, SourcedText{d.Source, truncate(html.UnescapeString(d.Text), 300)})
+	}
+	if upstream.Debug != nil {
+		preview.Debug.Protocol = upstream.Debug.Protocol
+	}
+	if meta.Video != "" {
+		preview.Video = resolveURL(html.UnescapeString(meta.Video), targetURL)
+	}
+	preview.VideoDuration = parseVideoDuration(meta.VideoDuration)
+	if meta.WordCount > 0 {
+		preview.ReadingTimeMinutes = max(1, int(math.Round(float64(meta.WordCount)/wordsPerMinute)))
+	}
+	if preview.Video != "" || preview.VideoDuration > 0 {
+		preview.VideoPoster = image
+	}
+	preview.PlayerAspectRatio = aspectRatio(meta.PlayerWidth, meta.PlayerHeight)
+	if meta.AppleTouchIcon != "" {
+		preview.AppleTouchIcon = resolveURL(html.UnescapeString(meta.AppleTouchIcon), targetURL)
+	}
+	// Keep the untruncated, unstripped text for clients that index the full title
+	if preview.Title != title {
+		preview.FullTitle = title
+	}
+	if preview.Description != description {
+		preview.FullDescription = description
+	}
+
+	for lang, href := range meta.Alternates {
+		if preview.Alternates == nil {
+			preview.Alternates = make(map[string]string, len(meta.Alternates))
+		}
+		preview.Alternates[lang] = resolveURL(html.UnescapeString(href), targetURL)
+	}
+
+	for _, feed := range meta.Feeds {
+		preview.Feeds = append(preview.Feeds, resolveURL(html.UnescapeString(feed), targetURL))
+	}
+
+	for _, link := range meta.AuthorLinks {
+		preview.AuthorLinks = append(preview.AuthorLinks, resolveURL(html.UnescapeString(link), targetURL))
+	}
+	preview.ContentHash = contentHash(preview)
+
+	return preview
+}
+
+// corsMiddleware allows any origin to call the route with methods
+func corsMiddleware(next http.HandlerFunc, methods ...string) http.HandlerFunc {
+	allow := strings.Join(methods, ", ")
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", allow)
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		if r.Method == "OPTIONS" {
+			return
+		}
+		next(w, r)
+	}
+}
+
+// methodsMiddleware answers 405 with an Allow header for methods outside methods
+func methodsMiddleware(next http.HandlerFunc, methods ...string) http.HandlerFunc {
+	allow := strings.Join(methods, ", ")
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !slices.Contains(methods, r.Method) {
+			w.Header().Set("Allow", allow)
+			http.Error(w, "Method not allowed", 405)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func cacheHeadersMiddleware(next http.HandlerFunc, maxAge int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", maxAge))
+		next(w, r)
+	}
+}
+
+// policyHeadersMiddleware advises browsers how to treat our responses when
+// embedded cross-origin: proxied images and previews are meant to be loaded
+// from any site, and no referrer needs to leak through them
+func policyHeadersMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if referrerPolicy != "off" {
+			w.Header().Set("Referrer-Policy", referrerPolicy)
+		}
+		if crossOriginResourcePolicy != "off" {
+			w.Header().Set("Cross-Origin-Resource-Policy", crossOriginResourcePolicy)
+		}
+		next(w, r)
+	}
+}
+
+func queryBool(r *http.Request, key string) bool {
+	b, _ := strconv.ParseBool(r.URL.Query().Get(key))
+	return b
+}
+
+// jsonEncoder writes compact JSON to w, or indented JSON for ?pretty=1 when
+// reading responses by hand
+func jsonEncoder(w http.ResponseWriter, r *http.Request) *json.Encoder {
+	enc := json.NewEncoder(w)
+	if queryBool(r, "pretty") {
+		enc.SetIndent("", "  ")
+	}
+	return enc
+}
+
+func handlePreview(w http.ResponseWriter, r *http.Request) {
+	targetURL := r.URL.Query().Get("url")
 	if targetURL == "" {
 		http.Error(w, "Missing url parameter", 400)
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(fetchPreview(targetURL))
+	opts, err := parsePreviewOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if opts.TTL > 0 {
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(opts.TTL.Seconds())))
+	}
+	if previewFormat(r) == "sse" {
+		streamPreview(w, targetURL, opts)
+		return
+	}
+	opts.Timings = &serverTimings{}
+	preview := fetchPreview(targetURL, opts)
+	w.Header().Set("Server-Timing", opts.Timings.header())
+	writePreview(w, r, preview)
+}
+
+// streamPreview sends Server-Sent Events: a "field" event with {name: value}
+// for each field as the head scan finds it, then a "preview" event with the
+// complete preview. A cached preview is sent as the "preview" event alone.
+func streamPreview(w http.ResponseWriter, targetURL string, opts previewOptions) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", 500)
+		return
+	}
+
+	w.Header().Set("Vary", "Accept")
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	send := func(event string, data any) {
+		payload, _ := json.Marshal(data)
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload)
+		flusher.Flush()
+	}
+
+	opts.OnField = func(name, value string) {
+		value = html.UnescapeString(value)
+		if name == "image" || name == "favicon" {
+			value = resolveURL(value, targetURL)
+		}
+		send("field", map[string]string{name: value})
+	}
+	send("preview", fetchPreview(targetURL, opts))
+}
+
+var namespaceRe = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+// parsePreviewOptions reads the per-request preview settings shared by
+// /preview and /previews
+func parsePreviewOptions(r *http.Request) (previewOptions, error) {
+	opts := previewOptions{
+		DebugTiming:  queryBool(r, "debug_timing"),
+		Debug:        queryBool(r, "debug"),
+		Namespace:    r.URL.Query().Get("namespace"),
+		ExtractColor: queryBool(r, "extract_color"),
+		ReadingTime:  queryBool(r, "reading_time"),
+		NoImage:      queryBool(r, "no_image"),
+		VerifyImage:  queryBool(r, "verify_image"),
+		BaseURL:      externalBaseURL(r),
+	}
+	if opts.Namespace == "" {
+		opts.Namespace = r.Header.Get("X-Cache-Namespace")
+	}
+
+	// Cache-Control request directives map onto refresh semantics
+	for _, directive := range strings.Split(r.Header.Get("Cache-Control"), ",") {
+		switch strings.ToLower(strings.TrimSpace(directive)) {
+		case "no-cache":
+			opts.Refresh = true
+		case "no-store":
+			opts.NoStore = true
+		}
+	}
+	if queryBool(r, "refresh") {
+		opts.Refresh = true
+	}
+	if opts.Namespace != "" && !namespaceRe.MatchString(opts.Namespace) {
+		return opts, errors.New("Invalid namespace")
+	}
+	if v := r.URL.Query().Get("ttl"); v != "" {
+		seconds, err := strconv.Atoi(v)
+		if err != nil || seconds <= 0 {
+			return opts, errors.New("Invalid ttl, must be a positive number of seconds")
+		}
+		opts.TTL = min(max(time.Duration(seconds)*time.Second, cfg().PreviewCacheMinTTL), cfg().PreviewCacheMaxTTL)
+	}
+	return opts, nil
+}
+
+// previewFormat picks the response format from ?format= or the Accept header
+func previewFormat(r *http.Request) string {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format
+	}
+	if strings.Contains(r.Header.Get("Accept"), "application/ld+json") {
+		return "jsonld"
+	}
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		return "sse"
+	}
+	return "json"
+}
+
+func writePreview(w http.ResponseWriter, r *http.Request, preview Preview) {
+	w.Header().Set("Vary", "Accept")
+
+	switch format := previewFormat(r); {
+	case queryBool(r, "summary") && preview.Error == "":
+		w.Header().Set("Content-Type", "application/json")
+		jsonEncoder(w, r).Encode(PreviewSummary{
+			URL:         preview.URL,
+			Title:       truncateWords(preview.Title, summaryTitleLen),
+			Description: truncateWords(preview.Description, summaryDescriptionLen),
+			Image:       preview.Image,
+		})
+	case format == "jsonld" && preview.Error == "":
+		w.Header().Set("Content-Type", "application/ld+json")
+		jsonEncoder(w, r).Encode(previewJSONLD(preview))
+	case format == "meta" && preview.Error == "":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, previewMetaTags(preview))
+	case format == "text" && preview.Error == "":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		io.WriteString(w, previewText(preview)+"\n")
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		jsonEncoder(w, r).Encode(preview)
+	}
+}
+
+// previewText renders a preview as a single line, "Title — Description
+// (domain)", for logs, shells and bots; empty parts are left out
+func previewText(p Preview) string {
+	var parts []string
+	for _, s := range []string{p.Title, p.Description} {
+		if s = strings.Join(strings.Fields(s), " "); s != "" {
+			parts = append(parts, s)
+		}
+	}
+	text := strings.Join(parts, " — ")
+	if p.Domain != "" {
+		text = strings.TrimSpace(text + " (" + p.Domain + ")")
+	}
+	return text
+}
+
+// previewMetaTags renders a preview as Open Graph <meta> elements, one per
+// line, ready to inject into a page head
+func previewMetaTags(p Preview) string {
+	tags := [][2]string{
+		{"og:url", p.URL},
+		{"og:title", p.Title},
+		{"og:description", p.Description},
+		{"og:site_name", p.SiteName},
+		{"og:type", p.Type},
+		{"og:image", p.Image},
+	}
+	if len(p.Images) > 0 && p.Images[0].URL == p.Image {
+		img := p.Images[0]
+		if img.Width > 0 && img.Height > 0 {
+			tags = append(tags, [2]string{"og:image:width", strconv.Itoa(img.Width)}, [2]string{"og:image:height", strconv.Itoa(img.Height)})
+		}
+		tags = append(tags, [2]string{"og:image:alt", img.Alt})
+	}
+	tags = append(tags, [2]string{"og:video", p.Video}, [2]string{"og:locale", p.Locale})
+	for _, locale := range p.LocaleAlternates {
+		tags = append(tags, [2]string{"og:locale:alternate", locale})
+	}
+	tags = append(tags, [2]string{"og:determiner", p.Determiner})
+	if p.PublishedTime != "" && strings.HasPrefix(p.Type, "article") {
+		tags = append(tags, [2]string{"article:published_time", p.PublishedTime})
+	}
+
+	var b strings.Builder
+	for _, tag := range tags {
+		if tag[1] != "" {
+			fmt.Fprintf(&b, "<meta property=\"%s\" content=\"%s\">\n", tag[0], html.EscapeString(tag[1]))
+		}
+	}
+	return b.String()
+}
+
+// PreviewSummary is the ?summary=1 response, pre-trimmed to fit push
+// notification limits
+type PreviewSummary struct {
+	URL         string `json:"url"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Image       string `json:"image,omitempty"`
+}
+
+const (
+	summaryTitleLen       = 50
+	summaryDescriptionLen = 100
+)
+
+// truncateWords shortens s to at most maxLen characters including a
+// trailing ellipsis, cutting at the last word boundary when there is one
+func truncateWords(s string, maxLen int) string {
+	runes := []rune(strings.TrimSpace(s))
+	if len(runes) <= maxLen {
+		return string(runes)
+	}
+	cut := string(runes[:maxLen-1])
+	if i := strings.LastIndexAny(cut, " \t\n"); i > 0 {
+		cut = cut[:i]
+	}
+	return strings.TrimRight(cut, " \t\n,;:.-") + "…"
+}
+
+// previewJSONLD maps a preview onto a schema.org Article (for og:type
+// article pages) or WebPage
+func previewJSONLD(p Preview) map[string]any {
+	doc := map[string]any{
+		"@context": "https://schema.org",
+		"@type":    "WebPage",
+		"url":      p.URL,
+		"name":     p.Title,
+	}
+	if p.Description != "" {
+		doc["description"] = p.Description
+	}
+	if p.Image != "" {
+		doc["image"] = p.Image
+	}
+
+	if strings.HasPrefix(p.Type, "article") {
+		publisher := map[string]any{"@type": "Organization", "name": p.SiteName}
+		if p.Logo != "" {
+			publisher["logo"] = map[string]any{"@type": "ImageObject", "url": p.Logo}
+		}
+		doc["@type"] = "Article"
+		doc["headline"] = p.Title
+		doc["publisher"] = publisher
+	} else {
+		doc["isPartOf"] = map[string]any{"@type": "WebSite", "name": p.SiteName}
+	}
+	return doc
+}
+
+func handlePreviews(w http.ResponseWriter, r *http.Request) {
+	urls := r.URL.Query()["url"]
+	if len(urls) == 0 {
+		http.Error(w, "Missing url parameter", 400)
+		return
+	}
+	if len(urls) > 20 {
+		http.Error(w, "Maximum 20 URLs", 400)
+		return
+	}
+
+	opts, err := parsePreviewOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	results := make([]Preview, len(urls))
+	var wg sync.WaitGroup
+	for i, u := range urls {
+		wg.Add(1)
+		go func(idx int, targetURL string) {
+			defer wg.Done()
+			results[idx] = fetchPreview(targetURL, opts)
+		}(i, u)
+	}
+	wg.Wait()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	// sort=success lists successful previews first, each keeping its original
+	// index so clients can map results back to their input
+	if r.URL.Query().Get("sort") == "success" {
+		sorted := make([]batchPreview, len(results))
+		for i, preview := range results {
+			sorted[i] = batchPreview{Index: i, Preview: preview}
+		}
+		sort.SliceStable(sorted, func(i, j int) bool {
+			return sorted[i].Error == "" && sorted[j].Error != ""
+		})
+		jsonEncoder(w, r).Encode(sorted)
+		return
+	}
+
+	jsonEncoder(w, r).Encode(results)
+}
+
+// handleWebSocket streams previews over a WebSocket: each text message is a
+// URL, answered with its preview as soon as that resolves, so answers can
+// arrive out of order. Query parameters apply to every URL like on /preview.
+// URLs over a connection's per-minute allowance get a rate_limited error.
+func handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	opts, err := parsePreviewOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	// Any origin may connect, as with the CORS headers on the other endpoints
+	conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{InsecureSkipVerify: true})
+	if err != nil {
+		return
+	}
+	defer conn.CloseNow()
+	conn.SetReadLimit(int64(wsMaxMessageBytes))
+
+	ctx := r.Context()
+	sem := make(chan struct{}, max(1, wsConcurrency))
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	windowStart, accepted := time.Now(), 0
+	for {
+		_, data, err := conn.Read(ctx)
+		if err != nil {
+			return
+		}
+		targetURL := strings.TrimSpace(string(data))
+		if targetURL == "" {
+			continue
+		}
+
+		if time.Since(windowStart) >= time.Minute {
+			windowStart, accepted = time.Now(), 0
+		}
+		if accepted++; accepted > wsURLsPerMinute {
+			wsjson.Write(ctx, conn, Preview{
+				URL:        targetURL,
+				Error:      "Rate limit exceeded",
+				ErrorCode:  "rate_limited",
+				RetryAfter: int(math.Ceil((time.Minute - time.Since(windowStart)).Seconds())),
+			})
+			continue
+		}
+
+		// A full semaphore stops reading, pushing back on the client
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			wsjson.Write(ctx, conn, fetchPreview(targetURL, opts))
+		}()
+	}
+}
+
+// batchPreview tags a /previews result with its position in the request
+type batchPreview struct {
+	Index int `json:"index"`
+	Preview
+}
+
+func handleProxyImage(w http.ResponseWriter, r *http.Request) {
+	imageURL := r.URL.Query().Get("url")
+	if imageURL == "" {
+		http.Error(w, "Missing url parameter", 400)
+		return
+	}
+
+	parsed, err := url.Parse(imageURL)
+	if err != nil {
+		http.Error(w, "Invalid url parameter", 400)
+		return
+	}
+	if err := validateTarget(parsed); err != nil {
+		http.Error(w, "Image host not allowed", 403)
+		return
+	}
+	// With screenshot=1, ?url= is the page to render; the backend is ours,
+	// so it skips the image host checks
+	if queryBool(r, "screenshot") {
+		if screenshotService == "" {
+			http.Error(w, "Screenshots not enabled", 404)
+			return
+		}
+		imageURL = strings.ReplaceAll(screenshotService, "{url}", url.QueryEscape(imageURL))
+	} else if proxyKnownImageHostsOnly && !imageHosts.Contains(strings.ToLower(parsed.Hostname())) {
+		http.Error(w, "Image host not allowed", 403)
+		return
+	}
+
+	timer := time.NewTimer(proxyImageQueueTimeout)
+	select {
+	case proxyImageSlots <- struct{}{}:
+		timer.Stop()
+	case <-timer.C:
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Too many image requests", 503)
+		return
+	case <-r.Context().Done():
+		timer.Stop()
+		return
+	}
+	imageProxyInFlight.Add(1)
+	defer func() {
+		imageProxyInFlight.Add(-1)
+		<-proxyImageSlots
+	}()
+
+	cacheKey := "img_" + hashURL(imageURL)
+	referer := imageReferer(imageURL, r.URL.Query().Get("referer"))
+
+	if v := r.URL.Query().Get("w"); v != "" {
+		width, err := strconv.Atoi(v)
+		if err != nil || width < 1 || width > maxImageWidth {
+			http.Error(w, fmt.Sprintf("Invalid w parameter, must be 1-%d", maxImageWidth), 400)
+			return
+		}
+		serveImageVariant(w, r, imageURL, cacheKey, referer, width)
+		return
+	}
+
+	if cached, ok := getCachedImage(cacheKey); ok {
+		metricsMu.Lock()
+		metrics.ImageHits++
+		metricsMu.Unlock()
+
+		serveImage(w, r, cached)
+		return
+	}
+
+	metricsMu.Lock()
+	metrics.ImageMisses++
+	metricsMu.Unlock()
+
+	// Ranged requests go upstream on their own, so a partial response is
+	// never shared or cached
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+		result, err := fetchImage(w, imageURL, cacheKey, referer, rangeHeader)
+		if errors.Is(err, errImageStreamed) {
+			return
+		}
+		if err != nil {
+			var fe *fetchError
+			if errors.As(err, &fe) && fe.Status != 0 {
+				http.Error(w, "Image not found", fe.Status)
+				return
+			}
+			http.Error(w, "Failed to fetch image", 500)
+			return
+		}
+		serveImage(w, r, result)
+		return
+	}
+
+	// Concurrent requests for the same uncached image share one upstream fetch.
+	// A leader that streamed a large image has nothing to share, so waiters
+	// then fetch it themselves.
+	led := false
+	result, err, _ := imageGroup.Do(imageURL, func() (interface{}, error) {
+		led = true
+		return fetchImage(w, imageURL, cacheKey, referer, "")
+	})
+	if errors.Is(err, errImageStreamed) && !led {
+		result, err = fetchImage(w, imageURL, cacheKey, referer, "")
+	}
+	if errors.Is(err, errImageStreamed) {
+		return
+	}
+	if err != nil {
+		var fe *fetchError
+		if errors.As(err, &fe) && fe.Status != 0 {
+			http.Error(w, "Image not found", fe.Status)
+			return
+		}
+		http.Error(w, "Failed to fetch image", 500)
+		return
+	}
+
+	serveImage(w, r, result.(ImageCacheEntry))
+}
+
+// serveImageVariant serves the image scaled down to width. Variants are
+// cached like originals, but at most maxImageVariants per source image; the
+// least recently used variant of a source makes way for a new one.
+func serveImageVariant(w http.ResponseWriter, r *http.Request, imageURL, sourceKey, referer string, width int) {
+	variantKey := fmt.Sprintf("%s_w%d", sourceKey, width)
+
+	entry, ok := getCachedImage(variantKey)
+	metricsMu.Lock()
+	if ok {
+		metrics.ImageHits++
+	} else {
+		metrics.ImageMisses++
+	}
+	metricsMu.Unlock()
+
+	if !ok {
+		result, err, _ := imageGroup.Do(variantKey, func() (interface{}, error) {
+			source, ok := getCachedImage(sourceKey)
+			if !ok {
+				var err error
+				if source, err = downloadImage(imageURL, referer); err != nil {
+					return nil, err
+				}
+			}
+			return resizeImage(source, width), nil
+		})
+		if err != nil {
+			var fe *fetchError
+			if errors.As(err, &fe) && fe.Status != 0 {
+				http.Error(w, "Image not found", fe.Status)
+				return
+			}
+			http.Error(w, "Failed to fetch image", 500)
+			return
+		}
+		entry = result.(ImageCacheEntry)
+		if len(entry.Data) < maxCachedImageBytes {
+			addCachedImage(variantKey, entry)
+		}
+	}
+	trackImageVariant(sourceKey, variantKey)
+
+	serveImage(w, r, entry)
+}
+
+// getCachedImage looks an image up by its cache key, going through its
+// content hash when images are deduplicated
+func getCachedImage(key string) (ImageCacheEntry, bool) {
+	if !dedupeImages {
+		return imageCache.Get(key)
+	}
+	hash, ok := imageKeys.Get(key)
+	if !ok {
+		return ImageCacheEntry{}, false
+	}
+	return imageCache.Get(hash)
+}
+
+// addCachedImage caches an image under key; deduplicated, the bytes are
+// stored once per content hash and key only points at them
+func addCachedImage(key string, entry ImageCacheEntry) {
+	if !dedupeImages {
+		imageCache.Add(key, entry)
+		return
+	}
+	hash := "hash_" + strings.Trim(cmp.Or(entry.ETag, imageETag(entry.Data)), `"`)
+	imageKeys.Add(key, hash)
+	imageCache.Add(hash, entry)
+}
+
+// removeCachedImage drops key; deduplicated bytes other keys may share are
+// left to the LRU
+func removeCachedImage(key string) {
+	if !dedupeImages {
+		imageCache.Remove(key)
+		return
+	}
+	imageKeys.Remove(key)
+}
+
+// trackImageVariant records a cached variant of a source image, evicting
+// the source's least recently used variant beyond maxImageVariants
+func trackImageVariant(sourceKey, variantKey string) {
+	imageVariantsMu.Lock()
+	defer imageVariantsMu.Unlock()
+
+	variants, ok := imageVariants.Get(sourceKey)
+	if !ok {
+		variants, _ = lru.NewWithEvict(max(1, maxImageVariants), func(key string, _ struct{}) {
+			removeCachedImage(key)
+		})
+		imageVariants.Add(sourceKey, variants)
+	}
+	variants.Add(variantKey, struct{}{})
+}
+
+// decodeImage decodes data after checking, from the header alone, that the
+// image is within maxImagePixels
+func decodeImage(data []byte) (image.Image, string, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width > maxImagePixels/config.Height {
+		return nil, "", fmt.Errorf("image too large: %dx%d", config.Width, config.Height)
+	}
+	return image.Decode(bytes.NewReader(data))
+}
+
+// downloadImage fetches a whole image, up to maxImageBytes, for processing
+func downloadImage(imageURL, referer string) (ImageCacheEntry, error) {
+	resp, err := doUpstream(context.Background(), "GET", imageURL, upstreamOptions{Referer: referer})
+	if err != nil {
+		return ImageCacheEntry{}, err
+	}
+	defer resp.Body.Close()
+	defer countDownload(resp, "image", imageURL)()
+
+	if resp.StatusCode != 200 {
+		return ImageCacheEntry{}, &fetchError{Code: "http_error", Status: resp.StatusCode, Err: fmt.Errorf("HTTP %d", resp.StatusCode)}
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, int64(maxImageBytes)))
+	if err != nil {
+		return ImageCacheEntry{}, err
+	}
+	return ImageCacheEntry{
+		Data:         data,
+		ContentType:  imageContentType(resp.Header.Get("Content-Type"), data),
+		ETag:         imageETag(data),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}, nil
+}
+
+// resizeImage scales an image down to width, keeping the aspect ratio, by
+// averaging the source pixels under each target pixel. JPEGs stay JPEG and
+// everything else becomes PNG; images already narrow enough, or in formats
+// the standard library can't decode, are returned unchanged.
+func resizeImage(entry ImageCacheEntry, width int) ImageCacheEntry {
+	src, format, err := decodeImage(entry.Data)
+	if err != nil {
+		return entry
+	}
+	b := src.Bounds()
+	if width >= b.Dx() {
+		return entry
+	}
+	height := max(1, b.Dy()*width/b.Dx())
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := range height {
+		y0, y1 := b.Min.Y+y*b.Dy()/height, b.Min.Y+max((y+1)*b.Dy()/height, y*b.Dy()/height+1)
+		for x := range width {
+			x0, x1 := b.Min.X+x*b.Dx()/width, b.Min.X+max((x+1)*b.Dx()/width, x*b.Dx()/width+1)
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := src.At(sx, sy).RGBA()
+					r, g, bl, a, n = r+uint64(pr), g+uint64(pg), bl+uint64(pb), a+uint64(pa), n+1
+				}
+			}
+			dst.Set(x, y, color.RGBA64{uint16(r / n), uint16(g / n), uint16(bl / n), uint16(a / n)})
+		}
+	}
+
+	var buf bytes.Buffer
+	if format == "jpeg" {
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 85})
+		entry.ContentType = "image/jpeg"
+	} else {
+		err = png.Encode(&buf, dst)
+		entry.ContentType = "image/png"
+	}
+	if err != nil {
+		return entry
+	}
+	entry.Data = buf.Bytes()
+	entry.ETag = imageETag(entry.Data)
+	return entry
+}
+
+func writeImageHeaders(w http.ResponseWriter, contentType string) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(imageCacheTTL.Seconds())))
+}
+
+// serveImage writes a buffered image with its validators, answering 304
+// when the client already has these bytes
+func serveImage(w http.ResponseWriter, r *http.Request, entry ImageCacheEntry) {
+	writeImageHeaders(w, entry.ContentType)
+	if entry.ETag != "" {
+		w.Header().Set("ETag", entry.ETag)
+	}
+	if entry.LastModified != "" {
+		w.Header().Set("Last-Modified", entry.LastModified)
+	}
+	if entry.ETag != "" && etagMatches(r.Header.Get("If-None-Match"), entry.ETag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Write(entry.Data)
 }
 
-func handlePreviews(w http.ResponseWriter, r *http.Request) {
-	urls := r.URL.Query()["url"]
-	if len(urls) == 0 {
+// imageETag is a strong validator for image bytes
+func imageETag(data []byte) string {
+	h := md5.Sum(data)
+	return `"` + hex.EncodeToString(h[:]) + `"`
+}
+
+// etagMatches reports whether an If-None-Match header lists etag, using the
+// weak comparison RFC 9110 prescribes for it
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// handleProxyFavicon serves the favicon at ?url= with a long cache TTL,
+// falling back to the origin's /favicon.ico and then FAVICON_SERVICE
+func handleProxyFavicon(w http.ResponseWriter, r *http.Request) {
+	iconURL := r.URL.Query().Get("url")
+	if iconURL == "" {
 		http.Error(w, "Missing url parameter", 400)
 		return
 	}
-	if len(urls) > 20 {
-		http.Error(w, "Maximum 20 URLs", 400)
+
+	parsed, err := url.Parse(iconURL)
+	if err != nil {
+		http.Error(w, "Invalid url parameter", 400)
+		return
+	}
+	if err := validateTarget(parsed); err != nil {
+		http.Error(w, "Favicon host not allowed", 403)
+		return
+	}
+	if proxyKnownImageHostsOnly && !imageHosts.Contains(strings.ToLower(parsed.Hostname())) {
+		http.Error(w, "Favicon host not allowed", 403)
 		return
 	}
 
-	results := make([]Preview, len(urls))
-	var wg sync.WaitGroup
-	for i, u := range urls {
-		wg.Add(1)
-		go func(idx int, targetURL string) {
-			defer wg.Done()
-			results[idx] = fetchPreview(targetURL)
-		}(i, u)
+	cacheKey := "ico_" + hashURL(iconURL)
+	entry, ok := faviconCache.Get(cacheKey)
+
+	metricsMu.Lock()
+	if ok {
+		metrics.ImageHits++
+	} else {
+		metrics.ImageMisses++
 	}
-	wg.Wait()
+	metricsMu.Unlock()
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(results)
+	if !ok {
+		result, err, _ := imageGroup.Do(cacheKey, func() (interface{}, error) {
+			return fetchFavicon(parsed)
+		})
+		if err != nil {
+			http.Error(w, "Favicon not found", 404)
+			return
+		}
+		entry = result.(ImageCacheEntry)
+		faviconCache.Add(cacheKey, entry)
+	}
+
+	w.Header().Set("Content-Type", entry.ContentType)
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(faviconCacheTTL.Seconds())))
+	w.Write(entry.Data)
 }
 
-func handleProxyImage(w http.ResponseWriter, r *http.Request) {
-	imageURL := r.URL.Query().Get("url")
-	if imageURL == "" {
+// fetchFavicon tries the icon itself, the origin's /favicon.ico, then the
+// favicon service, and normalizes the first that works
+func fetchFavicon(parsed *url.URL) (ImageCacheEntry, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg().FaviconTimeout)
+	defer cancel()
+
+	candidates := []string{parsed.String()}
+	if fallback := defaultFavicon(parsed); fallback != parsed.String() {
+		candidates = append(candidates, fallback)
+	}
+	if faviconService != "" {
+		candidates = append(candidates, strings.ReplaceAll(faviconService, "{domain}", url.QueryEscape(parsed.Hostname())))
+	}
+
+	var err error
+	for _, candidate := range candidates {
+		var entry ImageCacheEntry
+		if entry, err = fetchIcon(ctx, candidate); err == nil {
+			return normalizeIcon(entry), nil
+		}
+		debugf("Favicon %s: %v", candidate, err)
+	}
+	return ImageCacheEntry{}, err
+}
+
+// normalizeIcon re-encodes icons as PNG unless they already are PNG or ICO.
+// SVG and formats the standard library can't decode are passed through.
+func normalizeIcon(entry ImageCacheEntry) ImageCacheEntry {
+	switch mediaType, _, _ := strings.Cut(entry.ContentType, ";"); strings.TrimSpace(mediaType) {
+	case "image/png", "image/x-icon", "image/vnd.microsoft.icon", "image/svg+xml":
+		return entry
+	}
+
+	img, _, err := decodeImage(entry.Data)
+	if err != nil {
+		return entry
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return entry
+	}
+	return ImageCacheEntry{Data: buf.Bytes(), ContentType: "image/png"}
+}
+
+// imageReferer picks the Referer for an upstream image fetch so hotlink
+// protection lets it through: the page passed as ?referer=, or else the
+// image's own origin unless IMAGE_REFERER=none
+func imageReferer(imageURL, pageURL string) string {
+	if u, err := url.Parse(pageURL); err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" {
+		return u.String()
+	}
+	if imageRefererMode != "origin" {
+		return ""
+	}
+	if u, err := url.Parse(imageURL); err == nil && u.Host != "" {
+		return u.Scheme + "://" + u.Host + "/"
+	}
+	return ""
+}
+
+// isImageContentType accepts image types and the generic ones some servers
+// send for images, but not e.g. the HTML of a soft 404
+func isImageContentType(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	return strings.HasPrefix(mediaType, "image/") || genericContentTypes[mediaType]
+}
+
+// genericContentTypes say nothing about what an image actually is
+var genericContentTypes = map[string]bool{
+	"":                         true,
+	"application/octet-stream": true,
+	"binary/octet-stream":      true,
+	"application/binary":       true,
+	"application/unknown":      true,
+	"text/plain":               true,
+}
+
+// imageContentType keeps the upstream's Content-Type unless it is missing
+// or generic, in which case the type is sniffed from the first bytes. A
+// sniffed non-image type isn't trusted, so those stay application/octet-stream.
+func imageContentType(upstream string, data []byte) string {
+	mediaType, _, _ := strings.Cut(upstream, ";")
+	if !genericContentTypes[strings.ToLower(strings.TrimSpace(mediaType))] {
+		return upstream
+	}
+	if sniffed := http.DetectContentType(data); strings.HasPrefix(sniffed, "image/") {
+		return sniffed
+	}
+	return "application/octet-stream"
+}
+
+// errImageStreamed means fetchImage already wrote the image to its writer
+var errImageStreamed = errors.New("image streamed to client")
+
+// fetchImage buffers and caches images smaller than maxCachedImageBytes and
+// returns them for the caller to write. Larger ones are streamed straight to
+// w, bounded by maxImageBytes, without holding them in memory, and
+// errImageStreamed is returned. A rangeHeader is forwarded upstream, and a
+// 206 (or 416) answer to it is relayed as is.
+func fetchImage(w http.ResponseWriter, imageURL, cacheKey, referer, rangeHeader string) (ImageCacheEntry, error) {
+	resp, err := doUpstream(context.Background(), "GET", imageURL, upstreamOptions{Referer: referer, Range: rangeHeader})
+	if err != nil {
+		return ImageCacheEntry{}, err
+	}
+	defer resp.Body.Close()
+	defer countDownload(resp, "image", imageURL)()
+
+	if rangeHeader != "" && (resp.StatusCode == http.StatusPartialContent || resp.StatusCode == http.StatusRequestedRangeNotSatisfiable) {
+		writeImageHeaders(w, imageContentType(resp.Header.Get("Content-Type"), nil))
+		for _, h := range []string{"Content-Range", "Accept-Ranges", "ETag", "Last-Modified"} {
+			if v := resp.Header.Get(h); v != "" {
+				w.Header().Set(h, v)
+			}
+		}
+		if resp.ContentLength >= 0 && resp.ContentLength <= int64(maxImageBytes) {
+			w.Header().Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, io.LimitReader(resp.Body, int64(maxImageBytes)))
+		return ImageCacheEntry{}, errImageStreamed
+	}
+
+	if resp.StatusCode != 200 {
+		return ImageCacheEntry{}, &fetchError{Code: "http_error", Status: resp.StatusCode, Err: fmt.Errorf("HTTP %d", resp.StatusCode)}
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, int64(maxCachedImageBytes)))
+	if err != nil {
+		return ImageCacheEntry{}, err
+	}
+	contentType := imageContentType(resp.Header.Get("Content-Type"), data)
+
+	if len(data) < maxCachedImageBytes {
+		entry := ImageCacheEntry{
+			Data:         data,
+			ContentType:  contentType,
+			ETag:         imageETag(data),
+			LastModified: resp.Header.Get("Last-Modified"),
+		}
+		addCachedImage(cacheKey, entry)
+		return entry, nil
+	}
+
+	// Streamed images aren't hashed, so only the upstream's validators apply
+	writeImageHeaders(w, contentType)
+	for _, h := range []string{"ETag", "Last-Modified"} {
+		if v := resp.Header.Get(h); v != "" {
+			w.Header().Set(h, v)
+		}
+	}
+	if resp.ContentLength > 0 && resp.ContentLength <= int64(maxImageBytes) {
+		w.Header().Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+	w.Write(data)
+	io.Copy(w, io.LimitReader(resp.Body, int64(maxImageBytes-len(data))))
+	return ImageCacheEntry{}, errImageStreamed
+}
+
+func handleCheck(w http.ResponseWriter, r *http.Request) {
+	targetURL := r.URL.Query().Get("url")
+	if targetURL == "" {
 		http.Error(w, "Missing url parameter", 400)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	jsonEncoder(w, r).Encode(checkLink(r.Context(), targetURL))
+}
 
-	cacheKey := "img_" + hashURL(imageURL)
+// checkLink validates a link with a HEAD request, falling back to a one-byte
+// ranged GET for servers that reject HEAD. Results are cached briefly, unless
+// ctx ended first.
+func checkLink(ctx context.Context, targetURL string) CheckResult {
+	cacheKey := hashURL(targetURL)
+	if cached, ok := checkCache.Get(cacheKey); ok {
+		return cached
+	}
 
-	if cached, ok := imageCache.Get(cacheKey); ok {
-		metricsMu.Lock()
-		metrics.ImageHits++
-		metricsMu.Unlock()
+	result := CheckResult{URL: targetURL}
+	parsed, err := url.Parse(targetURL)
+	if err == nil {
+		err = validateTarget(parsed)
+	}
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
 
-		w.Header().Set("Content-Type", cached.ContentType)
-		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(imageCacheTTL.Seconds())))
-		w.Write(cached.Data)
-		return
+	ctx, cancel := context.WithTimeout(ctx, cfg().RequestDeadline)
+	defer cancel()
+
+	resp, err := checkRequest(ctx, "HEAD", targetURL)
+	if err == nil && (resp.StatusCode == 403 || resp.StatusCode == 405 || resp.StatusCode == 501) {
+		resp, err = checkRequest(ctx, "GET", targetURL)
 	}
 
-	metricsMu.Lock()
-	metrics.ImageMisses++
-	metricsMu.Unlock()
+	if err != nil {
+		result.Error = err.Error()
+	} else {
+		result.Status = resp.StatusCode
+		result.OK = resp.StatusCode < 400
+		result.ContentType = resp.Header.Get("Content-Type")
+	}
 
-	req, _ := http.NewRequest("GET", imageURL, nil)
-	req.Header.Set("User-Agent", userAgent)
+	if ctx.Err() == nil {
+		checkCache.Add(cacheKey, result)
+	}
+	return result
+}
 
-	resp, err := client.Do(req)
+// checkRequest issues a bodiless request; GETs ask for a single byte and the
+// body is closed unread either way
+func checkRequest(ctx context.Context, method, targetURL string) (*http.Response, error) {
+	var opts upstreamOptions
+	if method == "GET" {
+		opts.Range = "bytes=0-0"
+	}
+	resp, err := doUpstream(ctx, method, targetURL, opts)
 	if err != nil {
-		http.Error(w, "Failed to fetch image", 500)
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+type extractRequest struct {
+	URL  string `json:"url"`
+	HTML string `json:"html"`
+}
+
+// handleExtract runs the extraction pipeline over caller-supplied HTML; the
+// URL is only used to resolve relative links and nothing is fetched
+func handleExtract(w http.ResponseWriter, r *http.Request) {
+	var body extractRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, int64(maxExtractBytes))).Decode(&body); err != nil {
+		http.Error(w, "Invalid JSON body", 400)
+		return
+	}
+	if body.URL == "" {
+		http.Error(w, "Missing url field", 400)
+		return
+	}
+	parsed, err := url.Parse(body.URL)
+	if err != nil || parsed.Host == "" {
+		http.Error(w, "Invalid url field", 400)
 		return
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
-		http.Error(w, "Image not found", resp.StatusCode)
+	meta := extractMetaTags(strings.NewReader(body.HTML), cfg().ScanLimit, previewOptions{
+		ReadingTime: queryBool(r, "reading_time"),
+		NoImage:     queryBool(r, "no_image"),
+	})
+	preview := buildPreview(parsed, body.URL, meta, Preview{})
+	if !queryBool(r, "debug") {
+		preview.Debug = nil
+	}
+	writePreview(w, r, preview)
+}
+
+type endpointInfo struct {
+	Path        string `json:"path"`
+	Methods     string `json:"methods"`
+	Description string `json:"description"`
+}
+
+// endpoints is the API summary served at the root path
+var endpoints = []endpointInfo{
+	{"/preview", "GET", "Preview for ?url=; supports format=jsonld, format=meta, format=text, format=sse, summary=1, ttl=, debug=1, debug_timing=1, extract_color=1, reading_time=1, no_image=1, verify_image=1 and pretty=1"},
+	{"/previews", "GET", "Previews for up to 20 repeated ?url= parameters; sort=success lists failures last"},
+	{"/proxy-image", "GET", "Proxies and caches the image at ?url=; w= scales it down to that width, screenshot=1 renders the page at ?url= instead"},
+	{"/proxy-favicon", "GET", "Proxies and caches the favicon at ?url=, falling back to /favicon.ico and a favicon service"},
+	{"/check", "GET", "Link check for ?url= via HEAD, without downloading the body"},
+	{"/extract", "POST", "Preview extracted from a JSON body {url, html} without fetching; supports reading_time=1"},
+	{"/ws", "GET", "WebSocket taking one URL per message and answering each with its preview as it resolves"},
+	{"/health", "GET", "Liveness check"},
+	{"/metrics", "GET", "Cache and memory metrics"},
+	{"/admin/config", "GET, POST", "Reads or updates runtime settings such as timeouts and scan limits; requires ADMIN_TOKEN"},
+}
+
+func handleRoot(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
 		return
 	}
+	// Absolute URLs as clients see them, e.g. through the proxy
+	type endpointLink struct {
+		endpointInfo
+		URL string `json:"url"`
+	}
+	base := externalBaseURL(r)
+	list := make([]endpointLink, len(endpoints))
+	for i, e := range endpoints {
+		list[i] = endpointLink{e, base + e.Path}
+	}
 
-	data, _ := io.ReadAll(io.LimitReader(resp.Body, 2*1024*1024))
-	contentType := resp.Header.Get("Content-Type")
-	if contentType == "" {
-		contentType = "image/jpeg"
+	w.Header().Set("Content-Type", "application/json")
+	jsonEncoder(w, r).Encode(map[string]any{
+		"service":   "link-preview",
+		"endpoints": list,
+	})
+}
+
+// externalBaseURL is the scheme and host clients reached us on. Behind a
+// proxy in TRUSTED_PROXIES that's taken from X-Forwarded-Proto,
+// X-Forwarded-Host and X-Forwarded-Prefix; those headers are ignored from
+// anyone else, since they'd let clients forge our links.
+func externalBaseURL(r *http.Request) string {
+	scheme, host, prefix := "http", r.Host, ""
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if fromTrustedProxy(r) {
+		if proto := firstForwarded(r.Header.Get("X-Forwarded-Proto")); proto == "http" || proto == "https" {
+			scheme = proto
+		}
+		if fwdHost := firstForwarded(r.Header.Get("X-Forwarded-Host")); fwdHost != "" {
+			host = fwdHost
+		}
+		prefix = strings.TrimRight(firstForwarded(r.Header.Get("X-Forwarded-Prefix")), "/")
 	}
+	return scheme + "://" + host + prefix
+}
 
-	// Only cache smaller images to save memory
-	if len(data) < 500*1024 {
-		imageCache.Add(cacheKey, ImageCacheEntry{
-			Data:        data,
-			ContentType: contentType,
-		})
+// firstForwarded takes the value set by the proxy closest to the client
+// from a comma-separated forwarded header
+func firstForwarded(v string) string {
+	first, _, _ := strings.Cut(v, ",")
+	return strings.TrimSpace(first)
+}
+
+func fromTrustedProxy(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		// Unix socket peers are local
+		return r.RemoteAddr == "@" || r.RemoteAddr == ""
+	}
+	for _, cidr := range trustedProxies {
+		if cidr.Contains(ip) {
+			return true
+		}
 	}
+	return false
+}
 
-	w.Header().Set("Content-Type", contentType)
-	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(imageCacheTTL.Seconds())))
-	w.Write(data)
+// handleFavicon answers browsers' automatic /favicon.ico requests with no
+// content, cached for a day, instead of logging 404s
+func handleFavicon(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func handleHealth(w http.ResponseWriter, r *http.Request) {
@@ -465,27 +4596,202 @@ func handleHealth(w http.ResponseWriter, r *http.Request) {
 func handleMetrics(w http.ResponseWriter, r *http.Request) {
 	metricsMu.RLock()
 	m := metrics
+	m.FetchErrors = maps.Clone(metrics.FetchErrors)
 	metricsMu.RUnlock()
 
-	var memStats runtime.MemStats
-	runtime.ReadMemStats(&memStats)
-	m.MemoryUsageMB = int64(memStats.Alloc / 1024 / 1024)
-	m.PreviewSize = previewCache.Len()
-	m.ImageSize = imageCache.Len()
+	// MemoryUsageMB and the cache sizes are the cleanup routine's last
+	// readings, so scrapes don't stop the world or lock every cache shard
+	m.ActiveConnections = activeConnections.Load()
+	m.TotalDials = totalDials.Load()
+	m.ImageProxyInFlight = imageProxyInFlight.Load()
+	m.StartedAt = startTime
+	m.UptimeSeconds = time.Since(startTime).Seconds()
+
+	w.Header().Set("Content-Type", "application/json")
+	jsonEncoder(w, r).Encode(m)
+}
+
+// handleAdminConfig reads (GET) or updates (POST) the runtime configuration.
+// Updates are all-or-nothing and take effect for requests started after them
+func handleAdminConfig(w http.ResponseWriter, r *http.Request) {
+	if adminToken == "" {
+		http.NotFound(w, r)
+		return
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Unauthorized", 401)
+		return
+	}
+
+	if r.Method == "POST" {
+		var update map[string]json.RawMessage
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&update); err != nil {
+			http.Error(w, "Invalid JSON body", 400)
+			return
+		}
+		liveConfigMu.Lock()
+		next := *cfg()
+		if err := next.apply(update); err != nil {
+			liveConfigMu.Unlock()
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		liveConfig.Store(&next)
+		liveConfigMu.Unlock()
+		log.Printf("Runtime config updated: %s", strings.Join(slices.Sorted(maps.Keys(update)), ", "))
+	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(m)
+	w.Header().Set("Cache-Control", "no-store")
+	jsonEncoder(w, r).Encode(cfg().values())
+}
+
+// newServeMux registers every endpoint with its middlewares
+func newServeMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	readMethods := []string{"GET", "HEAD", "OPTIONS"}
+	extractMethods := []string{"POST", "OPTIONS"}
+
+	mux.HandleFunc("/preview", corsMiddleware(policyHeadersMiddleware(methodsMiddleware(cacheHeadersMiddleware(handlePreview, 3600), readMethods...)), readMethods...))
+	mux.HandleFunc("/previews", corsMiddleware(policyHeadersMiddleware(methodsMiddleware(cacheHeadersMiddleware(handlePreviews, 3600), readMethods...)), readMethods...))
+	mux.HandleFunc("/proxy-image", corsMiddleware(policyHeadersMiddleware(methodsMiddleware(handleProxyImage, readMethods...)), readMethods...))
+	mux.HandleFunc("/proxy-favicon", corsMiddleware(policyHeadersMiddleware(methodsMiddleware(handleProxyFavicon, readMethods...)), readMethods...))
+	mux.HandleFunc("/check", corsMiddleware(methodsMiddleware(handleCheck, readMethods...), readMethods...))
+	mux.HandleFunc("/extract", corsMiddleware(methodsMiddleware(handleExtract, extractMethods...), extractMethods...))
+	mux.HandleFunc("/ws", methodsMiddleware(handleWebSocket, "GET"))
+	mux.HandleFunc("/", methodsMiddleware(handleRoot, "GET", "HEAD"))
+	mux.HandleFunc("/favicon.ico", methodsMiddleware(handleFavicon, "GET", "HEAD"))
+	mux.HandleFunc("/health", methodsMiddleware(handleHealth, "GET", "HEAD"))
+	mux.HandleFunc("/metrics", methodsMiddleware(handleMetrics, "GET", "HEAD"))
+	mux.HandleFunc("/admin/config", methodsMiddleware(handleAdminConfig, "GET", "POST"))
+	return mux
 }
 
 func main() {
-	http.HandleFunc("/preview", corsMiddleware(cacheHeadersMiddleware(handlePreview, 3600)))
-	http.HandleFunc("/previews", corsMiddleware(cacheHeadersMiddleware(handlePreviews, 3600)))
-	http.HandleFunc("/proxy-image", corsMiddleware(handleProxyImage))
-	http.HandleFunc("/health", handleHealth)
-	http.HandleFunc("/metrics", handleMetrics)
+	listener, err := listen(listenAddr)
+	if err != nil {
+		log.Fatal("Failed to listen:", err)
+	}
 
-	log.Println("Link preview service starting on :5000")
 	log.Printf("Memory limits: %d preview entries (~10MB), %d image entries (~20MB)",
 		maxPreviewCacheEntries, maxImageCacheEntries)
-	log.Fatal(http.ListenAndServe(":5000", nil))
+
+	if tlsCertFile == "" && tlsKeyFile == "" {
+		log.Printf("Link preview service starting on %s", listener.Addr())
+		log.Fatal(http.Serve(listener, newServeMux()))
+	}
+
+	certs, err := newCertReloader(tlsCertFile, tlsKeyFile)
+	if err != nil {
+		log.Fatal("Failed to load TLS certificate:", err)
+	}
+	log.Printf("Link preview service starting on %s (TLS)", listener.Addr())
+	log.Fatal(newTLSServer(certs).ServeTLS(listener, "", ""))
+}
+
+// newTLSServer serves every endpoint over TLS 1.2 or later, with the key
+// pair from certs
+func newTLSServer(certs *certReloader) *http.Server {
+	return &http.Server{
+		Handler: newServeMux(),
+		TLSConfig: &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: certs.GetCertificate,
+		},
+	}
+}
+
+// certReloader serves the TLS key pair from disk and reloads it when either
+// file changes, so renewed certificates are picked up without a restart
+type certReloader struct {
+	certFile, keyFile string
+
+	cert    atomic.Pointer[tls.Certificate]
+	checked atomic.Int64 // UnixNano of the last check for changed files
+
+	mu      sync.Mutex // held by the handshake that checks the files
+	modTime time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	c.checked.Store(time.Now().UnixNano())
+	return c, nil
+}
+
+// reload loads the key pair if it changed since the last load; the caller
+// holds mu, or owns c exclusively during construction
+func (c *certReloader) reload() error {
+	var modTime time.Time
+	for _, file := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	loaded := c.cert.Load() != nil
+	if loaded && modTime.Equal(c.modTime) {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	if loaded {
+		log.Printf("Reloaded TLS certificate from %s", c.certFile)
+	}
+	c.cert.Store(&cert)
+	c.modTime = modTime
+	return nil
+}
+
+// GetCertificate checks the files at most every tlsReloadInterval, in a
+// single handshake while the others go on with the current certificate. It
+// keeps serving the previous certificate if a reload fails, e.g. while the
+// files are being replaced.
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if time.Since(time.Unix(0, c.checked.Load())) >= tlsReloadInterval && c.mu.TryLock() {
+		defer c.mu.Unlock()
+		if time.Since(time.Unix(0, c.checked.Load())) >= tlsReloadInterval {
+			if err := c.reload(); err != nil {
+				log.Printf("TLS certificate reload failed: %v", err)
+			}
+			c.checked.Store(time.Now().UnixNano())
+		}
+	}
+	return c.cert.Load(), nil
+}
+
+// listen binds LISTEN_ADDR: a host:port, or a Unix socket given as
+// unix:/path or an absolute path, replacing a stale socket file. Any other
+// file at the path is left alone and refused.
+func listen(addr string) (net.Listener, error) {
+	path, isUnix := strings.CutPrefix(addr, "unix:")
+	if !isUnix && !strings.HasPrefix(addr, "/") {
+		return net.Listen("tcp", addr)
+	}
+	if !isUnix {
+		path = addr
+	}
+	info, err := os.Lstat(path)
+	switch {
+	case err == nil && info.Mode()&os.ModeSocket == 0:
+		return nil, fmt.Errorf("%s exists and is not a socket", path)
+	case err == nil:
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		return nil, err
+	}
+	return net.Listen("unix", path)
 }
@@ -0,0 +1,4203 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/md5"
+	crand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"html"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"io"
+	"log"
+	"maps"
+	"math/big"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/hashicorp/golang-lru/v2/expirable"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// setVar overrides a package setting for the duration of the test
+func setVar[T any](t *testing.T, p *T, v T) {
+	t.Helper()
+	old := *p
+	*p = v
+	t.Cleanup(func() { *p = old })
+}
+
+// setConfig changes the runtime configuration for the duration of the test
+func setConfig(t *testing.T, change func(*runtimeConfig)) {
+	t.Helper()
+	next := *cfg()
+	change(&next)
+	old := liveConfig.Swap(&next)
+	t.Cleanup(func() { liveConfig.Store(old) })
+}
+
+// newUpstream starts a server for the service to fetch from, allowing its
+// random port, which ALLOWED_PORTS would otherwise block
+func newUpstream(t *testing.T, handler http.Handler) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	u, _ := url.Parse(srv.URL)
+	port, _ := strconv.Atoi(u.Port())
+	setVar(t, &allowedPorts, append(slices.Clone(allowedPorts), port))
+	return srv
+}
+
+// newPage serves body as an HTML page at every path
+func newPage(t *testing.T, body string) *httptest.Server {
+	t.Helper()
+	return newUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(body))
+	}))
+}
+
+// newTLSUpstream is newUpstream over TLS, with the service's client set to
+// accept the test certificate for any host name
+func newTLSUpstream(t *testing.T, handler http.Handler) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewTLSServer(handler)
+	t.Cleanup(srv.Close)
+	u, _ := url.Parse(srv.URL)
+	port, _ := strconv.Atoi(u.Port())
+	setVar(t, &allowedPorts, append(slices.Clone(allowedPorts), port))
+
+	transport := client.Transport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	setVar(t, &client.Transport, http.RoundTripper(transport))
+	return srv
+}
+
+// newCountingPage serves pages titled with the number of requests so far,
+// so a preview shows which fetch it came from
+func newCountingPage(t *testing.T) *httptest.Server {
+	t.Helper()
+	var n atomic.Int64
+	return newUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprintf(w, "<html><head><title>Fetch %d</title></head></html>", n.Add(1))
+	}))
+}
+
+// pngImage encodes a w×h PNG filled with c
+func pngImage(w, h int, c color.Color) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := range h {
+		for x := range w {
+			img.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	return buf.Bytes()
+}
+
+// pngBomb is a tiny PNG whose header declares w×h pixels, like a
+// decompression bomb; only the header is consistent
+func pngBomb(w, h uint32) []byte {
+	data := pngImage(1, 1, color.White)
+	// IHDR follows the 8-byte signature: length, type, width, height, ...
+	ihdr := data[8+8 : 8+8+13]
+	binary.BigEndian.PutUint32(ihdr[0:4], w)
+	binary.BigEndian.PutUint32(ihdr[4:8], h)
+	binary.BigEndian.PutUint32(data[8+8+13:], crc32.ChecksumIEEE(data[8+4:8+8+13]))
+	return data
+}
+
+// hitCounter counts requests per path
+type hitCounter struct {
+	mu   sync.Mutex
+	hits map[string]int
+}
+
+func (c *hitCounter) add(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.hits == nil {
+		c.hits = make(map[string]int)
+	}
+	c.hits[path]++
+}
+
+func (c *hitCounter) get(path string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits[path]
+}
+
+// roundTripFunc adapts a function to http.RoundTripper
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+// newService starts the service with all its endpoints and middlewares
+func newService(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(newServeMux())
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// getJSON fetches rawURL and decodes its JSON body into v
+func getJSON(t *testing.T, rawURL string, v any) *http.Response {
+	t.Helper()
+	resp, err := http.Get(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatalf("decoding %s: %v", rawURL, err)
+	}
+	return resp
+}
+
+// getPreview requests the preview of target from service, with any extra
+// query parameters
+func getPreview(t *testing.T, service *httptest.Server, target string, extra ...string) Preview {
+	t.Helper()
+	query := url.Values{"url": {target}}
+	for i := 0; i+1 < len(extra); i += 2 {
+		query.Set(extra[i], extra[i+1])
+	}
+	var preview Preview
+	getJSON(t, service.URL+"/preview?"+query.Encode(), &preview)
+	return preview
+}
+
+func TestPreviewBlocksDisallowedPorts(t *testing.T) {
+	service := newService(t)
+
+	preview := getPreview(t, service, "http://host:22/")
+	if preview.ErrorCode != "blocked" {
+		t.Errorf("http://host:22/: error code %q, want blocked", preview.ErrorCode)
+	}
+
+	// A live server is refused too until its port is allowed
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("fetched a blocked port")
+	}))
+	defer upstream.Close()
+	if preview := getPreview(t, service, upstream.URL+"/"); preview.ErrorCode != "blocked" {
+		t.Errorf("%s: error code %q, want blocked", upstream.URL, preview.ErrorCode)
+	}
+
+	page := newPage(t, `<html><head><title>Allowed</title></head></html>`)
+	if preview := getPreview(t, service, page.URL+"/"); preview.Title != "Allowed" {
+		t.Errorf("allowed port: title %q, error %q", preview.Title, preview.Error)
+	}
+}
+
+func TestPreviewDebugTiming(t *testing.T) {
+	service := newService(t)
+	upstream := newTLSUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<html><head><title>Timed</title></head></html>`))
+	}))
+	// A host name rather than the IP, so there's a lookup to time
+	target := strings.Replace(upstream.URL, "127.0.0.1", "localhost", 1) + "/"
+
+	for range 2 {
+		// A fresh connection each time, so every phase is timed
+		client.CloseIdleConnections()
+		preview := getPreview(t, service, target, "debug_timing", "1")
+		if preview.Title != "Timed" {
+			t.Fatalf("title %q, error %q", preview.Title, preview.Error)
+		}
+		timing := preview.Timing
+		if timing == nil {
+			t.Fatal("no timing")
+		}
+		for name, ms := range map[string]float64{"dns_ms": timing.DNSMs, "connect_ms": timing.ConnectMs, "tls_ms": timing.TLSMs, "ttfb_ms": timing.TTFBMs, "total_ms": timing.TotalMs} {
+			if ms <= 0 {
+				t.Errorf("%s = %v, want > 0", name, ms)
+			}
+		}
+		if timing.TTFBMs > timing.TotalMs {
+			t.Errorf("ttfb_ms %v exceeds total_ms %v", timing.TTFBMs, timing.TotalMs)
+		}
+	}
+
+	// The refreshed entry is cached without the timing
+	if preview := getPreview(t, service, target); preview.Timing != nil {
+		t.Errorf("cached preview has timing %+v", preview.Timing)
+	}
+}
+
+func TestPreviewLogo(t *testing.T) {
+	service := newService(t)
+
+	article := newPage(t, `<html><head><title>Article</title>
+<script type="application/ld+json">
+{"@context": "https://schema.org", "@type": "NewsArticle", "headline": "Article",
+ "publisher": {"@type": "Organization", "name": "Daily", "logo": {"@type": "ImageObject", "url": "/img/logo.png"}}}
+</script>
+</head></html>`)
+	if preview := getPreview(t, service, article.URL+"/news/1"); preview.Logo != article.URL+"/img/logo.png" {
+		t.Errorf("publisher logo: got %q", preview.Logo)
+	}
+
+	org := newPage(t, `<html><head><title>Home</title>
+<script type="application/ld+json">{"@type": "Organization", "logo": "https://cdn.example.com/brand.svg"}</script>
+</head></html>`)
+	if preview := getPreview(t, service, org.URL+"/"); preview.Logo != "https://cdn.example.com/brand.svg" {
+		t.Errorf("organization logo: got %q", preview.Logo)
+	}
+
+	plain := newPage(t, `<html><head><title>Plain</title><link rel="icon" href="/icon.png"></head></html>`)
+	preview := getPreview(t, service, plain.URL+"/")
+	if preview.Logo != plain.URL+"/icon.png" || preview.Logo != preview.Favicon {
+		t.Errorf("no logo: got logo %q, favicon %q", preview.Logo, preview.Favicon)
+	}
+}
+
+func TestPreviewDeadlineBoundsSlowBody(t *testing.T) {
+	setConfig(t, func(c *runtimeConfig) { c.RequestDeadline = 300 * time.Millisecond })
+	service := newService(t)
+	// The head trickles in a byte at a time and never ends
+	upstream := newUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<html><head>"))
+		for {
+			w.Write([]byte(" "))
+			w.(http.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(20 * time.Millisecond):
+			}
+		}
+	}))
+
+	start := time.Now()
+	preview := getPreview(t, service, upstream.URL+"/")
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("took %s with a 300ms deadline", elapsed)
+	}
+	if preview.ErrorCode != "timeout" {
+		t.Errorf("error code %q (%q), want timeout", preview.ErrorCode, preview.Error)
+	}
+}
+
+func TestPreviewContentHash(t *testing.T) {
+	service := newService(t)
+	mirror := newPage(t, `<html><head><title>Same  Story</title>
+<meta property="og:description" content="Told twice">
+<meta property="og:image" content="https://cdn.example.com/story.jpg"></head></html>`)
+	alias := newPage(t, `<html><head><title>same story</title>
+<meta property="og:description" content="Told
+  twice">
+<meta property="og:image" content="https://cdn.example.com/story.jpg"></head></html>`)
+	other := newPage(t, `<html><head><title>Another story</title></head></html>`)
+
+	first := getPreview(t, service, mirror.URL+"/a")
+	second := getPreview(t, service, alias.URL+"/b")
+	if first.ContentHash == "" || first.ContentHash != second.ContentHash {
+		t.Errorf("identical metadata hashed to %q and %q", first.ContentHash, second.ContentHash)
+	}
+	if third := getPreview(t, service, other.URL+"/"); third.ContentHash == first.ContentHash {
+		t.Errorf("different metadata share hash %q", third.ContentHash)
+	}
+}
+
+func TestPreviewUpstreamResponse(t *testing.T) {
+	service := newService(t)
+	upstream := newUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/old" {
+			http.Redirect(w, r, "/new", http.StatusMovedPermanently)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(`<html><head><title>Moved</title></head></html>`))
+	}))
+
+	preview := getPreview(t, service, upstream.URL+"/old")
+	if preview.UpstreamStatus != 200 {
+		t.Errorf("upstream_status %d, want 200", preview.UpstreamStatus)
+	}
+	if preview.UpstreamFinalURL != upstream.URL+"/new" {
+		t.Errorf("upstream_final_url %q, want %s/new", preview.UpstreamFinalURL, upstream.URL)
+	}
+	if preview.ContentType != "text/html; charset=utf-8" {
+		t.Errorf("content_type %q", preview.ContentType)
+	}
+}
+
+func TestPreviewGroupsImageProperties(t *testing.T) {
+	service := newService(t)
+	page := newPage(t, `<html><head><title>Gallery</title>
+<meta property="og:image" content="/wide.jpg">
+<meta property="og:image:width" content="1200">
+<meta property="og:image:height" content="630">
+<meta property="og:image:type" content="image/jpeg">
+<meta property="og:image" content="https://cdn.example.com/square.png">
+<meta property="og:image:width" content="400">
+<meta property="og:image:height" content="400">
+<meta property="og:image:type" content="image/png">
+</head></html>`)
+
+	preview := getPreview(t, service, page.URL+"/")
+	want := []OGImage{
+		{URL: page.URL + "/wide.jpg", Width: 1200, Height: 630, Type: "image/jpeg"},
+		{URL: "https://cdn.example.com/square.png", Width: 400, Height: 400, Type: "image/png"},
+	}
+	if !slices.Equal(preview.Images, want) {
+		t.Errorf("images:\n got %+v\nwant %+v", preview.Images, want)
+	}
+}
+
+// longHead is a page head with lines far longer than the scanner's
+// initial buffer, like minified markup
+func longHead() string {
+	var b strings.Builder
+	b.WriteString(`<html><head><title>Long lines</title><meta property="og:description" content="Found">`)
+	for i := range 200 {
+		fmt.Fprintf(&b, `<link rel="preload" href="/assets/chunk-%d.js" as="script">`, i)
+	}
+	b.WriteString("\n<style>" + strings.Repeat(".c{color:red}", 2000) + "</style>\n")
+	b.WriteString(`<meta property="og:image" content="/late.png"></head><body></body></html>`)
+	return b.String()
+}
+
+func TestPreviewLongHeadLines(t *testing.T) {
+	service := newService(t)
+	page := newPage(t, longHead())
+
+	preview := getPreview(t, service, page.URL+"/")
+	if preview.Description != "Found" || preview.Image != page.URL+"/late.png" {
+		t.Errorf("got description %q, image %q", preview.Description, preview.Image)
+	}
+}
+
+func BenchmarkExtractMetaTags(b *testing.B) {
+	page := []byte(longHead())
+	for _, size := range []int{4 * 1024, 16 * 1024} {
+		b.Run(fmt.Sprintf("buffer=%dKB", size/1024), func(b *testing.B) {
+			old := scanBufferSize
+			scanBufferSize = size
+			defer func() { scanBufferSize = old }()
+
+			b.ReportAllocs()
+			b.SetBytes(int64(len(page)))
+			for range b.N {
+				extractMetaTags(bytes.NewReader(page), 50000, previewOptions{})
+			}
+		})
+	}
+}
+
+// cloudflareChallenge is a trimmed Cloudflare "Just a moment..." interstitial
+const cloudflareChallenge = `<!DOCTYPE html><html lang="en-US"><head><title>Just a moment...</title>
+<meta http-equiv="Content-Type" content="text/html; charset=UTF-8">
+<meta name="robots" content="noindex,nofollow">
+</head><body><div class="main-wrapper" role="main"><div class="main-content">
+<noscript><div class="h2"><span id="challenge-error-text">Enable JavaScript and cookies to continue</span></div></noscript>
+</div></div>
+<script>(function(){window._cf_chl_opt={cvId: '3',cZone: "example.com",cType: 'managed'};
+var a = document.createElement('script');a.src = '/cdn-cgi/challenge-platform/h/g/orchestrate/chl_page/v1';
+document.getElementsByTagName('head')[0].appendChild(a);}());</script></body></html>`
+
+func TestPreviewBotChallenge(t *testing.T) {
+	// A 503 challenge isn't worth retrying here
+	setVar(t, &retryOnStatus, nil)
+	service := newService(t)
+	upstream := newUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+		switch r.URL.Path {
+		case "/page":
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(cloudflareChallenge))
+		case "/header":
+			w.Header().Set("cf-mitigated", "challenge")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`<html><head><title>Forbidden</title></head></html>`))
+		}
+	}))
+
+	for _, path := range []string{"/page", "/header"} {
+		preview := getPreview(t, service, upstream.URL+path)
+		if preview.ErrorCode != "bot_challenge" {
+			t.Errorf("%s: error code %q (%q), want bot_challenge", path, preview.ErrorCode, preview.Error)
+		}
+		if preview.Title != "" {
+			t.Errorf("%s: challenge previewed with title %q", path, preview.Title)
+		}
+	}
+
+	if preview := getPreview(t, service, upstream.URL+"/plain"); preview.ErrorCode == "bot_challenge" || preview.UpstreamStatus != 403 {
+		t.Errorf("plain 403: error code %q, upstream status %d", preview.ErrorCode, preview.UpstreamStatus)
+	}
+}
+
+func TestPreviewVerifiesIcons(t *testing.T) {
+	setVar(t, &verifyIcons, true)
+	setVar(t, &iconMaxBytes, 1024)
+	service := newService(t)
+	icon := pngImage(16, 16, color.Black)
+	var hits hitCounter
+	upstream := newUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.add(r.URL.Path)
+		switch r.URL.Path {
+		case "/oversized":
+			w.Write([]byte(`<html><head><title>Big icon</title><link rel="icon" href="/big.png"></head></html>`))
+		case "/html":
+			w.Write([]byte(`<html><head><title>Not an icon</title><link rel="icon" href="/icon.html"></head></html>`))
+		case "/valid":
+			w.Write([]byte(`<html><head><title>Good icon</title><link rel="icon" href="/good.png"></head></html>`))
+		case "/big.png":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(bytes.Repeat([]byte{0}, 4096))
+		case "/icon.html":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<html><body>Not found</body></html>"))
+		case "/good.png", "/favicon.ico":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(icon)
+		}
+	}))
+
+	// An oversized icon falls back to /favicon.ico
+	preview := getPreview(t, service, upstream.URL+"/oversized")
+	if preview.Favicon != upstream.URL+"/favicon.ico" || preview.Logo != preview.Favicon {
+		t.Errorf("oversized icon: favicon %q, logo %q", preview.Favicon, preview.Logo)
+	}
+
+	// So does an HTML page served at the icon URL
+	preview = getPreview(t, service, upstream.URL+"/html")
+	if preview.Favicon != upstream.URL+"/favicon.ico" {
+		t.Errorf("HTML icon: favicon %q", preview.Favicon)
+	}
+
+	// A valid icon is kept, and fetched only once
+	preview = getPreview(t, service, upstream.URL+"/valid")
+	if preview.Favicon != upstream.URL+"/good.png" {
+		t.Errorf("valid icon: favicon %q", preview.Favicon)
+	}
+	if n := hits.get("/good.png"); n != 1 {
+		t.Errorf("valid icon fetched %d times, want 1", n)
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	service := newService(t)
+	for _, tc := range []struct{ method, path, allow string }{
+		{"PUT", "/preview?url=https://example.com/", "GET, HEAD, OPTIONS"},
+		{"POST", "/previews", "GET, HEAD, OPTIONS"},
+		{"DELETE", "/proxy-image?url=https://example.com/a.png", "GET, HEAD, OPTIONS"},
+		{"GET", "/extract", "POST, OPTIONS"},
+	} {
+		req, _ := http.NewRequest(tc.method, service.URL+tc.path, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusMethodNotAllowed {
+			t.Errorf("%s %s: status %d, want 405", tc.method, tc.path, resp.StatusCode)
+		}
+		if allow := resp.Header.Get("Allow"); allow != tc.allow {
+			t.Errorf("%s %s: Allow %q, want %q", tc.method, tc.path, allow, tc.allow)
+		}
+	}
+}
+
+func TestProxyImageCollapsesConcurrentFetches(t *testing.T) {
+	service := newService(t)
+	img := pngImage(8, 8, color.White)
+	var hits hitCounter
+	upstream := newUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.add(r.URL.Path)
+		time.Sleep(200 * time.Millisecond)
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(img)
+	}))
+
+	target := service.URL + "/proxy-image?url=" + url.QueryEscape(upstream.URL+"/shared.png")
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := http.Get(target)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != 200 || !bytes.Equal(body, img) {
+				t.Errorf("status %d, %d bytes, want the %d-byte image", resp.StatusCode, len(body), len(img))
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := hits.get("/shared.png"); n != 1 {
+		t.Errorf("%d upstream fetches, want 1", n)
+	}
+}
+
+func TestPreviewJSONLD(t *testing.T) {
+	service := newService(t)
+	page := newPage(t, `<html><head><title>Launch</title>
+<meta property="og:type" content="article">
+<meta property="og:site_name" content="Rockets Weekly">
+<meta property="og:description" content="Liftoff at dawn">
+<meta property="og:image" content="/launch.jpg"></head></html>`)
+
+	// Both the format parameter and the Accept header select JSON-LD
+	for _, viaHeader := range []bool{false, true} {
+		target := service.URL + "/preview?url=" + url.QueryEscape(page.URL+"/launch")
+		if !viaHeader {
+			target += "&format=jsonld"
+		}
+		req, _ := http.NewRequest("GET", target, nil)
+		if viaHeader {
+			req.Header.Set("Accept", "application/ld+json")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var doc map[string]any
+		err = json.NewDecoder(resp.Body).Decode(&doc)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("invalid JSON-LD: %v", err)
+		}
+
+		if ct := resp.Header.Get("Content-Type"); ct != "application/ld+json" {
+			t.Errorf("Content-Type %q", ct)
+		}
+		for key, want := range map[string]any{
+			"@context":    "https://schema.org",
+			"@type":       "Article",
+			"headline":    "Launch",
+			"description": "Liftoff at dawn",
+			"image":       page.URL + "/launch.jpg",
+			"url":         page.URL + "/launch",
+		} {
+			if doc[key] != want {
+				t.Errorf("header %v: %s = %v, want %v", viaHeader, key, doc[key], want)
+			}
+		}
+		if publisher, _ := doc["publisher"].(map[string]any); publisher["@type"] != "Organization" || publisher["name"] != "Rockets Weekly" {
+			t.Errorf("publisher %v", doc["publisher"])
+		}
+	}
+}
+
+func TestPreviewVideo(t *testing.T) {
+	service := newService(t)
+	page := newPage(t, `<html><head><title>Trailer</title>
+<meta property="og:type" content="video.movie">
+<meta property="og:video" content="/media/trailer.mp4">
+<meta property="og:video:type" content="video/mp4">
+<meta property="og:video:duration" content="PT2M5S">
+<meta property="og:image" content="/media/poster.jpg">
+</head></html>`)
+
+	preview := getPreview(t, service, page.URL+"/watch")
+	if preview.Video != page.URL+"/media/trailer.mp4" {
+		t.Errorf("video %q", preview.Video)
+	}
+	if preview.VideoDuration != 125 {
+		t.Errorf("duration %d, want 125", preview.VideoDuration)
+	}
+	if preview.VideoPoster != page.URL+"/media/poster.jpg" {
+		t.Errorf("poster %q", preview.VideoPoster)
+	}
+
+	for in, want := range map[string]int{
+		"90": 90, "90.4": 90, "PT1H2M3S": 3723, "P1DT1S": 86401, "1:30": 90, "1:02:03": 3723,
+		"1m30s": 90, "": 0, "soon": 0, "-5": 0, "1:-1": 0,
+	} {
+		if got := parseVideoDuration(in); got != want {
+			t.Errorf("parseVideoDuration(%q) = %d, want %d", in, got, want)
+		}
+	}
+}
+
+func TestPreviewFallbackUserAgents(t *testing.T) {
+	setVar(t, &fallbackUserAgents, []string{"Otherbot/1.0", "facebookexternalhit/1.1", "Twitterbot/1.0"})
+	service := newService(t)
+	var mu sync.Mutex
+	var agents []string
+	upstream := newUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ua := r.Header.Get("User-Agent")
+		mu.Lock()
+		agents = append(agents, ua)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "text/html")
+		if strings.HasPrefix(ua, "facebookexternalhit") {
+			w.Write([]byte(`<html><head><meta property="og:title" content="Rich"><meta property="og:image" content="/card.png"></head></html>`))
+			return
+		}
+		w.Write([]byte(`<html><head></head><body>Enable JavaScript</body></html>`))
+	}))
+
+	preview := getPreview(t, service, upstream.URL+"/")
+	if preview.Title != "Rich" || preview.Image != upstream.URL+"/card.png" {
+		t.Errorf("title %q, image %q", preview.Title, preview.Image)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{userAgent, "Otherbot/1.0", "facebookexternalhit/1.1"}
+	if !slices.Equal(agents, want) {
+		t.Errorf("user agents tried %q, want %q", agents, want)
+	}
+	agents = nil
+	mu.Unlock()
+
+	// Attempts stop at MaxUserAgentAttempts, default user agent included
+	setConfig(t, func(c *runtimeConfig) { c.MaxUserAgentAttempts = 2 })
+	getPreview(t, service, upstream.URL+"/bounded")
+	mu.Lock()
+	if len(agents) != 2 {
+		t.Errorf("%d attempts %q, want 2", len(agents), agents)
+	}
+}
+
+func TestMetricsCountDownloadedBytes(t *testing.T) {
+	service := newService(t)
+	body := `<html><head><title>Weighed</title></head><body>` + strings.Repeat("x", 5000) + `</body></html>`
+	page := newPage(t, body)
+
+	var before, after CacheMetrics
+	getJSON(t, service.URL+"/metrics", &before)
+	getPreview(t, service, page.URL+"/")
+	getJSON(t, service.URL+"/metrics", &after)
+
+	// The scan can stop at the end of the head, before the whole page is read
+	downloaded := after.TotalBytesDownloaded - before.TotalBytesDownloaded
+	if downloaded <= 0 || downloaded > int64(len(body)) {
+		t.Errorf("downloaded %d bytes of a %d-byte page", downloaded, len(body))
+	}
+}
+
+func TestPreviewAuthorLinks(t *testing.T) {
+	service := newService(t)
+	page := newPage(t, `<html><head><title>Profile</title>
+<link rel="me" href="https://mastodon.example/@writer">
+<link rel="author me" href="/about">
+<link rel="me" href="https://mastodon.example/@writer">
+<link rel="stylesheet" href="/style.css">
+<a rel="me noopener" href="https://github.com/writer">GitHub</a>
+</head></html>`)
+
+	preview := getPreview(t, service, page.URL+"/")
+	want := []string{"https://mastodon.example/@writer", page.URL + "/about", "https://github.com/writer"}
+	if !slices.Equal(preview.AuthorLinks, want) {
+		t.Errorf("author links %q, want %q", preview.AuthorLinks, want)
+	}
+}
+
+func TestRootListsEndpoints(t *testing.T) {
+	service := newService(t)
+
+	var info struct {
+		Service   string `json:"service"`
+		Endpoints []struct {
+			endpointInfo
+			URL string `json:"url"`
+		} `json:"endpoints"`
+	}
+	resp := getJSON(t, service.URL+"/", &info)
+	if resp.StatusCode != 200 {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	var paths []string
+	for _, e := range info.Endpoints {
+		paths = append(paths, e.Path)
+		if e.URL != service.URL+e.Path || e.Methods == "" || e.Description == "" {
+			t.Errorf("incomplete entry %+v", e)
+		}
+	}
+	for _, path := range []string{"/preview", "/previews", "/proxy-image", "/health", "/metrics"} {
+		if !slices.Contains(paths, path) {
+			t.Errorf("%s not listed in %q", path, paths)
+		}
+	}
+
+	resp, err := http.Get(service.URL + "/nowhere")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 404 {
+		t.Errorf("/nowhere: status %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestPreviewCapsImageCandidates(t *testing.T) {
+	// Scan the whole page, so only the cap limits the images
+	setConfig(t, func(c *runtimeConfig) { c.ScanLimit = 1 << 20 })
+	service := newService(t)
+	var head strings.Builder
+	head.WriteString("<html><head><title>Flood</title>\n")
+	for i := range 1000 {
+		fmt.Fprintf(&head, "<meta property=\"og:image\" content=\"/img/%d.png\">\n", i)
+	}
+	head.WriteString("</head></html>")
+	page := newPage(t, head.String())
+
+	preview := getPreview(t, service, page.URL+"/")
+	if len(preview.Images) != 10 {
+		t.Fatalf("%d images stored, want the default cap of 10", len(preview.Images))
+	}
+	if preview.Images[0].URL != page.URL+"/img/0.png" || preview.Images[9].URL != page.URL+"/img/9.png" {
+		t.Errorf("kept %q .. %q, want the first ten", preview.Images[0].URL, preview.Images[9].URL)
+	}
+
+	setConfig(t, func(c *runtimeConfig) { c.MaxRepeatedFields = 3 })
+	if preview := getPreview(t, service, page.URL+"/again"); len(preview.Images) != 3 {
+		t.Errorf("%d images stored with max_repeated_fields 3", len(preview.Images))
+	}
+}
+
+func TestPreviewFullTitle(t *testing.T) {
+	service := newService(t)
+	longTitle := strings.Repeat("Very long headline ", 15) + "end"
+	longDescription := strings.Repeat("A sentence that goes on. ", 20) + "Fin."
+	page := newPage(t, `<html><head><title>`+longTitle+`</title>
+<meta name="description" content="`+longDescription+`"></head></html>`)
+	short := newPage(t, `<html><head><title>Short</title></head></html>`)
+
+	preview := getPreview(t, service, page.URL+"/")
+	if preview.Title != longTitle[:200] || preview.FullTitle != longTitle {
+		t.Errorf("title %q (%d), full title %q", preview.Title, len(preview.Title), preview.FullTitle)
+	}
+	if preview.Description != longDescription[:300] || preview.FullDescription != longDescription {
+		t.Errorf("description %d bytes, full description %q", len(preview.Description), preview.FullDescription)
+	}
+
+	// Untruncated fields aren't repeated
+	if preview := getPreview(t, service, short.URL+"/"); preview.FullTitle != "" || preview.FullDescription != "" {
+		t.Errorf("short page: full title %q, full description %q", preview.FullTitle, preview.FullDescription)
+	}
+}
+
+func TestPreviewPublishedTime(t *testing.T) {
+	service := newService(t)
+	for _, tc := range []struct{ name, head, want string }{
+		{"article meta", `<meta property="article:published_time" content="2024-03-05T10:20:30+02:00">
+<meta name="date" content="2020-01-01">`, "2024-03-05T10:20:30+02:00"},
+		{"JSON-LD", `<script type="application/ld+json">{"@type": "BlogPosting", "datePublished": "2023-11-02 08:00:00"}</script>
+<meta name="date" content="2020-01-01">`, "2023-11-02T08:00:00Z"},
+		{"meta date", `<meta name="date" content="Tue, 10 Oct 2023 12:00:00 GMT">`, "2023-10-10T12:00:00Z"},
+		{"time element", `<time class="stamp" datetime="2022/07/04">July 4th</time>`, "2022-07-04T00:00:00Z"},
+		{"unparseable first", `<meta property="article:published_time" content="last Tuesday">
+<meta name="date" content="2021-05-06">`, "2021-05-06T00:00:00Z"},
+		{"none", `<meta name="date" content="someday">`, ""},
+	} {
+		page := newPage(t, "<html><head><title>Dated</title>\n"+tc.head+"\n</head></html>")
+		if preview := getPreview(t, service, page.URL+"/"); preview.PublishedTime != tc.want {
+			t.Errorf("%s: published %q, want %q", tc.name, preview.PublishedTime, tc.want)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	service := newService(t)
+	var hits hitCounter
+	upstream := newUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.add(r.Method + " " + r.URL.Path)
+		switch r.URL.Path {
+		case "/live":
+			w.Header().Set("Content-Type", "text/html")
+		case "/no-head":
+			if r.Method == "HEAD" {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			if r.Header.Get("Range") != "bytes=0-0" {
+				t.Errorf("fallback GET without a range: %q", r.Header.Get("Range"))
+			}
+			w.Header().Set("Content-Type", "application/pdf")
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write([]byte("%"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+
+	check := func(path string) CheckResult {
+		var result CheckResult
+		getJSON(t, service.URL+"/check?url="+url.QueryEscape(upstream.URL+path), &result)
+		return result
+	}
+	if result := check("/live"); !result.OK || result.Status != 200 || result.ContentType != "text/html" {
+		t.Errorf("live: %+v", result)
+	}
+	if result := check("/missing"); result.OK || result.Status != 404 {
+		t.Errorf("missing: %+v", result)
+	}
+	if result := check("/no-head"); !result.OK || result.Status != 206 || result.ContentType != "application/pdf" {
+		t.Errorf("no HEAD support: %+v", result)
+	}
+	if n := hits.get("GET /live"); n != 0 {
+		t.Errorf("live link fetched with GET %d times", n)
+	}
+
+	// Results are cached briefly
+	check("/live")
+	if n := hits.get("HEAD /live"); n != 1 {
+		t.Errorf("live link checked %d times, want 1", n)
+	}
+}
+
+func TestPreviewCacheNamespaces(t *testing.T) {
+	service := newService(t)
+	page := newCountingPage(t)
+	target := page.URL + "/"
+
+	if preview := getPreview(t, service, target, "namespace", "mobile"); preview.Title != "Fetch 1" {
+		t.Errorf("mobile: %q", preview.Title)
+	}
+	if preview := getPreview(t, service, target, "namespace", "desktop"); preview.Title != "Fetch 2" {
+		t.Errorf("desktop shares mobile's entry: %q", preview.Title)
+	}
+	if preview := getPreview(t, service, target); preview.Title != "Fetch 3" {
+		t.Errorf("shared namespace: %q", preview.Title)
+	}
+
+	// Each namespace hits its own entry, by parameter or header
+	if preview := getPreview(t, service, target, "namespace", "mobile"); preview.Title != "Fetch 1" {
+		t.Errorf("mobile again: %q", preview.Title)
+	}
+	req, _ := http.NewRequest("GET", service.URL+"/preview?url="+url.QueryEscape(target), nil)
+	req.Header.Set("X-Cache-Namespace", "desktop")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var preview Preview
+	json.NewDecoder(resp.Body).Decode(&preview)
+	resp.Body.Close()
+	if preview.Title != "Fetch 2" {
+		t.Errorf("desktop by header: %q", preview.Title)
+	}
+
+	resp, err = http.Get(service.URL + "/preview?namespace=Not+Valid&url=" + url.QueryEscape(target))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 400 {
+		t.Errorf("invalid namespace: status %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestExtract(t *testing.T) {
+	service := newService(t)
+	// Nothing may be fetched from the page's host
+	upstream := newUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("fetched %s", r.URL)
+	}))
+
+	body, _ := json.Marshal(extractRequest{
+		URL: upstream.URL + "/posts/1",
+		HTML: `<html><head><title>Crawled</title>
+<meta property="og:description" content="From the client crawl">
+<meta property="og:image" content="../img/cover.jpg">
+<link rel="icon" href="/icon.png"></head></html>`,
+	})
+	resp, err := http.Post(service.URL+"/extract", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var preview Preview
+	err = json.NewDecoder(resp.Body).Decode(&preview)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if preview.Title != "Crawled" || preview.Description != "From the client crawl" {
+		t.Errorf("title %q, description %q", preview.Title, preview.Description)
+	}
+	if preview.Image != upstream.URL+"/img/cover.jpg" || preview.Favicon != upstream.URL+"/icon.png" {
+		t.Errorf("relative links not resolved: image %q, favicon %q", preview.Image, preview.Favicon)
+	}
+
+	for _, bad := range []string{`{"html": "<title>x</title>"}`, `not json`} {
+		resp, err := http.Post(service.URL+"/extract", "application/json", strings.NewReader(bad))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 400 {
+			t.Errorf("%s: status %d, want 400", bad, resp.StatusCode)
+		}
+	}
+
+	// Preflights allow POST on /extract only
+	for path, want := range map[string]string{"/extract": "POST, OPTIONS", "/preview": "GET, HEAD, OPTIONS"} {
+		req, _ := http.NewRequest("OPTIONS", service.URL+path, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if got := resp.Header.Get("Access-Control-Allow-Methods"); got != want {
+			t.Errorf("%s allows %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestProxyImageReferer(t *testing.T) {
+	service := newService(t)
+	img := pngImage(4, 4, color.White)
+	var mu sync.Mutex
+	referers := make(map[string]string)
+	upstream := newUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		referers[r.URL.Path] = r.Header.Get("Referer")
+		mu.Unlock()
+		// Hotlink protection: only requests referred from this site get the image
+		if !strings.HasPrefix(r.Header.Get("Referer"), "http://"+r.Host+"/") {
+			http.Error(w, "Hotlinking forbidden", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(img)
+	}))
+	proxy := func(path, referer string) int {
+		query := url.Values{"url": {upstream.URL + path}}
+		if referer != "" {
+			query.Set("referer", referer)
+		}
+		resp, err := http.Get(service.URL + "/proxy-image?" + query.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	setVar(t, &imageRefererMode, "none")
+	if status := proxy("/none.png", ""); status == 200 {
+		t.Errorf("without a referer: status %d, want an error", status)
+	}
+	if status := proxy("/page.png", upstream.URL+"/article"); status != 200 {
+		t.Errorf("with ?referer=: status %d, want 200", status)
+	}
+
+	setVar(t, &imageRefererMode, "origin")
+	if status := proxy("/origin.png", ""); status != 200 {
+		t.Errorf("origin referer: status %d, want 200", status)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for path, want := range map[string]string{"/none.png": "", "/page.png": upstream.URL + "/article", "/origin.png": upstream.URL + "/"} {
+		if referers[path] != want {
+			t.Errorf("%s: sent Referer %q, want %q", path, referers[path], want)
+		}
+	}
+}
+
+func TestMetricsUptime(t *testing.T) {
+	service := newService(t)
+
+	var first, second CacheMetrics
+	getJSON(t, service.URL+"/metrics", &first)
+	time.Sleep(10 * time.Millisecond)
+	getJSON(t, service.URL+"/metrics", &second)
+
+	if first.UptimeSeconds <= 0 {
+		t.Errorf("uptime %v, want > 0", first.UptimeSeconds)
+	}
+	if second.UptimeSeconds <= first.UptimeSeconds {
+		t.Errorf("uptime went from %v to %v", first.UptimeSeconds, second.UptimeSeconds)
+	}
+	if !first.StartedAt.Equal(second.StartedAt) || first.StartedAt.After(time.Now()) {
+		t.Errorf("started_at %v, then %v", first.StartedAt, second.StartedAt)
+	}
+}
+
+func TestPreviewRequestCacheControl(t *testing.T) {
+	service := newService(t)
+	page := newCountingPage(t)
+	get := func(cacheControl string) string {
+		req, _ := http.NewRequest("GET", service.URL+"/preview?url="+url.QueryEscape(page.URL+"/"), nil)
+		if cacheControl != "" {
+			req.Header.Set("Cache-Control", cacheControl)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var preview Preview
+		json.NewDecoder(resp.Body).Decode(&preview)
+		return preview.Title
+	}
+
+	for _, step := range []struct{ cacheControl, want string }{
+		{"", "Fetch 1"},
+		{"", "Fetch 1"},
+		// no-cache refetches and updates the entry
+		{"no-cache", "Fetch 2"},
+		{"", "Fetch 2"},
+		// no-store neither reads nor writes it
+		{"no-store", "Fetch 3"},
+		{"", "Fetch 2"},
+		{"max-age=0, no-store", "Fetch 4"},
+	} {
+		if got := get(step.cacheControl); got != step.want {
+			t.Errorf("Cache-Control %q: got %q, want %q", step.cacheControl, got, step.want)
+		}
+	}
+}
+
+// richPreview has every commonly set field filled in, like a news article
+func richPreview() Preview {
+	now := time.Now().UTC()
+	return Preview{
+		URL:             "https://news.example.com/2024/03/05/a-long-article-slug",
+		Title:           strings.Repeat("Headline words ", 10),
+		HasTitle:        true,
+		Description:     strings.Repeat("A description that runs for a while. ", 8),
+		Image:           "https://cdn.example.com/images/2024/03/05/cover-1200x630.jpg",
+		SiteName:        "Example News",
+		Favicon:         "https://news.example.com/favicon.ico",
+		Logo:            "https://news.example.com/logo.png",
+		Images:          []OGImage{{URL: "https://cdn.example.com/images/cover.jpg", Width: 1200, Height: 630, Type: "image/jpeg"}},
+		Type:            "article",
+		Locale:          "en_US",
+		PublishedTime:   "2024-03-05T10:20:30Z",
+		Feeds:           []string{"https://news.example.com/feed.xml"},
+		Domain:          "news.example.com",
+		ContentHash:     "0b904ef20017a098afd839c2a3377916",
+		CachedAt:        &now,
+		UpstreamStatus:  200,
+		ContentType:     "text/html; charset=utf-8",
+		FullDescription: strings.Repeat("A description that runs for a while. ", 12),
+	}
+}
+
+func TestPreviewCacheCompression(t *testing.T) {
+	setVar(t, &compressPreviewCache, true)
+	service := newService(t)
+	var hits hitCounter
+	upstream := newUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.add(r.URL.Path)
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<html><head><title>Packed</title>
+<meta property="og:description" content="Stored gzipped">
+<meta property="og:image" content="/cover.jpg"><meta property="og:image:width" content="1200">
+<link rel="alternate" type="application/rss+xml" href="/feed.xml"></head></html>`))
+	}))
+	target := upstream.URL + "/packed"
+
+	fetched := getPreview(t, service, target)
+	entry, ok := previewCache.Get(previewCacheKey(target, ""))
+	if !ok || entry.Compressed == nil || entry.Preview.URL != "" {
+		t.Fatalf("entry not stored compressed: %+v", entry)
+	}
+
+	cached := getPreview(t, service, target)
+	if n := hits.get("/packed"); n != 1 {
+		t.Fatalf("fetched %d times, want the second preview from cache", n)
+	}
+	fetched.Age, cached.Age = 0, 0
+	if !reflect.DeepEqual(fetched, cached) {
+		t.Errorf("round trip changed the preview:\n got %+v\nwant %+v", cached, fetched)
+	}
+
+	// And directly, for every field of a full preview
+	want := richPreview()
+	data, err := compressPreview(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := decompressPreview(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("round trip:\n got %+v\nwant %+v", got, want)
+	}
+}
+
+func BenchmarkPreviewCacheCompression(b *testing.B) {
+	preview := richPreview()
+	plain, _ := json.Marshal(preview)
+	compressed, _ := compressPreview(preview)
+
+	b.Run("compress", func(b *testing.B) {
+		b.ReportAllocs()
+		for range b.N {
+			compressPreview(preview)
+		}
+		b.ReportMetric(float64(len(compressed)), "stored-bytes")
+		b.ReportMetric(float64(len(plain)), "json-bytes")
+	})
+	b.Run("decompress", func(b *testing.B) {
+		b.ReportAllocs()
+		for range b.N {
+			decompressPreview(compressed)
+		}
+	})
+}
+
+func TestShardedPreviewCache(t *testing.T) {
+	cache, err := newShardedCache[PreviewCacheEntry](100, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setVar(t, &previewCache, cache)
+	service := newService(t)
+	page := newPage(t, `<html><head><title>Sharded</title></head></html>`)
+
+	for i := range 20 {
+		getPreview(t, service, fmt.Sprintf("%s/%d", page.URL, i))
+	}
+	used := 0
+	for _, shard := range cache.shards {
+		if shard.Len() > 0 {
+			used++
+		}
+	}
+	if used < 2 {
+		t.Errorf("20 entries landed in %d of 4 shards", used)
+	}
+
+	// /metrics reports the size summed over the shards
+	updateCacheMetrics()
+	var m CacheMetrics
+	getJSON(t, service.URL+"/metrics", &m)
+	if m.PreviewSize != 20 || cache.Len() != 20 {
+		t.Errorf("preview_cache_size %d, Len %d, want 20", m.PreviewSize, cache.Len())
+	}
+
+	if removed := cache.RemoveOldest(6); removed != 6 || cache.Len() != 14 {
+		t.Errorf("RemoveOldest(6) removed %d, leaving %d", removed, cache.Len())
+	}
+	if removed := cache.RemoveOldest(100); removed != 14 || cache.Len() != 0 {
+		t.Errorf("RemoveOldest(100) removed %d, leaving %d", removed, cache.Len())
+	}
+}
+
+func BenchmarkPreviewCacheContention(b *testing.B) {
+	keys := make([]string, 10000)
+	for i := range keys {
+		keys[i] = hashURL(fmt.Sprintf("https://example.com/%d", i))
+	}
+	for _, shards := range []int{1, 16} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			cache, _ := newShardedCache[PreviewCacheEntry](maxPreviewCacheEntries, shards)
+			b.RunParallel(func(pb *testing.PB) {
+				// A private cursor, so the goroutines contend on the cache only
+				i := rand.IntN(len(keys))
+				for pb.Next() {
+					i = (i + 1) % len(keys)
+					key := keys[i]
+					if _, ok := cache.Get(key); !ok {
+						cache.Add(key, PreviewCacheEntry{})
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestPreviewManifestIcons(t *testing.T) {
+	setVar(t, &fetchManifest, true)
+	service := newService(t)
+	upstream := newUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/app/manifest.json":
+			w.Header().Set("Content-Type", "application/manifest+json")
+			w.Write([]byte(`{"name": "PWA", "icons": [
+				{"src": "icons/48.png", "sizes": "48x48"},
+				{"src": "icons/512-maskable.png", "sizes": "512x512", "purpose": "maskable"},
+				{"src": "icons/192.png", "sizes": "192x192", "purpose": "any maskable"},
+				{"src": "icons/1024.png", "sizes": "1024x1024"}]}`))
+		case "/huge/manifest.json":
+			w.Write([]byte(`{"icons": [{"src": "/huge.png", "sizes": "192x192"}], "pad": "` + strings.Repeat("x", manifestMaxBytes) + `"}`))
+		case "/pwa":
+			w.Write([]byte(`<html><head><title>PWA</title><link rel="manifest" href="/app/manifest.json"></head></html>`))
+		case "/inline":
+			w.Write([]byte(`<html><head><title>Inline</title><link rel="icon" href="/inline.png"><link rel="manifest" href="/app/manifest.json"></head></html>`))
+		case "/huge":
+			w.Write([]byte(`<html><head><title>Huge</title><link rel="manifest" href="/huge/manifest.json"></head></html>`))
+		}
+	}))
+
+	if preview := getPreview(t, service, upstream.URL+"/pwa"); preview.Favicon != upstream.URL+"/app/icons/192.png" || preview.Logo != preview.Favicon {
+		t.Errorf("manifest icon: favicon %q, logo %q", preview.Favicon, preview.Logo)
+	}
+	// Icon links in the page win over the manifest
+	if preview := getPreview(t, service, upstream.URL+"/inline"); preview.Favicon != upstream.URL+"/inline.png" {
+		t.Errorf("inline icon: favicon %q", preview.Favicon)
+	}
+	// Oversized manifests are ignored
+	if preview := getPreview(t, service, upstream.URL+"/huge"); preview.Favicon != upstream.URL+"/favicon.ico" {
+		t.Errorf("oversized manifest: favicon %q", preview.Favicon)
+	}
+}
+
+func TestPreviewsSortSuccess(t *testing.T) {
+	setVar(t, &retryOnStatus, nil)
+	service := newService(t)
+	upstream := newUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/gone" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprintf(w, "<html><head><title>%s</title></head></html>", r.URL.Path)
+	}))
+	urls := []string{upstream.URL + "/a", "http://host:22/", upstream.URL + "/b", upstream.URL + "/gone", upstream.URL + "/c"}
+	query := url.Values{"url": urls}
+
+	var ordered []Preview
+	getJSON(t, service.URL+"/previews?"+query.Encode(), &ordered)
+	if len(ordered) != len(urls) {
+		t.Fatalf("%d results for %d URLs", len(ordered), len(urls))
+	}
+	for i, preview := range ordered {
+		if preview.URL != urls[i] {
+			t.Errorf("default order: result %d is %s, want %s", i, preview.URL, urls[i])
+		}
+	}
+
+	query.Set("sort", "success")
+	var sorted []batchPreview
+	getJSON(t, service.URL+"/previews?"+query.Encode(), &sorted)
+	var indexes []int
+	for _, result := range sorted {
+		indexes = append(indexes, result.Index)
+		if result.URL != urls[result.Index] {
+			t.Errorf("index %d maps to %s, want %s", result.Index, urls[result.Index], result.URL)
+		}
+	}
+	if want := []int{0, 2, 4, 1, 3}; !slices.Equal(indexes, want) {
+		t.Errorf("sort=success order %v, want %v", indexes, want)
+	}
+	if sorted[2].Title != "/c" || sorted[3].Error == "" {
+		t.Errorf("successes don't precede failures: %+v", sorted)
+	}
+}
+
+func TestPreviewRedirectLimits(t *testing.T) {
+	service := newService(t)
+	var hits hitCounter
+	upstream := newUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.add(r.URL.Path)
+		var length, hop int
+		_, err := fmt.Sscanf(r.URL.Path, "/chain%d/%d", &length, &hop)
+		switch {
+		case r.URL.Path == "/loop/a":
+			http.Redirect(w, r, "/loop/b", http.StatusFound)
+		case r.URL.Path == "/loop/b":
+			http.Redirect(w, r, "/loop/a", http.StatusFound)
+		case err == nil && hop < length:
+			http.Redirect(w, r, fmt.Sprintf("/chain%d/%d", length, hop+1), http.StatusFound)
+		default:
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(`<html><head><title>Arrived</title></head></html>`))
+		}
+	}))
+
+	done := make(chan Preview)
+	go func() { done <- getPreview(t, service, upstream.URL+"/loop/a") }()
+	select {
+	case preview := <-done:
+		if preview.ErrorCode != "redirect_loop" {
+			t.Errorf("loop: error code %q (%q), want redirect_loop", preview.ErrorCode, preview.Error)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("redirect loop didn't terminate")
+	}
+	if n := hits.get("/loop/a"); n != 1 {
+		t.Errorf("loop start fetched %d times, want 1", n)
+	}
+
+	// MAX_REDIRECTS hops are followed, one more is refused
+	if preview := getPreview(t, service, upstream.URL+"/chain5/0"); preview.Title != "Arrived" {
+		t.Errorf("5 redirects: title %q, error %q", preview.Title, preview.Error)
+	}
+	if preview := getPreview(t, service, upstream.URL+"/chain6/0"); preview.ErrorCode != "too_many_redirects" {
+		t.Errorf("6 redirects: error code %q (%q), want too_many_redirects", preview.ErrorCode, preview.Error)
+	}
+	setConfig(t, func(c *runtimeConfig) { c.MaxRedirects = 1 })
+	if preview := getPreview(t, service, upstream.URL+"/chain2/0"); preview.ErrorCode != "too_many_redirects" {
+		t.Errorf("2 redirects with max 1: error code %q", preview.ErrorCode)
+	}
+}
+
+func TestPreviewFeeds(t *testing.T) {
+	service := newService(t)
+	page := newPage(t, `<html><head><title>Blog</title>
+<link rel="alternate" type="application/rss+xml" title="RSS" href="/feed.xml">
+<link rel="alternate" type="application/atom+xml" title="Atom" href="https://blog.example.com/atom.xml">
+<link rel="alternate" hreflang="de" href="/de/">
+<link rel="alternate" type="application/rss+xml" href="/feed.xml">
+<link rel="stylesheet" type="text/css" href="/style.css">
+</head></html>`)
+
+	preview := getPreview(t, service, page.URL+"/blog/")
+	want := []string{page.URL + "/feed.xml", "https://blog.example.com/atom.xml"}
+	if !slices.Equal(preview.Feeds, want) {
+		t.Errorf("feeds %q, want %q", preview.Feeds, want)
+	}
+}
+
+func TestPreviewUpstreamCacheTTL(t *testing.T) {
+	setConfig(t, func(c *runtimeConfig) {
+		c.PreviewCacheTTL = time.Hour
+		c.PreviewCacheMinTTL = 30 * time.Second
+		c.PreviewCacheMaxTTL = 24 * time.Hour
+		c.PreviewCacheTTLJitter = 0
+	})
+	service := newService(t)
+	upstream := newUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/expires":
+			now := time.Now().UTC()
+			w.Header().Set("Date", now.Format(http.TimeFormat))
+			w.Header().Set("Expires", now.Add(10*time.Minute).Format(http.TimeFormat))
+		case "/none":
+		default:
+			w.Header().Set("Cache-Control", r.URL.Query().Get("cc"))
+		}
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<html><head><title>Cached</title></head></html>`))
+	}))
+
+	for _, tc := range []struct {
+		path string
+		want time.Duration
+	}{
+		{"/cc?cc=" + url.QueryEscape("public, max-age=60"), time.Minute},
+		{"/cc?cc=" + url.QueryEscape("max-age=60, s-maxage=120"), 2 * time.Minute},
+		{"/cc?cc=max-age=5", 30 * time.Second},
+		{"/cc?cc=max-age=999999999", 24 * time.Hour},
+		{"/expires", 10 * time.Minute},
+		{"/none", time.Hour},
+	} {
+		target := upstream.URL + tc.path
+		getPreview(t, service, target)
+		entry, ok := previewCache.Get(previewCacheKey(target, ""))
+		if !ok {
+			t.Errorf("%s: not cached", tc.path)
+			continue
+		}
+		if ttl := time.Until(entry.ExpiresAt); ttl > tc.want || ttl < tc.want-5*time.Second {
+			t.Errorf("%s: TTL %s, want %s", tc.path, ttl.Round(time.Second), tc.want)
+		}
+	}
+}
+
+func TestProxyImageStreamsLargeImages(t *testing.T) {
+	service := newService(t)
+	// A 1.5MB "image": too big to cache, within maxImageBytes
+	img := append(pngImage(1, 1, color.White), bytes.Repeat([]byte{0x42}, 1500*1024)...)
+	half := len(img) / 2
+	release := make(chan struct{})
+	upstream := newUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Content-Length", strconv.Itoa(len(img)))
+		w.Write(img[:half])
+		w.(http.Flusher).Flush()
+		// The rest only comes once the client has seen the first half
+		select {
+		case <-release:
+		case <-r.Context().Done():
+			return
+		}
+		w.Write(img[half:])
+	}))
+
+	imageURL := upstream.URL + "/large.png"
+	resp, err := http.Get(service.URL + "/proxy-image?url=" + url.QueryEscape(imageURL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 || resp.ContentLength != int64(len(img)) {
+		t.Fatalf("status %d, Content-Length %d", resp.StatusCode, resp.ContentLength)
+	}
+
+	first := make([]byte, half-64*1024)
+	read := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(resp.Body, first)
+		read <- err
+	}()
+	select {
+	case err := <-read:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		close(release)
+		t.Fatal("nothing streamed before the upstream finished")
+	}
+	close(release)
+
+	rest, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := append(first, rest...); !bytes.Equal(got, img) {
+		t.Errorf("streamed %d bytes that differ from the %d-byte image", len(got), len(img))
+	}
+	if _, ok := getCachedImage("img_" + hashURL(imageURL)); ok {
+		t.Error("streamed image was cached")
+	}
+}
+
+func TestProxyImageHostRestrictions(t *testing.T) {
+	service := newService(t)
+	img := pngImage(2, 2, color.White)
+	// The same server under another name, as a second image host
+	var byName string
+	upstream := newUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/page" {
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprintf(w, `<html><head><title>Page</title><meta property="og:image" content="%s/known.png"></head></html>`, byName)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(img)
+	}))
+	byName = strings.Replace(upstream.URL, "127.0.0.1", "localhost", 1)
+	proxy := func(imageURL string) int {
+		resp, err := http.Get(service.URL + "/proxy-image?url=" + url.QueryEscape(imageURL))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	setVar(t, &blockedDomains, []string{"localhost"})
+	if status := proxy(byName + "/blocked.png"); status != 403 {
+		t.Errorf("blocked domain: status %d, want 403", status)
+	}
+	if status := proxy(upstream.URL + "/allowed.png"); status != 200 {
+		t.Errorf("allowed domain: status %d, want 200", status)
+	}
+	if status := proxy("http://127.0.0.1:22/ssh.png"); status != 403 {
+		t.Errorf("disallowed port: status %d, want 403", status)
+	}
+	setVar(t, &blockedDomains, nil)
+
+	// Only hosts that served images for previewed pages are proxied
+	hosts, _ := lru.New[string, struct{}](maxImageHosts)
+	setVar(t, &imageHosts, hosts)
+	setVar(t, &proxyKnownImageHostsOnly, true)
+	if status := proxy(byName + "/known.png"); status != 403 {
+		t.Errorf("unknown host: status %d, want 403", status)
+	}
+	getPreview(t, service, upstream.URL+"/page")
+	if status := proxy(byName + "/known.png"); status != 200 {
+		t.Errorf("known host: status %d, want 200", status)
+	}
+}
+
+func TestPreviewDominantColor(t *testing.T) {
+	service := newService(t)
+	upstream := newUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/red.png", "/timed.png", "/packed.png":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(pngImage(64, 48, color.RGBA{0xe0, 0x20, 0x10, 0xff}))
+		case "/bomb.png":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(pngBomb(100000, 100000))
+		default:
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprintf(w, `<html><head><title>Card</title><meta property="og:image" content="%s.png"></head></html>`, r.URL.Path)
+		}
+	}))
+
+	if preview := getPreview(t, service, upstream.URL+"/red", "extract_color", "1"); preview.DominantColor != "#e02010" {
+		t.Errorf("solid red image: dominant color %q, want #e02010", preview.DominantColor)
+	}
+	// Without the option nothing is computed
+	if preview := getPreview(t, service, upstream.URL+"/red?plain"); preview.DominantColor != "" {
+		t.Errorf("without extract_color: %q", preview.DominantColor)
+	}
+
+	// The color is merged into the cached entry, but the first request's
+	// timing stays out of it
+	for _, path := range []string{"/timed", "/packed"} {
+		setVar(t, &compressPreviewCache, path == "/packed")
+		if preview := getPreview(t, service, upstream.URL+path, "extract_color", "1", "debug_timing", "1"); preview.Timing == nil || preview.DominantColor == "" {
+			t.Fatalf("%s: timed color request got timing %v, color %q", path, preview.Timing, preview.DominantColor)
+		}
+		if preview := getPreview(t, service, upstream.URL+path); preview.Timing != nil || preview.DominantColor != "#e02010" || preview.Title != "Card" {
+			t.Errorf("%s: cached preview has timing %v, color %q, title %q", path, preview.Timing, preview.DominantColor, preview.Title)
+		}
+	}
+
+	// Images declaring huge dimensions are refused before decoding
+	if preview := getPreview(t, service, upstream.URL+"/bomb", "extract_color", "1"); preview.DominantColor != "" || preview.Title != "Card" {
+		t.Errorf("bomb: dominant color %q, title %q", preview.DominantColor, preview.Title)
+	}
+	if _, err := dominantColor(context.Background(), upstream.URL+"/bomb.png"); err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Errorf("bomb: error %v, want too large", err)
+	}
+}
+
+func TestPolicyHeaders(t *testing.T) {
+	service := newService(t)
+	img := pngImage(2, 2, color.Black)
+	upstream := newUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(img)
+	}))
+	headersOf := func(path string) http.Header {
+		resp, err := http.Get(service.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.Header
+	}
+	paths := []string{
+		"/preview?url=" + url.QueryEscape(upstream.URL+"/"),
+		"/proxy-image?url=" + url.QueryEscape(upstream.URL+"/policy.png"),
+	}
+
+	for _, path := range paths {
+		h := headersOf(path)
+		if got := h.Get("Referrer-Policy"); got != "no-referrer" {
+			t.Errorf("%s: Referrer-Policy %q", path, got)
+		}
+		if got := h.Get("Cross-Origin-Resource-Policy"); got != "cross-origin" {
+			t.Errorf("%s: Cross-Origin-Resource-Policy %q", path, got)
+		}
+	}
+
+	setVar(t, &referrerPolicy, "strict-origin")
+	setVar(t, &crossOriginResourcePolicy, "off")
+	h := headersOf(paths[1])
+	if got := h.Get("Referrer-Policy"); got != "strict-origin" {
+		t.Errorf("configured Referrer-Policy %q", got)
+	}
+	if _, ok := h["Cross-Origin-Resource-Policy"]; ok {
+		t.Error("Cross-Origin-Resource-Policy sent while off")
+	}
+}
+
+func TestPreviewLoginRedirect(t *testing.T) {
+	service := newService(t)
+	upstream := newUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/members/report":
+			http.Redirect(w, r, "/login?next=/members/report", http.StatusFound)
+		case "/old-post":
+			http.Redirect(w, r, "/posts/new-post", http.StatusMovedPermanently)
+		default:
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprintf(w, "<html><head><title>%s</title></head></html>", r.URL.Path)
+		}
+	}))
+
+	preview := getPreview(t, service, upstream.URL+"/members/report")
+	if !preview.RedirectedToLogin || preview.ErrorCode != "requires_auth" {
+		t.Errorf("redirect to /login: redirected_to_login %v, error code %q", preview.RedirectedToLogin, preview.ErrorCode)
+	}
+	if preview.Title != "" {
+		t.Errorf("login page previewed as %q", preview.Title)
+	}
+
+	// Other redirects, and login pages asked for directly, are previewed
+	for _, path := range []string{"/old-post", "/login"} {
+		if preview := getPreview(t, service, upstream.URL+path); preview.RedirectedToLogin || preview.Error != "" {
+			t.Errorf("%s: redirected_to_login %v, error %q", path, preview.RedirectedToLogin, preview.Error)
+		}
+	}
+}
+
+func TestPreviewCacheTTLJitter(t *testing.T) {
+	setConfig(t, func(c *runtimeConfig) {
+		c.PreviewCacheTTL = time.Hour
+		c.PreviewCacheTTLJitter = 10
+	})
+	service := newService(t)
+	page := newPage(t, `<html><head><title>Warm</title></head></html>`)
+
+	// A batch warm caches entries together
+	ttls := make(map[time.Duration]bool)
+	for i := range 20 {
+		target := fmt.Sprintf("%s/%d", page.URL, i)
+		getPreview(t, service, target)
+		entry, ok := previewCache.Get(previewCacheKey(target, ""))
+		if !ok {
+			t.Fatalf("%s not cached", target)
+		}
+		ttl := time.Until(entry.ExpiresAt)
+		if ttl < 54*time.Minute-time.Second || ttl > 66*time.Minute {
+			t.Errorf("TTL %s outside 1h ±10%%", ttl)
+		}
+		ttls[ttl.Round(time.Second)] = true
+	}
+	if len(ttls) < 5 {
+		t.Errorf("20 entries share only %d distinct TTLs", len(ttls))
+	}
+
+	setConfig(t, func(c *runtimeConfig) { c.PreviewCacheTTLJitter = 0 })
+	if ttl := jitterTTL(time.Hour); ttl != time.Hour {
+		t.Errorf("no jitter: TTL %s", ttl)
+	}
+}
+
+func TestEvictUnderPressure(t *testing.T) {
+	previews, _ := newShardedCache[PreviewCacheEntry](maxPreviewCacheEntries, 4)
+	images, _ := lru.New[string, ImageCacheEntry](maxImageCacheEntries)
+	setVar(t, &previewCache, previews)
+	setVar(t, &imageCache, images)
+	setVar(t, &memoryHighWaterMB, 1)
+	service := newService(t)
+	img := pngImage(2, 2, color.White)
+	upstream := newUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, ".png") {
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(img)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<html><head><title>Filler</title></head></html>`))
+	}))
+	for i := range 30 {
+		getPreview(t, service, fmt.Sprintf("%s/%d", upstream.URL, i))
+		resp, err := http.Get(service.URL + "/proxy-image?url=" + url.QueryEscape(fmt.Sprintf("%s/%d.png", upstream.URL, i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if previews.Len() != 30 || images.Len() != 30 {
+		t.Fatalf("cached %d previews and %d images, want 30 each", previews.Len(), images.Len())
+	}
+
+	// Usage under the low-water mark already: nothing to do
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	setVar(t, &memoryLowWaterMB, int(m.Alloc/1024/1024)+1024)
+	evictUnderPressure(&m)
+	if previews.Len() != 30 || images.Len() != 30 {
+		t.Errorf("evicted down to %d previews and %d images while under the low-water mark", previews.Len(), images.Len())
+	}
+
+	// A low-water mark that can't be reached: the caches are emptied
+	setVar(t, &memoryLowWaterMB, 0)
+	evictUnderPressure(&m)
+	if previews.Len() != 0 || images.Len() != 0 {
+		t.Errorf("%d previews and %d images left under pressure", previews.Len(), images.Len())
+	}
+}
+
+func TestPreviewAlternates(t *testing.T) {
+	service := newService(t)
+	page := newPage(t, `<html><head><title>Welcome</title>
+<link rel="alternate" hreflang="en" href="/en/">
+<link rel="alternate" hreflang="fr" href="/fr/">
+<link hreflang="de-AT" rel="alternate" href="https://example.at/">
+<link rel="alternate" hreflang="x-default" href="/">
+<link rel="alternate" hreflang="fr" href="/fr-duplicate/">
+<link rel="alternate" type="application/rss+xml" href="/feed.xml">
+</head></html>`)
+
+	preview := getPreview(t, service, page.URL+"/en/")
+	want := map[string]string{
+		"en":        page.URL + "/en/",
+		"fr":        page.URL + "/fr/",
+		"de-AT":     "https://example.at/",
+		"x-default": page.URL + "/",
+	}
+	if !maps.Equal(preview.Alternates, want) {
+		t.Errorf("alternates %v, want %v", preview.Alternates, want)
+	}
+}
+
+func TestPreviewExtractOnStatus(t *testing.T) {
+	service := newService(t)
+	upstream := newUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status, _ := strconv.Atoi(strings.Trim(r.URL.Path, "/"))
+		if r.URL.Query().Has("json") {
+			w.Header().Set("Content-Type", "application/json")
+		} else {
+			w.Header().Set("Content-Type", "text/html")
+		}
+		w.WriteHeader(status)
+		fmt.Fprintf(w, `<html><head><meta property="og:title" content="Soft %d"><meta property="og:image" content="/card.png"></head></html>`, status)
+	}))
+
+	if preview := getPreview(t, service, upstream.URL+"/404"); preview.Error == "" || preview.Title != "" {
+		t.Errorf("404 by default: title %q, error %q", preview.Title, preview.Error)
+	}
+
+	setVar(t, &extractOnStatus, []int{403, 404, 410})
+	for _, status := range []int{404, 410, 403} {
+		preview := getPreview(t, service, fmt.Sprintf("%s/%d?on", upstream.URL, status))
+		if preview.Title != fmt.Sprintf("Soft %d", status) || preview.Image != upstream.URL+"/card.png" || preview.Error != "" {
+			t.Errorf("%d: title %q, image %q, error %q", status, preview.Title, preview.Image, preview.Error)
+		}
+		if preview.UpstreamStatus != status {
+			t.Errorf("%d: upstream_status %d", status, preview.UpstreamStatus)
+		}
+	}
+
+	// Only HTML is scanned
+	if preview := getPreview(t, service, upstream.URL+"/404?json"); preview.Error == "" {
+		t.Errorf("404 JSON: title %q, no error", preview.Title)
+	}
+}
+
+func TestPreviewMicrodata(t *testing.T) {
+	service := newService(t)
+	page := newPage(t, `<html><head><title>Shop</title></head>
+<body>
+<div itemscope itemtype="https://schema.org/Product">
+  <h1 itemprop="name">Trail Shoe</h1>
+  <img itemprop="image" src="/img/shoe.jpg" alt="">
+  <meta itemprop="description" content="Grippy and light">
+</div>
+</body></html>`)
+
+	preview := getPreview(t, service, page.URL+"/shoe")
+	if preview.Description != "Grippy and light" || preview.Image != page.URL+"/img/shoe.jpg" {
+		t.Errorf("description %q, image %q", preview.Description, preview.Image)
+	}
+	// The <title> outranks microdata by default
+	if preview.Title != "Shop" {
+		t.Errorf("title %q, want Shop", preview.Title)
+	}
+}
+
+func TestPreviewContactLinks(t *testing.T) {
+	setVar(t, &client.Transport, http.RoundTripper(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		t.Errorf("fetched %s", req.URL)
+		return nil, errors.New("no network")
+	})))
+	service := newService(t)
+
+	for _, tc := range []struct{ url, title, kind, domain string }{
+		{"mailto:editor@example.com", "editor@example.com", "email", "example.com"},
+		{"mailto:first%20last@example.org?subject=Hello", "first last@example.org", "email", "example.org"},
+		{"tel:+1-555-0100", "+1-555-0100", "phone", ""},
+		{"TEL:+44%2020%207946%200000", "+44 20 7946 0000", "phone", ""},
+	} {
+		preview := getPreview(t, service, tc.url)
+		if preview.Error != "" || preview.Title != tc.title || preview.Type != tc.kind || preview.Domain != tc.domain {
+			t.Errorf("%s: title %q, type %q, domain %q, error %q", tc.url, preview.Title, preview.Type, preview.Domain, preview.Error)
+		}
+	}
+}
+
+func TestListen(t *testing.T) {
+	// A TCP address, with an ephemeral port
+	ln, err := listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(newServeMux())
+	srv.Listener.Close()
+	srv.Listener = ln
+	srv.Start()
+	defer srv.Close()
+	resp, err := http.Get("http://" + ln.Addr().String() + "/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Errorf("TCP: /health status %d", resp.StatusCode)
+	}
+
+	// A Unix socket, replacing the socket file a previous run left behind
+	path := filepath.Join(t.TempDir(), "preview.sock")
+	for _, addr := range []string{"unix:" + path, path} {
+		stale, err := net.Listen("unix", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stale.(*net.UnixListener).SetUnlinkOnClose(false)
+		stale.Close()
+
+		ln, err := listen(addr)
+		if err != nil {
+			t.Fatalf("%s: %v", addr, err)
+		}
+		srv := httptest.NewUnstartedServer(newServeMux())
+		srv.Listener.Close()
+		srv.Listener = ln
+		srv.Start()
+
+		unixClient := &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", path)
+			},
+		}}
+		resp, err := unixClient.Get("http://socket/health")
+		if err != nil {
+			t.Fatalf("%s: %v", addr, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 200 {
+			t.Errorf("%s: /health status %d", addr, resp.StatusCode)
+		}
+		unixClient.CloseIdleConnections()
+		srv.Close()
+	}
+
+	// Anything else at the path, e.g. from a mistyped LISTEN_ADDR, is kept
+	file := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(file, []byte("keep me"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if ln, err := listen(file); err == nil {
+		ln.Close()
+		t.Error("listened over a regular file")
+	}
+	if data, err := os.ReadFile(file); err != nil || string(data) != "keep me" {
+		t.Errorf("regular file changed: %q, %v", data, err)
+	}
+}
+
+// writeSelfSigned writes a self-signed certificate for 127.0.0.1 and its key
+// as PEM files, returning the certificate
+func writeSelfSigned(t *testing.T, certFile, keyFile string, serial int64) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "link-preview test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(crand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	cert, _ := x509.ParseCertificate(der)
+	return cert
+}
+
+func TestServeTLS(t *testing.T) {
+	setVar(t, &tlsReloadInterval, time.Hour)
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	first := writeSelfSigned(t, certFile, keyFile, 1)
+	certs, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newTLSServer(certs)
+	go server.ServeTLS(ln, "", "")
+	defer server.Close()
+
+	// Each request on a new connection, so it sees the current certificate
+	get := func(cert *x509.Certificate, maxVersion uint16) (*http.Response, error) {
+		roots := x509.NewCertPool()
+		roots.AddCert(cert)
+		tlsClient := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: roots, MaxVersion: maxVersion},
+		}}
+		defer tlsClient.CloseIdleConnections()
+		return tlsClient.Get("https://" + ln.Addr().String() + "/health")
+	}
+
+	resp, err := get(first, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 || resp.TLS == nil || resp.TLS.PeerCertificates[0].SerialNumber.Int64() != 1 {
+		t.Errorf("status %d over %+v", resp.StatusCode, resp.TLS)
+	}
+
+	if _, err := get(first, tls.VersionTLS11); err == nil {
+		t.Error("TLS 1.1 connection accepted")
+	}
+
+	// Handshakes don't check the files again within the reload interval
+	second := writeSelfSigned(t, certFile, keyFile, 2)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	resp, err = get(first, 0)
+	if err != nil {
+		t.Fatalf("within the interval: %v", err)
+	}
+	resp.Body.Close()
+
+	// Once it passes, the renewed certificate is picked up without a restart
+	setVar(t, &tlsReloadInterval, 0)
+	resp, err = get(second, 0)
+	if err != nil {
+		t.Fatalf("after renewal: %v", err)
+	}
+	resp.Body.Close()
+	if serial := resp.TLS.PeerCertificates[0].SerialNumber.Int64(); serial != 2 {
+		t.Errorf("after renewal: served certificate %d", serial)
+	}
+}
+
+func TestMetricsFetchErrors(t *testing.T) {
+	setConfig(t, func(c *runtimeConfig) { c.RequestDeadline = 300 * time.Millisecond })
+	setVar(t, &retryOnStatus, nil)
+	service := newService(t)
+	upstream := newUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/gone":
+			http.NotFound(w, r)
+		case "/broken":
+			http.Error(w, "broken", 500)
+		case "/slow":
+			<-r.Context().Done()
+		}
+	}))
+
+	for _, tc := range []struct{ target, category string }{
+		{"http://unresolvable.invalid/", "dns"},
+		{upstream.URL + "/slow", "timeout"},
+		{upstream.URL + "/gone", "http_4xx"},
+		{upstream.URL + "/broken", "http_5xx"},
+		{"http://host/%zz", "parse"},
+		{"http://host:22/", "blocked"},
+	} {
+		var before, after CacheMetrics
+		getJSON(t, service.URL+"/metrics", &before)
+		preview := getPreview(t, service, tc.target)
+		getJSON(t, service.URL+"/metrics", &after)
+		if got := after.FetchErrors[tc.category] - before.FetchErrors[tc.category]; got != 1 {
+			t.Errorf("%s (%q): %s errors grew by %d, want 1 (%v)", tc.target, preview.Error, tc.category, got, after.FetchErrors)
+		}
+	}
+}
+
+func TestPreviewSummary(t *testing.T) {
+	service := newService(t)
+	page := newPage(t, `<html><head>
+<title>The quick brown fox jumps over the lazy dog near the riverbank today</title>
+<meta name="description" content="Notifications show a line or two, so this description keeps going well past the hundred character limit, with more words after it.">
+<meta property="og:image" content="https://cdn.example.com/fox.jpg"></head></html>`)
+
+	var summary PreviewSummary
+	getJSON(t, service.URL+"/preview?summary=1&url="+url.QueryEscape(page.URL+"/"), &summary)
+	want := PreviewSummary{
+		URL:         page.URL + "/",
+		Title:       "The quick brown fox jumps over the lazy dog near…",
+		Description: "Notifications show a line or two, so this description keeps going well past the hundred character…",
+		Image:       "https://cdn.example.com/fox.jpg",
+	}
+	if summary != want {
+		t.Errorf("summary %+v, want %+v", summary, want)
+	}
+
+	for _, tc := range []struct {
+		in   string
+		want string
+	}{
+		{"Short enough", "Short enough"},
+		{"Words, then punctuation: trimmed", "Words, then…"},
+		{strings.Repeat("x", 30), strings.Repeat("x", 19) + "…"},
+	} {
+		if got := truncateWords(tc.in, 20); got != tc.want {
+			t.Errorf("truncateWords(%q, 20) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestPreviewReadingTime(t *testing.T) {
+	service := newService(t)
+	// 1000 words of prose, which the script and markup don't add to
+	page := newPage(t, `<html><head><title>Long read</title></head><body>
+<script>var ignored = "not words to read";</script>
+<article><p>`+strings.Repeat("word ", 500)+`</p><p>`+strings.Repeat("more ", 500)+`</p></article></body></html>`)
+
+	if preview := getPreview(t, service, page.URL+"/"); preview.ReadingTimeMinutes != 0 {
+		t.Errorf("reading time %d without reading_time=1", preview.ReadingTimeMinutes)
+	}
+	if preview := getPreview(t, service, page.URL+"/", "reading_time", "1"); preview.ReadingTimeMinutes != 5 {
+		t.Errorf("reading time %d minutes for 1000 words, want 5", preview.ReadingTimeMinutes)
+	}
+}
+
+func TestRootHonorsForwardedHeaders(t *testing.T) {
+	service := newService(t)
+	previewURL := func() string {
+		t.Helper()
+		req, _ := http.NewRequest("GET", service.URL+"/", nil)
+		req.Header.Set("X-Forwarded-Proto", "https")
+		req.Header.Set("X-Forwarded-Host", "feed.example.com, internal:8080")
+		req.Header.Set("X-Forwarded-Prefix", "/api/")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var info struct {
+			Endpoints []struct {
+				endpointInfo
+				URL string `json:"url"`
+			} `json:"endpoints"`
+		}
+		json.NewDecoder(resp.Body).Decode(&info)
+		for _, e := range info.Endpoints {
+			if e.Path == "/preview" {
+				return e.URL
+			}
+		}
+		t.Fatal("/preview not listed")
+		return ""
+	}
+
+	// The test client connects from loopback, a trusted proxy by default
+	if got, want := previewURL(), "https://feed.example.com/api/preview"; got != want {
+		t.Errorf("from a trusted proxy: %s, want %s", got, want)
+	}
+
+	_, elsewhere, _ := net.ParseCIDR("192.0.2.0/24")
+	setVar(t, &trustedProxies, []*net.IPNet{elsewhere})
+	if got, want := previewURL(), service.URL+"/preview"; got != want {
+		t.Errorf("from an untrusted client: %s, want %s", got, want)
+	}
+}
+
+func TestPreviewStreamsFields(t *testing.T) {
+	service := newService(t)
+	// Each part of the head is held back until the previous field has
+	// arrived at the client, so only a progressive stream can finish
+	next := make(chan struct{})
+	upstream := newUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		for _, part := range []string{
+			"<html><head><title>Streamed</title>\n",
+			`<meta name="description" content="Arrives second">` + "\n",
+			`<meta property="og:image" content="/third.jpg">` + "\n",
+		} {
+			io.WriteString(w, part)
+			w.(http.Flusher).Flush()
+			select {
+			case <-next:
+			case <-time.After(5 * time.Second):
+				return
+			}
+		}
+		io.WriteString(w, "</head></html>\n")
+	}))
+
+	resp, err := http.Get(service.URL + "/preview?format=sse&url=" + url.QueryEscape(upstream.URL+"/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("content type %q", ct)
+	}
+
+	events := bufio.NewScanner(resp.Body)
+	readEvent := func() (string, []byte) {
+		t.Helper()
+		var event string
+		for events.Scan() {
+			line := events.Text()
+			if name, ok := strings.CutPrefix(line, "event: "); ok {
+				event = name
+			} else if data, ok := strings.CutPrefix(line, "data: "); ok {
+				return event, []byte(data)
+			}
+		}
+		t.Fatalf("stream ended: %v", events.Err())
+		return "", nil
+	}
+
+	for _, want := range []map[string]string{
+		{"title": "Streamed"},
+		{"description": "Arrives second"},
+		{"image": upstream.URL + "/third.jpg"},
+	} {
+		event, data := readEvent()
+		var field map[string]string
+		json.Unmarshal(data, &field)
+		if event != "field" || !maps.Equal(field, want) {
+			t.Fatalf("got %s %s, want field %v", event, data, want)
+		}
+		next <- struct{}{}
+	}
+
+	// Anything found with the end of the head, then the complete preview
+	for {
+		event, data := readEvent()
+		if event == "field" {
+			continue
+		}
+		var preview Preview
+		json.Unmarshal(data, &preview)
+		if event != "preview" || preview.Title != "Streamed" || preview.Description != "Arrives second" {
+			t.Errorf("got %s %s, want the complete preview", event, data)
+		}
+		break
+	}
+}
+
+func TestProxyImageSniffsGenericTypes(t *testing.T) {
+	service := newService(t)
+	img := pngImage(4, 4, color.White)
+	upstream := newUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/octet.png":
+			w.Header().Set("Content-Type", "application/octet-stream")
+		case "/untyped.png":
+			// Nil stops net/http sniffing the type itself
+			w.Header()["Content-Type"] = nil
+		case "/labeled.png":
+			w.Header().Set("Content-Type", "image/x-custom")
+		}
+		w.Write(img)
+	}))
+
+	for path, want := range map[string]string{
+		"/octet.png":   "image/png",
+		"/untyped.png": "image/png",
+		"/labeled.png": "image/x-custom",
+	} {
+		resp, err := http.Get(service.URL + "/proxy-image?url=" + url.QueryEscape(upstream.URL+path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if ct := resp.Header.Get("Content-Type"); resp.StatusCode != 200 || ct != want {
+			t.Errorf("%s: status %d, type %q, want %q", path, resp.StatusCode, ct, want)
+		}
+	}
+}
+
+func TestProxyFavicon(t *testing.T) {
+	service := newService(t)
+	var gifIcon bytes.Buffer
+	gif.Encode(&gifIcon, image.NewPaletted(image.Rect(0, 0, 16, 16), color.Palette{color.White}), nil)
+	icoIcon := []byte("\x00\x00\x01\x00 not decoded, passed through")
+	bomb := pngBomb(1<<16, 1<<16)
+
+	var hits hitCounter
+	serveIcons := func(w http.ResponseWriter, r *http.Request) {
+		hits.add(r.URL.Path)
+		switch r.URL.Path {
+		case "/icon.gif":
+			w.Header().Set("Content-Type", "image/gif")
+			w.Write(gifIcon.Bytes())
+		case "/favicon.ico":
+			w.Header().Set("Content-Type", "image/x-icon")
+			w.Write(icoIcon)
+		case "/bomb.bmp":
+			// Claims 65536x65536 pixels in a few dozen bytes
+			w.Header().Set("Content-Type", "image/bmp")
+			w.Write(bomb)
+		case "/service":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(pngImage(16, 16, color.Black))
+		default:
+			http.NotFound(w, r)
+		}
+	}
+	origin := newUpstream(t, http.HandlerFunc(serveIcons))
+	// No icons of its own, so only the favicon service is left
+	bare := newUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.add("bare" + r.URL.Path)
+		http.NotFound(w, r)
+	}))
+	setVar(t, &faviconService, origin.URL+"/service?domain={domain}")
+
+	proxy := func(iconURL string) (*http.Response, []byte) {
+		t.Helper()
+		resp, err := http.Get(service.URL + "/proxy-favicon?url=" + url.QueryEscape(iconURL))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, body
+	}
+
+	for _, tc := range []struct {
+		iconURL     string
+		contentType string
+		body        []byte
+	}{
+		{origin.URL + "/icon.gif", "image/png", nil},
+		{origin.URL + "/missing.png", "image/x-icon", icoIcon},
+		{bare.URL + "/missing.png", "image/png", pngImage(16, 16, color.Black)},
+		{origin.URL + "/bomb.bmp", "image/bmp", bomb},
+	} {
+		resp, body := proxy(tc.iconURL)
+		if resp.StatusCode != 200 || resp.Header.Get("Content-Type") != tc.contentType {
+			t.Errorf("%s: status %d, type %q, want %q", tc.iconURL, resp.StatusCode, resp.Header.Get("Content-Type"), tc.contentType)
+			continue
+		}
+		if tc.body != nil && !bytes.Equal(body, tc.body) {
+			t.Errorf("%s: unexpected body", tc.iconURL)
+		}
+		if tc.body == nil {
+			if _, err := png.Decode(bytes.NewReader(body)); err != nil {
+				t.Errorf("%s: not normalized to PNG: %v", tc.iconURL, err)
+			}
+		}
+		if cc := resp.Header.Get("Cache-Control"); cc != "public, max-age=86400" {
+			t.Errorf("%s: Cache-Control %q", tc.iconURL, cc)
+		}
+	}
+	if hits.get("bare/favicon.ico") != 1 {
+		t.Error("the origin's /favicon.ico wasn't tried before the favicon service")
+	}
+
+	// Served from the cache the second time
+	proxy(origin.URL + "/icon.gif")
+	if n := hits.get("/icon.gif"); n != 1 {
+		t.Errorf("icon fetched %d times", n)
+	}
+}
+
+func TestPreviewUnresolvableImage(t *testing.T) {
+	service := newService(t)
+	// A malformed escape can't be parsed, so it can't be resolved either
+	broken := newPage(t, `<html><head><title>Broken</title>
+<meta property="og:image" content="images/%zz.png"></head></html>`)
+	script := newPage(t, `<html><head><title>Script</title>
+<meta property="og:image" content="javascript:alert(1)"></head></html>`)
+	resolvable := newPage(t, `<html><head><title>Fine</title>
+<meta property="og:image" content="images/cover.png"></head></html>`)
+
+	if preview := getPreview(t, service, resolvable.URL+"/post/"); preview.Image != resolvable.URL+"/post/images/cover.png" {
+		t.Errorf("resolvable image %q", preview.Image)
+	}
+	for _, page := range []*httptest.Server{broken, script} {
+		if preview := getPreview(t, service, page.URL+"/"); preview.Image != "" {
+			t.Errorf("%s: image %q, want none", preview.Title, preview.Image)
+		}
+	}
+
+	setVar(t, &defaultImage, "https://cdn.example.com/default.png")
+	for _, page := range []*httptest.Server{broken, script} {
+		if preview := getPreview(t, service, page.URL+"/?default"); preview.Image != defaultImage {
+			t.Errorf("%s: image %q, want the default", preview.Title, preview.Image)
+		}
+	}
+}
+
+func TestDoUpstreamPerRequestOptions(t *testing.T) {
+	var mu sync.Mutex
+	peers := make(map[string]bool)
+	upstream := newUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		peers[r.RemoteAddr] = true
+		mu.Unlock()
+		if r.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		fmt.Fprintf(w, "%s|%s", r.Header.Get("User-Agent"), r.Header.Get("Referer"))
+	}))
+	fetch := func(path string, opts upstreamOptions) (string, error) {
+		resp, err := doUpstream(context.Background(), "GET", upstream.URL+path, opts)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ua, referer := fmt.Sprintf("agent-%d", i), fmt.Sprintf("https://ref.example/%d", i)
+			path := "/"
+			if i%5 == 0 {
+				// A short timeout on some requests doesn't cut the others short
+				path = "/slow"
+				if _, err := fetch(path, upstreamOptions{UserAgent: ua, Timeout: 50 * time.Millisecond}); err == nil {
+					t.Errorf("request %d outlived its timeout", i)
+				}
+				return
+			}
+			got, err := fetch(path, upstreamOptions{UserAgent: ua, Referer: referer})
+			if want := ua + "|" + referer; err != nil || got != want {
+				t.Errorf("request %d saw %q (%v), want %q", i, got, err, want)
+			}
+		}()
+	}
+	wg.Wait()
+
+	got, err := fetch("/", upstreamOptions{})
+	if want := userAgent + "|"; err != nil || got != want {
+		t.Errorf("default request saw %q (%v), want %q", got, err, want)
+	}
+
+	// Sequential requests with different settings share one pooled connection
+	client.CloseIdleConnections()
+	mu.Lock()
+	clear(peers)
+	mu.Unlock()
+	for i := range 5 {
+		fetch("/", upstreamOptions{UserAgent: fmt.Sprintf("agent-%d", i)})
+	}
+	if len(peers) != 1 {
+		t.Errorf("5 sequential requests used %d connections", len(peers))
+	}
+}
+
+func TestProxyImageVariantCap(t *testing.T) {
+	setVar(t, &maxImageVariants, 3)
+	service := newService(t)
+	bomb := pngBomb(1<<16, 1<<16)
+	upstream := newUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		if r.URL.Path == "/bomb.png" {
+			w.Write(bomb)
+			return
+		}
+		w.Write(pngImage(64, 64, color.White))
+	}))
+	imageURL := upstream.URL + "/photo.png"
+	resize := func(imageURL string, width int) (*http.Response, []byte) {
+		t.Helper()
+		resp, err := http.Get(fmt.Sprintf("%s/proxy-image?w=%d&url=%s", service.URL, width, url.QueryEscape(imageURL)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, body
+	}
+	cachedWidths := func() []int {
+		var widths []int
+		for width := 10; width <= 60; width += 10 {
+			if _, ok := getCachedImage(fmt.Sprintf("img_%s_w%d", hashURL(imageURL), width)); ok {
+				widths = append(widths, width)
+			}
+		}
+		return widths
+	}
+
+	for width := 10; width <= 50; width += 10 {
+		resp, body := resize(imageURL, width)
+		img, err := png.Decode(bytes.NewReader(body))
+		if resp.StatusCode != 200 || err != nil || img.Bounds().Dx() != width {
+			t.Fatalf("w=%d: status %d, %v", width, resp.StatusCode, err)
+		}
+	}
+	if got := cachedWidths(); !slices.Equal(got, []int{30, 40, 50}) {
+		t.Errorf("cached widths %v, want the 3 most recent", got)
+	}
+
+	// Serving a variant makes it the most recently used
+	resize(imageURL, 30)
+	resize(imageURL, 60)
+	if got := cachedWidths(); !slices.Equal(got, []int{30, 50, 60}) {
+		t.Errorf("cached widths %v, want [30 50 60]", got)
+	}
+
+	// A decompression bomb isn't decoded; it is passed through unscaled
+	resp, body := resize(upstream.URL+"/bomb.png", 10)
+	if resp.StatusCode != 200 || !bytes.Equal(body, bomb) {
+		t.Errorf("bomb: status %d, %d bytes", resp.StatusCode, len(body))
+	}
+}
+
+func TestPreviewSafeBrowsing(t *testing.T) {
+	service := newService(t)
+	safePage := newPage(t, `<html><head><title>Fine</title></head></html>`)
+	badPage := newPage(t, `<html><head><title>Free prizes</title></head></html>`)
+	badURL := badPage.URL + "/prize"
+
+	var lookups atomic.Int32
+	mock := newUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lookups.Add(1)
+		var req struct {
+			ThreatInfo struct {
+				ThreatEntries []struct {
+					URL string `json:"url"`
+				} `json:"threatEntries"`
+			} `json:"threatInfo"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if r.Method != "POST" || r.URL.Query().Get("key") != "test-key" {
+			http.Error(w, "bad request", 400)
+			return
+		}
+		var matches []map[string]any
+		for _, e := range req.ThreatInfo.ThreatEntries {
+			if e.URL == badURL {
+				matches = append(matches, map[string]any{"threatType": "SOCIAL_ENGINEERING", "threat": map[string]string{"url": e.URL}})
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]any{"matches": matches})
+	}))
+	setVar(t, &safeBrowsingURL, mock.URL+"/v4/threatMatches:find")
+
+	// Unconfigured, nothing is looked up
+	if preview := getPreview(t, service, safePage.URL+"/unchecked"); preview.Unsafe || lookups.Load() != 0 {
+		t.Errorf("without a key: unsafe %v after %d lookups", preview.Unsafe, lookups.Load())
+	}
+
+	setVar(t, &safeBrowsingKey, "test-key")
+	if preview := getPreview(t, service, safePage.URL+"/"); preview.Unsafe || preview.ThreatType != "" {
+		t.Errorf("safe page flagged: %+v", preview)
+	}
+	preview := getPreview(t, service, badURL)
+	if !preview.Unsafe || preview.ThreatType != "SOCIAL_ENGINEERING" {
+		t.Errorf("listed page: unsafe %v, threat %q", preview.Unsafe, preview.ThreatType)
+	}
+
+	// Verdicts are cached
+	before := lookups.Load()
+	if threat := safeBrowsingThreat(context.Background(), badURL, safePage.URL+"/"); threat != "SOCIAL_ENGINEERING" || lookups.Load() != before {
+		t.Errorf("cached verdict %q after %d more lookups", threat, lookups.Load()-before)
+	}
+
+	// A failed lookup is logged without the API key from the request URL
+	setVar(t, &debugMode, true)
+	var logs bytes.Buffer
+	prevOutput := log.Writer()
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(prevOutput) })
+	setVar(t, &safeBrowsingURL, "http://unresolvable.invalid/v4/threatMatches:find")
+	if threat := safeBrowsingThreat(context.Background(), safePage.URL+"/uncached"); threat != "" {
+		t.Errorf("failed lookup reported %q", threat)
+	}
+	if !strings.Contains(logs.String(), "Safe Browsing lookup") || strings.Contains(logs.String(), "test-key") {
+		t.Errorf("log %q", logs.String())
+	}
+}
+
+func TestMetricsCacheSizesWithoutMemoryRead(t *testing.T) {
+	service := newService(t)
+	page := newPage(t, `<html><head><title>Counted</title></head></html>`)
+
+	updateCacheMetrics()
+	var before, stale, after CacheMetrics
+	getJSON(t, service.URL+"/metrics", &before)
+	getPreview(t, service, page.URL+"/")
+
+	// Scrapes report the last reading rather than locking the caches
+	getJSON(t, service.URL+"/metrics", &stale)
+	if stale.PreviewSize != before.PreviewSize {
+		t.Errorf("preview size %d before the metrics update, want %d", stale.PreviewSize, before.PreviewSize)
+	}
+
+	// A memory reading the cache size update must leave alone
+	metricsMu.Lock()
+	prevMemory := metrics.MemoryUsageMB
+	metrics.MemoryUsageMB = 12345
+	metricsMu.Unlock()
+	t.Cleanup(func() {
+		metricsMu.Lock()
+		metrics.MemoryUsageMB = prevMemory
+		metricsMu.Unlock()
+	})
+
+	updateCacheMetrics()
+	getJSON(t, service.URL+"/metrics", &after)
+	if after.PreviewSize != previewCache.Len() || after.PreviewSize != before.PreviewSize+1 {
+		t.Errorf("preview size %d after the update, want %d", after.PreviewSize, before.PreviewSize+1)
+	}
+	if after.MemoryUsageMB != 12345 {
+		t.Errorf("memory reading changed to %d by a cache size update", after.MemoryUsageMB)
+	}
+}
+
+func TestPreviewMetaFormat(t *testing.T) {
+	service := newService(t)
+	page := newPage(t, `<html><head>
+<title>Tags &amp; &quot;quotes&quot; &lt;b&gt;</title>
+<meta property="og:description" content="Injected &quot;&gt;&lt;script&gt;alert(1)&lt;/script&gt;">
+<meta property="og:type" content="article">
+<meta property="og:image" content="/cover.png">
+<meta property="og:locale" content="en_GB"></head></html>`)
+
+	resp, err := http.Get(service.URL + "/preview?format=meta&url=" + url.QueryEscape(page.URL+"/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if ct := resp.Header.Get("Content-Type"); ct != "text/html; charset=utf-8" {
+		t.Errorf("content type %q", ct)
+	}
+
+	metaRe := regexp.MustCompile(`^<meta property="((?:og|article):[a-z_:]+)" content="([^"<>]*)">$`)
+	got := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(string(body)), "\n") {
+		m := metaRe.FindStringSubmatch(line)
+		if m == nil {
+			t.Fatalf("malformed meta element %q", line)
+		}
+		got[m[1]] = html.UnescapeString(m[2])
+	}
+	want := map[string]string{
+		"og:url":         page.URL + "/",
+		"og:title":       `Tags & "quotes" <b>`,
+		"og:description": `Injected "><script>alert(1)</script>`,
+		"og:site_name":   strings.TrimPrefix(page.URL, "http://"),
+		"og:type":        "article",
+		"og:image":       page.URL + "/cover.png",
+		"og:locale":      "en_GB",
+	}
+	if !maps.Equal(got, want) {
+		t.Errorf("meta tags %v, want %v", got, want)
+	}
+}
+
+func TestPreviewTTLParameter(t *testing.T) {
+	setConfig(t, func(c *runtimeConfig) {
+		c.PreviewCacheTTL = time.Hour
+		c.PreviewCacheMinTTL = time.Second
+		c.PreviewCacheMaxTTL = 24 * time.Hour
+		c.PreviewCacheTTLJitter = 0
+	})
+	service := newService(t)
+	volatile := newCountingPage(t).URL + "/score"
+	stable := newCountingPage(t).URL + "/archive"
+
+	resp, err := http.Get(service.URL + "/preview?ttl=1&url=" + url.QueryEscape(volatile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if cc := resp.Header.Get("Cache-Control"); cc != "public, max-age=1" {
+		t.Errorf("Cache-Control %q", cc)
+	}
+	getPreview(t, service, stable)
+	if title := getPreview(t, service, volatile, "ttl", "1").Title; title != "Fetch 1" {
+		t.Errorf("within the ttl: %q", title)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	if title := getPreview(t, service, volatile, "ttl", "1").Title; title != "Fetch 2" {
+		t.Errorf("after the 1s ttl: %q, want a refetch", title)
+	}
+	if title := getPreview(t, service, stable).Title; title != "Fetch 1" {
+		t.Errorf("default ttl entry: %q, want it still cached", title)
+	}
+
+	// The ttl is bounded by the server's maximum, and must be positive
+	getPreview(t, service, stable+"?long", "ttl", "999999999")
+	entry, _ := previewCache.Get(previewCacheKey(stable+"?long", ""))
+	if ttl := time.Until(entry.ExpiresAt); ttl > 24*time.Hour {
+		t.Errorf("ttl of %s beyond the maximum", ttl)
+	}
+	resp, err = http.Get(service.URL + "/preview?ttl=-5&url=" + url.QueryEscape(stable))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 400 {
+		t.Errorf("negative ttl: status %d", resp.StatusCode)
+	}
+}
+
+func TestPreviewScanTruncated(t *testing.T) {
+	setConfig(t, func(c *runtimeConfig) { c.ScanLimit = 2048 })
+	service := newService(t)
+	shortBody := `<html><head><title>Short</title><meta property="og:image" content="/short.png"></head></html>`
+	short := newPage(t, shortBody)
+	// Inline styles push the image past the scan limit
+	deep := newPage(t, `<html><head><title>Deep</title>
+`+strings.Repeat("<style>.rule { color: red; }</style>\n", 200)+`<meta property="og:image" content="/deep.png"></head></html>`)
+
+	preview := getPreview(t, service, short.URL+"/", "debug", "1")
+	if preview.Debug == nil || preview.Debug.ScanTruncated || preview.Debug.BytesScanned != len(shortBody) {
+		t.Errorf("short page: debug %+v, want %d bytes scanned untruncated", preview.Debug, len(shortBody))
+	}
+
+	preview = getPreview(t, service, deep.URL+"/", "debug", "1")
+	if preview.Debug == nil || !preview.Debug.ScanTruncated {
+		t.Fatalf("deep page: debug %+v, want scan_truncated", preview.Debug)
+	}
+	if n := preview.Debug.BytesScanned; n < 2048 || n > 4096 {
+		t.Errorf("deep page: %d bytes scanned with a 2048-byte limit", n)
+	}
+	if preview.Image != "" {
+		t.Errorf("deep page: image %q found past the limit", preview.Image)
+	}
+
+	if preview := getPreview(t, service, deep.URL+"/"); preview.Debug != nil {
+		t.Errorf("debug info without debug=1: %+v", preview.Debug)
+	}
+}
+
+func TestPreviewLocale(t *testing.T) {
+	service := newService(t)
+	page := newPage(t, `<html><head><title>Colour</title>
+<meta property="og:locale:alternate" content="fr_FR">
+<meta property="og:locale" content="en_GB">
+<meta property="og:determiner" content="the">
+<meta property="og:locale:alternate" content="de_DE">
+<meta property="og:locale:alternate" content="fr_FR">
+</head></html>`)
+	bare := newPage(t, `<html><head><title>No locale</title></head></html>`)
+
+	preview := getPreview(t, service, page.URL+"/")
+	if preview.Locale != "en_GB" || preview.Determiner != "the" {
+		t.Errorf("locale %q, determiner %q", preview.Locale, preview.Determiner)
+	}
+	if want := []string{"fr_FR", "de_DE"}; !slices.Equal(preview.LocaleAlternates, want) {
+		t.Errorf("locale alternates %q, want %q", preview.LocaleAlternates, want)
+	}
+
+	preview = getPreview(t, service, bare.URL+"/")
+	if preview.Locale != "" || preview.Determiner != "" || preview.LocaleAlternates != nil {
+		t.Errorf("page without locale tags: %q %q %q", preview.Locale, preview.Determiner, preview.LocaleAlternates)
+	}
+}
+
+func TestAdminConfig(t *testing.T) {
+	// Restores whatever the test POSTs
+	setConfig(t, func(c *runtimeConfig) { c.RequestDeadline = 10 * time.Second })
+	service := newService(t)
+	slow := newUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(3 * time.Second):
+		}
+	}))
+	admin := func(method, token, body string) (int, map[string]any) {
+		t.Helper()
+		req, _ := http.NewRequest(method, service.URL+"/admin/config", strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var values map[string]any
+		json.NewDecoder(resp.Body).Decode(&values)
+		return resp.StatusCode, values
+	}
+
+	if status, _ := admin("GET", "", ""); status != 404 {
+		t.Errorf("without ADMIN_TOKEN: status %d", status)
+	}
+	setVar(t, &adminToken, "secret")
+	if status, _ := admin("GET", "wrong", ""); status != 401 {
+		t.Errorf("wrong token: status %d", status)
+	}
+	status, values := admin("GET", "secret", "")
+	if status != 200 || values["request_deadline"] != "10s" {
+		t.Fatalf("status %d, values %v", status, values)
+	}
+
+	// One bad setting rejects the whole update
+	if status, _ := admin("POST", "secret", `{"request_deadline": "200ms", "scan_limit": 10}`); status != 400 {
+		t.Errorf("out of range update: status %d", status)
+	}
+	if status, _ := admin("POST", "secret", `{"cache_size": 1}`); status != 400 {
+		t.Errorf("unknown setting: status %d", status)
+	}
+	if d := cfg().RequestDeadline; d != 10*time.Second {
+		t.Fatalf("rejected update changed the deadline to %s", d)
+	}
+
+	status, values = admin("POST", "secret", `{"request_deadline": "200ms"}`)
+	if status != 200 || values["request_deadline"] != "200ms" {
+		t.Fatalf("update: status %d, values %v", status, values)
+	}
+	start := time.Now()
+	preview := getPreview(t, service, slow.URL+"/")
+	if elapsed := time.Since(start); preview.ErrorCode != "timeout" || elapsed > 2*time.Second {
+		t.Errorf("after lowering the deadline: %q in %s", preview.ErrorCode, elapsed)
+	}
+}
+
+func TestProxyImageValidators(t *testing.T) {
+	service := newService(t)
+	img := pngImage(8, 8, color.Black)
+	lastModified := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC).Format(http.TimeFormat)
+	upstream := newUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Last-Modified", lastModified)
+		w.Write(img)
+	}))
+	proxy := func(ifNoneMatch string) (*http.Response, []byte) {
+		t.Helper()
+		req, _ := http.NewRequest("GET", service.URL+"/proxy-image?url="+url.QueryEscape(upstream.URL+"/photo.png"), nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, body
+	}
+
+	resp, body := proxy("")
+	etag := resp.Header.Get("ETag")
+	if resp.StatusCode != 200 || !bytes.Equal(body, img) || etag == "" {
+		t.Fatalf("status %d, ETag %q", resp.StatusCode, etag)
+	}
+	if lm := resp.Header.Get("Last-Modified"); lm != lastModified {
+		t.Errorf("Last-Modified %q, want the upstream's %q", lm, lastModified)
+	}
+
+	for _, tc := range []struct {
+		ifNoneMatch string
+		status      int
+	}{
+		{etag, 304},
+		{`"other", W/` + etag, 304},
+		{"*", 304},
+		{`"other"`, 200},
+	} {
+		resp, body := proxy(tc.ifNoneMatch)
+		if resp.StatusCode != tc.status {
+			t.Errorf("If-None-Match %s: status %d, want %d", tc.ifNoneMatch, resp.StatusCode, tc.status)
+		}
+		if tc.status == 304 && (len(body) != 0 || resp.Header.Get("ETag") != etag) {
+			t.Errorf("If-None-Match %s: %d-byte body, ETag %q", tc.ifNoneMatch, len(body), resp.Header.Get("ETag"))
+		}
+	}
+}
+
+func TestPreviewStripsSiteNameFromTitle(t *testing.T) {
+	setVar(t, &stripTitleSiteName, true)
+	service := newService(t)
+	for _, tc := range []struct{ title, siteName, want string }{
+		{"Release notes | The Changelog", "The Changelog", "Release notes"},
+		{"Release notes - the changelog", "The Changelog", "Release notes"},
+		{"Release notes — The Changelog", "The Changelog", "Release notes"},
+		{"Pipes | and dashes - The Changelog", "The Changelog", "Pipes | and dashes"},
+		{"Release notes | Another Site", "The Changelog", "Release notes | Another Site"},
+		{"The Changelog", "The Changelog", "The Changelog"},
+		{"Release notes | The Changelog", "", "Release notes | The Changelog"},
+	} {
+		head := `<title>` + tc.title + `</title>`
+		if tc.siteName != "" {
+			head += `<meta property="og:site_name" content="` + tc.siteName + `">`
+		}
+		page := newPage(t, `<html><head>`+head+`</head></html>`)
+		preview := getPreview(t, service, page.URL+"/")
+		if preview.Title != tc.want {
+			t.Errorf("%q with site name %q: title %q, want %q", tc.title, tc.siteName, preview.Title, tc.want)
+		}
+		if tc.want != tc.title && preview.FullTitle != tc.title {
+			t.Errorf("%q: full title %q, want the original", tc.title, preview.FullTitle)
+		}
+	}
+
+	setVar(t, &stripTitleSiteName, false)
+	page := newPage(t, `<html><head><title>Kept | Site</title><meta property="og:site_name" content="Site"></head></html>`)
+	if preview := getPreview(t, service, page.URL+"/"); preview.Title != "Kept | Site" {
+		t.Errorf("stripped with STRIP_TITLE_SITE_NAME unset: %q", preview.Title)
+	}
+}
+
+func TestPreviewExpandsShorteners(t *testing.T) {
+	setConfig(t, func(c *runtimeConfig) { c.MaxRedirects = 0 })
+	setVar(t, &sameSiteRedirects, true)
+	service := newService(t)
+	destination := newUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/moved" {
+			http.Redirect(w, r, "/article", http.StatusMovedPermanently)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		io.WriteString(w, `<html><head><title>Destination</title></head></html>`)
+	}))
+	// The destination by name, so the shortener is the only 127.0.0.1 host
+	_, port, _ := net.SplitHostPort(destination.Listener.Addr().String())
+	target := "http://localhost:" + port
+	shortener := newUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/abc":
+			http.Redirect(w, r, target+"/article", http.StatusMovedPermanently)
+		case "/nested":
+			http.Redirect(w, r, "/abc", http.StatusFound)
+		case "/moved":
+			http.Redirect(w, r, target+"/moved", http.StatusMovedPermanently)
+		}
+	}))
+
+	setVar(t, &shortenerDomains, nil)
+	if preview := getPreview(t, service, shortener.URL+"/abc"); preview.ErrorCode != "too_many_redirects" {
+		t.Errorf("unlisted shortener with no redirects allowed: %q", preview.ErrorCode)
+	}
+
+	setVar(t, &shortenerDomains, []string{"127.0.0.1"})
+	for _, path := range []string{"/abc", "/nested"} {
+		preview := getPreview(t, service, shortener.URL+path)
+		if preview.Title != "Destination" || preview.UpstreamFinalURL != target+"/article" {
+			t.Errorf("%s: title %q (%q), final URL %q", path, preview.Title, preview.Error, preview.UpstreamFinalURL)
+		}
+	}
+
+	// The destination's own redirects still count
+	if preview := getPreview(t, service, shortener.URL+"/moved"); preview.ErrorCode != "too_many_redirects" {
+		t.Errorf("redirect after the shortener: %q", preview.ErrorCode)
+	}
+}
+
+func TestPreviewPlayerAspectRatio(t *testing.T) {
+	service := newService(t)
+	for _, tc := range []struct{ name, head, want string }{
+		{"twitter player", `<meta name="twitter:player:width" content="1280"><meta name="twitter:player:height" content="720">
+<meta property="og:video:width" content="400"><meta property="og:video:height" content="400">`, "16:9"},
+		{"og:video", `<meta property="og:video:width" content="640"><meta property="og:video:height" content="480">`, "4:3"},
+		{"incomplete player", `<meta name="twitter:player:width" content="1280">
+<meta property="og:video:width" content="1080"><meta property="og:video:height" content="1920">`, "9:16"},
+		{"invalid", `<meta property="og:video:width" content="wide"><meta property="og:video:height" content="480">`, ""},
+		{"none", ``, ""},
+	} {
+		page := newPage(t, `<html><head><title>Player</title>`+tc.head+`</head></html>`)
+		if got := getPreview(t, service, page.URL+"/").PlayerAspectRatio; got != tc.want {
+			t.Errorf("%s: aspect ratio %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestPreviewDebugCacheKey(t *testing.T) {
+	service := newService(t)
+	target := newPage(t, `<html><head><title>Keyed</title></head></html>`).URL + "/post?id=1"
+	md5Hex := func(s string) string {
+		h := md5.Sum([]byte(s))
+		return hex.EncodeToString(h[:])
+	}
+
+	for _, tc := range []struct{ namespace, want string }{
+		{"", md5Hex(target)},
+		{"feed_a", md5Hex("feed_a:" + target)},
+	} {
+		// The key is reported for fresh and cached previews alike
+		for range 2 {
+			preview := getPreview(t, service, target, "debug", "1", "namespace", tc.namespace)
+			if preview.Debug == nil || preview.Debug.CacheKey != tc.want {
+				t.Fatalf("namespace %q: debug %+v, want cache key %s", tc.namespace, preview.Debug, tc.want)
+			}
+			if _, ok := previewCache.Get(preview.Debug.CacheKey); !ok {
+				t.Errorf("namespace %q: nothing cached under %s", tc.namespace, preview.Debug.CacheKey)
+			}
+		}
+	}
+
+	if preview := getPreview(t, service, target); preview.Debug != nil {
+		t.Errorf("cache key without debug=1: %+v", preview.Debug)
+	}
+}
+
+func TestProxyImageRange(t *testing.T) {
+	service := newService(t)
+	img := pngImage(64, 64, color.White)
+	var ranges []string
+	var mu sync.Mutex
+	upstream := newUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		mu.Unlock()
+		w.Header().Set("Content-Type", "image/png")
+		if r.URL.Path == "/whole.png" {
+			// Ignores Range, as servers may
+			w.Write(img)
+			return
+		}
+		http.ServeContent(w, r, "photo.png", time.Time{}, bytes.NewReader(img))
+	}))
+	get := func(path, rangeHeader string) (*http.Response, []byte) {
+		t.Helper()
+		req, _ := http.NewRequest("GET", service.URL+"/proxy-image?url="+url.QueryEscape(upstream.URL+path), nil)
+		req.Header.Set("Range", rangeHeader)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, body
+	}
+
+	resp, body := get("/photo.png", "bytes=0-99")
+	if resp.StatusCode != http.StatusPartialContent || !bytes.Equal(body, img[:100]) {
+		t.Fatalf("status %d, %d bytes", resp.StatusCode, len(body))
+	}
+	if cr := resp.Header.Get("Content-Range"); cr != fmt.Sprintf("bytes 0-99/%d", len(img)) {
+		t.Errorf("Content-Range %q", cr)
+	}
+	if resp.Header.Get("Accept-Ranges") != "bytes" || resp.Header.Get("Content-Type") != "image/png" {
+		t.Errorf("headers %v", resp.Header)
+	}
+	if !slices.Equal(ranges, []string{"bytes=0-99"}) {
+		t.Errorf("upstream saw ranges %q", ranges)
+	}
+	if _, ok := getCachedImage("img_" + hashURL(upstream.URL+"/photo.png")); ok {
+		t.Error("partial content cached")
+	}
+
+	if resp, _ := get("/photo.png", fmt.Sprintf("bytes=%d-", len(img)+10)); resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("unsatisfiable range: status %d", resp.StatusCode)
+	}
+
+	// An upstream that ignores the range gets the whole image served
+	resp, body = get("/whole.png", "bytes=0-99")
+	if resp.StatusCode != 200 || !bytes.Equal(body, img) {
+		t.Errorf("range ignored upstream: status %d, %d bytes", resp.StatusCode, len(body))
+	}
+}
+
+func TestPreviewSelfRedirect(t *testing.T) {
+	// Plenty of hops, so only loop detection stops the chain early
+	setConfig(t, func(c *runtimeConfig) { c.MaxRedirects = 50 })
+	service := newService(t)
+	var hits hitCounter
+	upstream := newUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.add(r.URL.RequestURI())
+		switch r.URL.Path {
+		case "/self":
+			http.Redirect(w, r, "http://"+r.Host+"/self", http.StatusMovedPermanently)
+		case "/slash":
+			// Back to itself after a detour through a trailing slash
+			http.Redirect(w, r, "/slash/", http.StatusMovedPermanently)
+		case "/slash/":
+			http.Redirect(w, r, "/slash", http.StatusMovedPermanently)
+		case "/retry":
+			// A new query each time is a new URL, not a loop
+			n, _ := strconv.Atoi(r.URL.Query().Get("n"))
+			if n < 3 {
+				http.Redirect(w, r, fmt.Sprintf("/retry?n=%d", n+1), http.StatusFound)
+				return
+			}
+			w.Header().Set("Content-Type", "text/html")
+			io.WriteString(w, `<html><head><title>Settled</title></head></html>`)
+		}
+	}))
+
+	for _, path := range []string{"/self", "/slash"} {
+		preview := getPreview(t, service, upstream.URL+path)
+		if preview.ErrorCode != "redirect_loop" {
+			t.Errorf("%s: error code %q (%q), want redirect_loop", path, preview.ErrorCode, preview.Error)
+		}
+		if n := hits.get(path); n != 1 {
+			t.Errorf("%s fetched %d times, want 1", path, n)
+		}
+	}
+
+	if preview := getPreview(t, service, upstream.URL+"/retry"); preview.Title != "Settled" {
+		t.Errorf("changing query: title %q, error %q", preview.Title, preview.Error)
+	}
+}
+
+func TestPreviewMetadataSources(t *testing.T) {
+	service := newService(t)
+	// Every source has its own title, description and image
+	page := newPage(t, `<html><head>
+<title>Title tag</title>
+<meta property="og:title" content="OG title">
+<meta property="og:image" content="/og.png">
+<meta name="twitter:title" content="Twitter title">
+<meta name="twitter:description" content="Twitter description">
+<meta name="twitter:image" content="/twitter.png">
+<meta name="description" content="Meta description">
+<meta property="og:site_name" content="Sources">
+<link rel="icon" href="/icon.png">
+<script type="application/ld+json">{"@type": "Article", "headline": "JSON-LD headline", "description": "JSON-LD description", "image": "/jsonld.png"}</script>
+</head>
+<body><div itemscope itemtype="https://schema.org/Product">
+<h1 itemprop="name">Microdata name</h1>
+<meta itemprop="description" content="Microdata description">
+<img itemprop="image" src="/microdata.png">
+</div></body></html>`)
+
+	for _, tc := range []struct {
+		sources                   []string
+		title, description, image string
+	}{
+		{[]string{"og", "twitter", "meta-name", "title-tag", "jsonld", "microdata"}, "OG title", "Twitter description", "/og.png"},
+		// og has no description, and no fallback is consulted
+		{[]string{"og"}, "OG title", "", "/og.png"},
+		{[]string{"title-tag", "meta-name"}, "Title tag", "Meta description", ""},
+		{[]string{"jsonld", "og"}, "JSON-LD headline", "JSON-LD description", "/jsonld.png"},
+		// Microdata in the body outranks the tags found in the head
+		{[]string{"microdata", "og", "twitter"}, "Microdata name", "Microdata description", "/microdata.png"},
+	} {
+		setVar(t, &metadataSources, tc.sources)
+		// A path per order, so earlier previews aren't served from the cache
+		preview := getPreview(t, service, page.URL+"/"+strings.Join(tc.sources, "/"))
+		image := ""
+		if tc.image != "" {
+			image = page.URL + tc.image
+		}
+		if preview.Title != tc.title || preview.Description != tc.description || preview.Image != image {
+			t.Errorf("sources %q: %q, %q, %q; want %q, %q, %q", tc.sources,
+				preview.Title, preview.Description, preview.Image, tc.title, tc.description, image)
+		}
+	}
+}
+
+func TestPreviewFreshness(t *testing.T) {
+	service := newService(t)
+	page := newCountingPage(t)
+
+	before := time.Now()
+	fresh := getPreview(t, service, page.URL+"/")
+	if fresh.CachedAt == nil || fresh.Age != 0 || fresh.CachedAt.Before(before.Add(-time.Second)) || fresh.CachedAt.After(time.Now()) {
+		t.Fatalf("fresh fetch: cached at %v, age %d", fresh.CachedAt, fresh.Age)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	cached := getPreview(t, service, page.URL+"/")
+	if cached.Title != fresh.Title {
+		t.Fatalf("refetched: %q after %q", cached.Title, fresh.Title)
+	}
+	if cached.CachedAt == nil || !cached.CachedAt.Equal(*fresh.CachedAt) || cached.Age < 1 {
+		t.Errorf("cached read: cached at %v (fetched %v), age %d", cached.CachedAt, fresh.CachedAt, cached.Age)
+	}
+}
+
+func TestPreviewHTTP3(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a QUIC server")
+	}
+	service := newService(t)
+	var port string
+	upstream := newTLSUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Alt-Svc", `h3=":`+port+`"; ma=3600`)
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprintf(w, "<html><head><title>%s</title></head></html>", r.Proto)
+	}))
+	_, port, _ = net.SplitHostPort(upstream.Listener.Addr().String())
+
+	// The h3 server shares the TCP server's port, on UDP
+	udp, err := net.ListenPacket("udp", "127.0.0.1:"+port)
+	if err != nil {
+		t.Skipf("UDP port %s: %v", port, err)
+	}
+	var quicConns atomic.Int64
+	h3Server := &http3.Server{
+		Handler:   upstream.Config.Handler,
+		TLSConfig: http3.ConfigureTLSConfig(upstream.TLS.Clone()),
+		ConnContext: func(ctx context.Context, _ quic.Connection) context.Context {
+			quicConns.Add(1)
+			return ctx
+		},
+	}
+	go h3Server.Serve(udp)
+	defer h3Server.Close()
+
+	// A short handshake timeout, so falling back off a dead server is quick
+	h3Transport := &http3.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		QUICConfig:      &quic.Config{HandshakeIdleTimeout: 200 * time.Millisecond},
+	}
+	defer h3Transport.Close()
+	setVar(t, &client.Transport, http.RoundTripper(&altSvcTransport{
+		base:  client.Transport,
+		h3:    h3Transport,
+		hosts: expirable.NewLRU[string, struct{}](maxHTTP3Hosts, nil, http3HostsTTL),
+	}))
+
+	// Until the origin advertises h3, and then once it stops answering on it.
+	// Closing idle connections reaches the HTTP/3 pool too, so the request
+	// after it needs a new QUIC connection.
+	for i, want := range []string{"HTTP/1.1", "HTTP/3.0", "HTTP/3.0", "HTTP/3.0", "HTTP/1.1"} {
+		switch i {
+		case 3:
+			client.CloseIdleConnections()
+		case 4:
+			if n := quicConns.Load(); n != 2 {
+				t.Errorf("%d QUIC connections, want 2", n)
+			}
+			h3Server.Close()
+		}
+		preview := getPreview(t, service, fmt.Sprintf("%s/%d", upstream.URL, i))
+		if preview.Title != want {
+			t.Errorf("request %d: over %q (%q), want %s", i, preview.Title, preview.Error, want)
+		}
+	}
+}
+
+func TestPreviewAppleTouchIcon(t *testing.T) {
+	service := newService(t)
+	page := newPage(t, `<html><head><title>Web clip</title>
+<link rel="icon" type="image/png" href="/favicon-32.png" sizes="32x32">
+<link rel="apple-touch-icon" href="/touch.png">
+<link rel="apple-touch-icon" sizes="120x120" href="/touch-120.png">
+<link rel="apple-touch-icon-precomposed" sizes="180x180" href="/touch-180.png">
+<link rel="apple-touch-icon" sizes="152x152" href="https://cdn.example.com/touch-152.png">
+</head></html>`)
+	bare := newPage(t, `<html><head><title>No clip</title><link rel="icon" href="/favicon.png"></head></html>`)
+
+	preview := getPreview(t, service, page.URL+"/post")
+	if preview.AppleTouchIcon != page.URL+"/touch-180.png" {
+		t.Errorf("apple-touch-icon %q, want the 180x180 one", preview.AppleTouchIcon)
+	}
+	if preview.Favicon != page.URL+"/favicon-32.png" {
+		t.Errorf("favicon %q, want the icon link", preview.Favicon)
+	}
+	if preview := getPreview(t, service, bare.URL+"/"); preview.AppleTouchIcon != "" {
+		t.Errorf("page without one: apple-touch-icon %q", preview.AppleTouchIcon)
+	}
+}
+
+func TestPreviewRetryAfter(t *testing.T) {
+	service := newService(t)
+	var hits hitCounter
+	upstream := newUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.add(r.URL.Path)
+		switch r.URL.Path {
+		case "/seconds":
+			w.Header().Set("Retry-After", "120")
+		case "/date":
+			w.Header().Set("Retry-After", time.Now().Add(90*time.Second).UTC().Format(http.TimeFormat))
+		case "/unavailable":
+			w.Header().Set("Retry-After", "120")
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		http.Error(w, "slow down", http.StatusTooManyRequests)
+	}))
+
+	// Longer than RETRY_MAX_WAIT, so the 429 is returned rather than retried
+	preview := getPreview(t, service, upstream.URL+"/seconds")
+	if preview.UpstreamStatus != 429 || preview.RetryAfter != 120 || preview.Error == "" {
+		t.Errorf("seconds: status %d, retry after %d, error %q", preview.UpstreamStatus, preview.RetryAfter, preview.Error)
+	}
+	if n := hits.get("/seconds"); n != 1 {
+		t.Errorf("seconds: fetched %d times", n)
+	}
+	if preview := getPreview(t, service, upstream.URL+"/date"); preview.RetryAfter < 88 || preview.RetryAfter > 91 {
+		t.Errorf("HTTP date: retry after %d, want about 90", preview.RetryAfter)
+	}
+
+	setVar(t, &retryOnStatus, nil)
+	if preview := getPreview(t, service, upstream.URL+"/none"); preview.UpstreamStatus != 429 || preview.RetryAfter != 0 {
+		t.Errorf("no header: status %d, retry after %d", preview.UpstreamStatus, preview.RetryAfter)
+	}
+	// Only rate limiting carries it through
+	if preview := getPreview(t, service, upstream.URL+"/unavailable"); preview.UpstreamStatus != 503 || preview.RetryAfter != 0 {
+		t.Errorf("503: status %d, retry after %d", preview.UpstreamStatus, preview.RetryAfter)
+	}
+}
+
+func TestWebSocketStreamsPreviews(t *testing.T) {
+	setVar(t, &wsURLsPerMinute, 3)
+	service := newService(t)
+	release := make(chan struct{})
+	upstream := newUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			select {
+			case <-release:
+			case <-time.After(5 * time.Second):
+			}
+		}
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprintf(w, "<html><head><title>Page %s</title></head></html>", r.URL.Path)
+	}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(service.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.CloseNow()
+	send := func(target string) {
+		t.Helper()
+		if err := conn.Write(ctx, websocket.MessageText, []byte(target)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func() Preview {
+		t.Helper()
+		var preview Preview
+		if err := wsjson.Read(ctx, conn, &preview); err != nil {
+			t.Fatal(err)
+		}
+		return preview
+	}
+
+	// The fast page is answered while the slow one is still loading
+	send(upstream.URL + "/slow")
+	send(upstream.URL + "/fast")
+	if preview := read(); preview.Title != "Page /fast" {
+		t.Fatalf("first answer %q (%q), want the fast page", preview.Title, preview.Error)
+	}
+	close(release)
+	if preview := read(); preview.Title != "Page /slow" {
+		t.Fatalf("second answer %q (%q), want the slow page", preview.Title, preview.Error)
+	}
+
+	// The third URL in a minute is answered, the fourth is over the allowance
+	send(upstream.URL + "/fast")
+	send(upstream.URL + "/over")
+	got := map[string]Preview{}
+	for range 2 {
+		preview := read()
+		got[preview.URL] = preview
+	}
+	if cached := got[upstream.URL+"/fast"]; cached.Title != "Page /fast" {
+		t.Errorf("repeated URL: title %q (%q)", cached.Title, cached.Error)
+	}
+	if limited := got[upstream.URL+"/over"]; limited.ErrorCode != "rate_limited" || limited.RetryAfter < 1 || limited.RetryAfter > 60 {
+		t.Errorf("over the allowance: code %q, retry after %d", limited.ErrorCode, limited.RetryAfter)
+	}
+	conn.Close(websocket.StatusNormalClosure, "")
+}
+
+func TestProxyImageDedupe(t *testing.T) {
+	setVar(t, &dedupeImages, true)
+	service := newService(t)
+	shared := pngImage(6, 6, color.Black)
+	var hits hitCounter
+	upstream := newUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.add(r.URL.Path)
+		w.Header().Set("Content-Type", "image/png")
+		if r.URL.Path == "/other.png" {
+			w.Write(pngImage(6, 6, color.White))
+			return
+		}
+		w.Write(shared)
+	}))
+	proxy := func(imageURL string) []byte {
+		t.Helper()
+		resp, err := http.Get(service.URL + "/proxy-image?url=" + url.QueryEscape(imageURL))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return body
+	}
+
+	// The same bytes behind a CDN variant URL
+	a, b, other := upstream.URL+"/a.png", upstream.URL+"/b.png?width=auto", upstream.URL+"/other.png"
+	for _, imageURL := range []string{a, b, other} {
+		proxy(imageURL)
+	}
+	hashA, okA := imageKeys.Get("img_" + hashURL(a))
+	hashB, okB := imageKeys.Get("img_" + hashURL(b))
+	hashOther, _ := imageKeys.Get("img_" + hashURL(other))
+	if !okA || !okB || hashA != hashB || hashA == hashOther {
+		t.Fatalf("content hashes %q, %q and %q", hashA, hashB, hashOther)
+	}
+	if entry, ok := imageCache.Peek(hashA); !ok || !bytes.Equal(entry.Data, shared) {
+		t.Error("shared bytes not cached under their hash")
+	}
+	if imageCache.Contains("img_"+hashURL(a)) || imageCache.Contains("img_"+hashURL(b)) {
+		t.Error("bytes also cached under their URLs")
+	}
+
+	// Both URLs are then served from the one copy
+	if !bytes.Equal(proxy(b), shared) || !bytes.Equal(proxy(a), shared) {
+		t.Error("cached bytes differ")
+	}
+	if hits.get("/a.png") != 1 || hits.get("/b.png") != 1 {
+		t.Errorf("refetched: %d and %d fetches", hits.get("/a.png"), hits.get("/b.png"))
+	}
+}
+
+func TestPreviewDebugProtocol(t *testing.T) {
+	service := newService(t)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		io.WriteString(w, `<html><head><title>Protocol</title></head></html>`)
+	})
+	plain := newPage(t, `<html><head><title>Protocol</title></head></html>`)
+	h2 := httptest.NewUnstartedServer(handler)
+	h2.EnableHTTP2 = true
+	h2.StartTLS()
+	t.Cleanup(h2.Close)
+	_, port, _ := net.SplitHostPort(h2.Listener.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+	setVar(t, &allowedPorts, append(slices.Clone(allowedPorts), portNum))
+	transport := client.Transport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	setVar(t, &client.Transport, http.RoundTripper(transport))
+
+	for target, want := range map[string]string{
+		plain.URL + "/": "HTTP/1.1",
+		h2.URL + "/":    "HTTP/2.0",
+	} {
+		// Cached previews keep the protocol they were fetched over
+		for range 2 {
+			preview := getPreview(t, service, target, "debug", "1")
+			if preview.Debug == nil || preview.Debug.Protocol != want {
+				t.Errorf("%s: debug %+v, want protocol %s", target, preview.Debug, want)
+			}
+		}
+		if preview := getPreview(t, service, target); preview.Debug != nil {
+			t.Errorf("%s: debug info without debug=1", target)
+		}
+	}
+}
+
+func TestPreviewRetriesOnStatus(t *testing.T) {
+	service := newService(t)
+	var hits hitCounter
+	upstream := newUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.add(r.URL.Path)
+		if hits.get(r.URL.Path) == 1 {
+			switch r.URL.Path {
+			case "/limited", "/deadline":
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, "slow down", http.StatusTooManyRequests)
+				return
+			case "/unavailable":
+				http.Error(w, "down", http.StatusServiceUnavailable)
+				return
+			case "/broken":
+				http.Error(w, "broken", http.StatusInternalServerError)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "text/html")
+		io.WriteString(w, `<html><head><title>Second try</title></head></html>`)
+	}))
+
+	// 429 waits out its Retry-After, 503 without one a second
+	for _, path := range []string{"/limited", "/unavailable"} {
+		start := time.Now()
+		preview := getPreview(t, service, upstream.URL+path)
+		if preview.Title != "Second try" || preview.UpstreamStatus != 200 {
+			t.Errorf("%s: title %q, status %d, error %q", path, preview.Title, preview.UpstreamStatus, preview.Error)
+		}
+		if elapsed := time.Since(start); elapsed < time.Second {
+			t.Errorf("%s: retried after %s", path, elapsed)
+		}
+		if n := hits.get(path); n != 2 {
+			t.Errorf("%s: fetched %d times, want 2", path, n)
+		}
+	}
+
+	// Statuses not listed aren't retried
+	if preview := getPreview(t, service, upstream.URL+"/broken"); preview.UpstreamStatus != 500 || hits.get("/broken") != 1 {
+		t.Errorf("500: status %d after %d fetches", preview.UpstreamStatus, hits.get("/broken"))
+	}
+
+	// Nor is a wait that wouldn't fit in the request deadline
+	setConfig(t, func(c *runtimeConfig) { c.RequestDeadline = 500 * time.Millisecond })
+	if preview := getPreview(t, service, upstream.URL+"/deadline"); preview.UpstreamStatus != 429 || hits.get("/deadline") != 1 {
+		t.Errorf("wait past the deadline: status %d after %d fetches", preview.UpstreamStatus, hits.get("/deadline"))
+	}
+}
+
+func TestServiceFavicon(t *testing.T) {
+	service := newService(t)
+	for _, method := range []string{"GET", "HEAD"} {
+		req, _ := http.NewRequest(method, service.URL+"/favicon.ico", nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent {
+			t.Errorf("%s /favicon.ico: status %d, want 204", method, resp.StatusCode)
+		}
+		if cc := resp.Header.Get("Cache-Control"); !strings.Contains(cc, "max-age=86400") {
+			t.Errorf("%s /favicon.ico: Cache-Control %q", method, cc)
+		}
+	}
+}
+
+func TestPreviewNoImage(t *testing.T) {
+	service := newService(t)
+	var hits hitCounter
+	upstream := newUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.add(r.URL.Path)
+		if r.URL.Path == "/cover.png" {
+			// A slow image host, which text-only clients shouldn't wait on
+			time.Sleep(300 * time.Millisecond)
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(pngImage(8, 8, color.Black))
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		io.WriteString(w, `<html><head><title>Text only</title>
+<meta property="og:image" content="/cover.png">
+<meta property="og:image:width" content="800">
+<meta property="og:video" content="/clip.mp4">
+<meta property="og:video:image" content="/poster.jpg"></head></html>`)
+	}))
+	target := upstream.URL + "/article"
+
+	start := time.Now()
+	preview := getPreview(t, service, target, "no_image", "1", "verify_image", "1", "extract_color", "1")
+	elapsed := time.Since(start)
+	if preview.Title != "Text only" || preview.Image != "" || preview.Images != nil || preview.VideoPoster != "" || preview.DominantColor != "" {
+		t.Errorf("no_image preview: %+v", preview)
+	}
+	if n := hits.get("/cover.png"); n != 0 || elapsed >= 300*time.Millisecond {
+		t.Errorf("image fetched %d times, took %s", n, elapsed)
+	}
+
+	// The imageless preview isn't cached for clients that want images
+	start = time.Now()
+	preview = getPreview(t, service, target, "verify_image", "1")
+	if preview.Image != upstream.URL+"/cover.png" || hits.get("/cover.png") == 0 {
+		t.Errorf("with images: image %q after %d image fetches", preview.Image, hits.get("/cover.png"))
+	}
+	if withImage := time.Since(start); withImage <= elapsed {
+		t.Errorf("verified image in %s, no faster than %s without", withImage, elapsed)
+	}
+}
+
+func TestPreviewProductOffer(t *testing.T) {
+	service := newService(t)
+	for _, tc := range []struct{ name, head, price, currency, availability string }{
+		{"og product", `<meta property="og:type" content="product">
+<meta property="product:price:amount" content="129.99">
+<meta property="product:price:currency" content="EUR">
+<meta property="og:availability" content="instock">`, "129.99", "EUR", "instock"},
+		{"JSON-LD offers", `<script type="application/ld+json">{"@type": "Product", "name": "Tent",
+"offers": [{"@type": "Offer", "price": 349, "priceCurrency": "USD", "availability": "https://schema.org/OutOfStock"}]}</script>`,
+			"349", "USD", "OutOfStock"},
+		{"aggregate offer", `<meta property="og:type" content="product.item">
+<script type="application/ld+json">{"@type": "Product", "offers": {"@type": "AggregateOffer", "lowPrice": "19.50", "priceCurrency": "GBP"}}</script>`,
+			"19.50", "GBP", ""},
+		// Prices on anything but a product page aren't reported
+		{"article", `<meta property="og:type" content="article">
+<meta property="product:price:amount" content="5">`, "", "", ""},
+	} {
+		page := newPage(t, `<html><head><title>Product</title>`+tc.head+`</head></html>`)
+		preview := getPreview(t, service, page.URL+"/")
+		if preview.Price != tc.price || preview.Currency != tc.currency || preview.Availability != tc.availability {
+			t.Errorf("%s: %q %q %q, want %q %q %q", tc.name, preview.Price, preview.Currency, preview.Availability,
+				tc.price, tc.currency, tc.availability)
+		}
+	}
+}
+
+func TestPreviewDebugRawHead(t *testing.T) {
+	service := newService(t)
+	head := `<html><head><title>Raw &amp; escaped</title>
+<meta property="og:description" content="Quote &quot;here&quot;">
+</head>`
+	page := newPage(t, head+`<body><p>Private body text</p></body></html>`)
+	long := newPage(t, `<html><head><title>Long</title>`+strings.Repeat(`<meta name="filler" content="0123456789">`+"\n", 400)+`</head></html>`)
+
+	// Without DEBUG, ?debug=1 never exposes page content
+	if preview := getPreview(t, service, page.URL+"/off", "debug", "1"); preview.Debug == nil || preview.Debug.RawHead != "" {
+		t.Errorf("DEBUG unset: debug %+v", preview.Debug)
+	}
+
+	setVar(t, &debugMode, true)
+	preview := getPreview(t, service, page.URL+"/on", "debug", "1")
+	if preview.Debug == nil || preview.Debug.RawHead != head {
+		t.Fatalf("raw head %+v, want %q", preview.Debug, head)
+	}
+	if preview := getPreview(t, service, page.URL+"/on"); preview.Debug != nil {
+		t.Errorf("raw head without debug=1: %+v", preview.Debug)
+	}
+
+	preview = getPreview(t, service, long.URL+"/", "debug", "1")
+	if n := len(preview.Debug.RawHead); n != rawHeadMaxBytes {
+		t.Errorf("raw head of a long page is %d bytes, want the %d-byte bound", n, rawHeadMaxBytes)
+	}
+}
+
+func TestPreviewUntitledPage(t *testing.T) {
+	service := newService(t)
+	untitled := newPage(t, `<html><head><meta name="description" content="No title here"></head></html>`)
+	titled := newPage(t, `<html><head><title>Titled</title></head></html>`)
+	host := strings.TrimPrefix(untitled.URL, "http://")
+
+	// By default the host stands in for the title
+	if preview := getPreview(t, service, untitled.URL+"/default"); preview.Title != host || preview.HasTitle {
+		t.Errorf("default: title %q, has title %v", preview.Title, preview.HasTitle)
+	}
+
+	setVar(t, &titleHostFallback, false)
+	preview := getPreview(t, service, untitled.URL+"/empty")
+	if preview.Title != "" || preview.HasTitle || preview.Error != "" || preview.Description != "No title here" {
+		t.Errorf("without the fallback: title %q, has title %v, error %q", preview.Title, preview.HasTitle, preview.Error)
+	}
+	if preview := getPreview(t, service, titled.URL+"/"); preview.Title != "Titled" || !preview.HasTitle {
+		t.Errorf("titled page: title %q, has title %v", preview.Title, preview.HasTitle)
+	}
+}
+
+func TestPreviewDescriptions(t *testing.T) {
+	service := newService(t)
+	page := newPage(t, `<html><head><title>Ranked</title>
+<meta name="description" content="A fuller account of the release, with every change &amp; fix listed.">
+<meta property="og:description" content="Release notes.">
+</head></html>`)
+	terse := newPage(t, `<html><head><title>One</title><meta property="og:description" content="Only one"></head></html>`)
+
+	preview := getPreview(t, service, page.URL+"/", "debug", "1")
+	if preview.Description != "Release notes." {
+		t.Errorf("primary description %q, want og:description", preview.Description)
+	}
+	want := []SourcedText{
+		{"og", "Release notes."},
+		{"meta", "A fuller account of the release, with every change & fix listed."},
+	}
+	if preview.Debug == nil || !slices.Equal(preview.Debug.Descriptions, want) {
+		t.Errorf("descriptions %+v, want %+v", preview.Debug, want)
+	}
+
+	preview = getPreview(t, service, terse.URL+"/", "debug", "1")
+	if want := []SourcedText{{"og", "Only one"}}; !slices.Equal(preview.Debug.Descriptions, want) {
+		t.Errorf("single source: %+v", preview.Debug.Descriptions)
+	}
+
+	// Like Description, each one is bounded in the cached preview
+	long := strings.Repeat("word ", 2000)
+	verbose := newPage(t, `<html><head><title>Long</title><meta name="description" content="`+long+`"><meta name="twitter:description" content="`+long+`"></head></html>`)
+	preview = getPreview(t, service, verbose.URL+"/", "debug", "1")
+	if len(preview.Debug.Descriptions) != 2 {
+		t.Fatalf("long descriptions: %+v", preview.Debug.Descriptions)
+	}
+	for _, d := range preview.Debug.Descriptions {
+		if d.Text != preview.Description || len(d.Text) > 300 {
+			t.Errorf("%s description is %d bytes, description %d", d.Source, len(d.Text), len(preview.Description))
+		}
+	}
+}
+
+func TestMetricsConnections(t *testing.T) {
+	service := newService(t)
+	client.CloseIdleConnections()
+	var before, during, after CacheMetrics
+	getJSON(t, service.URL+"/metrics", &before)
+
+	var pages []*httptest.Server
+	for range 3 {
+		pages = append(pages, newPage(t, `<html><head><title>Dialed</title></head></html>`))
+	}
+	for i, page := range pages {
+		getPreview(t, service, fmt.Sprintf("%s/%d", page.URL, i))
+	}
+	// Kept alive, so a second page from the first server needs no dial
+	getPreview(t, service, pages[0].URL+"/again")
+	getJSON(t, service.URL+"/metrics", &during)
+	if dials := during.TotalDials - before.TotalDials; dials != 3 {
+		t.Errorf("%d dials for 3 servers", dials)
+	}
+	if open := during.ActiveConnections - before.ActiveConnections; open != 3 {
+		t.Errorf("%d more active connections, want 3 idle in the pool", open)
+	}
+
+	client.CloseIdleConnections()
+	getJSON(t, service.URL+"/metrics", &after)
+	if after.ActiveConnections != before.ActiveConnections || after.TotalDials != during.TotalDials {
+		t.Errorf("after closing idle connections: %d active, %d dials", after.ActiveConnections, after.TotalDials)
+	}
+}
+
+func TestPreviewRejectsHugeHeaders(t *testing.T) {
+	service := newService(t)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/huge" {
+			// Just over the 64KB default, since HTTP/2 servers sending far
+			// more get the whole connection torn down instead
+			for i := range 70 {
+				w.Header().Set(fmt.Sprintf("X-Filler-%d", i), strings.Repeat("x", 1000))
+			}
+		}
+		w.Header().Set("Content-Type", "text/html")
+		io.WriteString(w, `<html><head><title>Headers</title></head></html>`)
+	})
+	h1 := newUpstream(t, handler)
+	h2 := httptest.NewUnstartedServer(handler)
+	h2.EnableHTTP2 = true
+	h2.StartTLS()
+	t.Cleanup(h2.Close)
+	_, port, _ := net.SplitHostPort(h2.Listener.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+	setVar(t, &allowedPorts, append(slices.Clone(allowedPorts), portNum))
+	transport := client.Transport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	setVar(t, &client.Transport, http.RoundTripper(transport))
+
+	for _, upstream := range []*httptest.Server{h1, h2} {
+		preview := getPreview(t, service, upstream.URL+"/huge")
+		if preview.ErrorCode != "headers_too_large" || preview.Title != "" {
+			t.Errorf("%s: error code %q (%q)", upstream.URL, preview.ErrorCode, preview.Error)
+		}
+		if preview := getPreview(t, service, upstream.URL+"/"); preview.Title != "Headers" {
+			t.Errorf("%s: normal headers: title %q (%q)", upstream.URL, preview.Title, preview.Error)
+		}
+	}
+}
+
+func TestPreviewScreenshotFallback(t *testing.T) {
+	service := newService(t)
+	shot := pngImage(32, 18, color.Black)
+	var mu sync.Mutex
+	var rendered []string
+	backend := newUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		rendered = append(rendered, r.URL.Query().Get("url"))
+		mu.Unlock()
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(shot)
+	}))
+	plain := newPage(t, `<html><head><title>No image</title></head></html>`)
+	illustrated := newPage(t, `<html><head><title>Has image</title><meta property="og:image" content="/own.png"></head></html>`)
+
+	if preview := getPreview(t, service, plain.URL+"/unset"); preview.Image != "" || preview.Screenshot {
+		t.Errorf("without SCREENSHOT_SERVICE: image %q", preview.Image)
+	}
+	resp, err := http.Get(service.URL + "/proxy-image?screenshot=1&url=" + url.QueryEscape(plain.URL+"/unset"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 404 {
+		t.Errorf("screenshot without SCREENSHOT_SERVICE: status %d", resp.StatusCode)
+	}
+
+	// The image goes through our proxy, and the backend stays hidden
+	setVar(t, &screenshotService, backend.URL+"/render?url={url}&width=1200")
+	target := plain.URL + "/post?id=7"
+	preview := getPreview(t, service, target)
+	if want := service.URL + "/proxy-image?screenshot=1&url=" + url.QueryEscape(target); preview.Image != want || !preview.Screenshot {
+		t.Fatalf("image %q (screenshot %v), want %q", preview.Image, preview.Screenshot, want)
+	}
+	if raw, _ := json.Marshal(preview); strings.Contains(string(raw), backend.URL) {
+		t.Errorf("preview exposes the backend: %s", raw)
+	}
+	if preview := getPreview(t, service, target, "no_image", "1"); preview.Image != "" || preview.Screenshot {
+		t.Errorf("no_image: image %q, screenshot %v", preview.Image, preview.Screenshot)
+	}
+	if preview := getPreview(t, service, illustrated.URL+"/"); preview.Screenshot || preview.Image != illustrated.URL+"/own.png" {
+		t.Errorf("page with an image: %q, screenshot %v", preview.Image, preview.Screenshot)
+	}
+	renders := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Clone(rendered)
+	}
+	if got := renders(); len(got) != 0 {
+		t.Errorf("rendered %q before any client loaded a screenshot", got)
+	}
+
+	// Rendered when loaded through the proxy, then cached like any image
+	for range 2 {
+		resp, err := http.Get(preview.Image)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != 200 || !bytes.Equal(body, shot) {
+			t.Errorf("proxied screenshot: status %d, %d bytes", resp.StatusCode, len(body))
+		}
+	}
+	if got := renders(); !slices.Equal(got, []string{target}) {
+		t.Errorf("rendered %q, want %q once", got, target)
+	}
+}
+
+func TestExtractSchemelessFavicon(t *testing.T) {
+	service := newService(t)
+	for target, want := range map[string]string{
+		"//news.example.com/story": "https://news.example.com/favicon.ico",
+		"http://news.example.com/": "http://news.example.com/favicon.ico",
+	} {
+		body, _ := json.Marshal(extractRequest{URL: target, HTML: `<html><head><title>No icon</title></head></html>`})
+		resp, err := http.Post(service.URL+"/extract", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var preview Preview
+		json.NewDecoder(resp.Body).Decode(&preview)
+		resp.Body.Close()
+		if resp.StatusCode != 200 || preview.Favicon != want {
+			t.Errorf("%s: status %d, favicon %q, want %q", target, resp.StatusCode, preview.Favicon, want)
+		}
+	}
+}
+
+func TestPreviewSameSiteRedirects(t *testing.T) {
+	service := newService(t)
+	destination := newPage(t, `<html><head><title>Elsewhere</title></head></html>`)
+	_, port, _ := net.SplitHostPort(destination.Listener.Addr().String())
+	// Reached by name, so it is another site than 127.0.0.1
+	elsewhere := "http://localhost:" + port + "/landing"
+	origin := newUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/away":
+			http.Redirect(w, r, elsewhere, http.StatusFound)
+		case "/within":
+			http.Redirect(w, r, "/home", http.StatusFound)
+		default:
+			w.Header().Set("Content-Type", "text/html")
+			io.WriteString(w, `<html><head><title>Home</title></head></html>`)
+		}
+	}))
+
+	// Cross-domain redirects are followed unless restricted
+	if preview := getPreview(t, service, origin.URL+"/away?unrestricted"); preview.Title != "Elsewhere" {
+		t.Errorf("unrestricted: title %q (%q)", preview.Title, preview.Error)
+	}
+
+	setVar(t, &sameSiteRedirects, true)
+	preview := getPreview(t, service, origin.URL+"/away")
+	if preview.ErrorCode != "cross_domain_redirect" || preview.Title != "" {
+		t.Errorf("cross-domain: error code %q (%q), title %q", preview.ErrorCode, preview.Error, preview.Title)
+	}
+	if preview := getPreview(t, service, origin.URL+"/within"); preview.Title != "Home" {
+		t.Errorf("same-site: title %q (%q)", preview.Title, preview.Error)
+	}
+
+	setVar(t, &redirectAllowedDomains, []string{"localhost"})
+	if preview := getPreview(t, service, origin.URL+"/away?allowed"); preview.Title != "Elsewhere" {
+		t.Errorf("allowlisted: title %q (%q)", preview.Title, preview.Error)
+	}
+}
+
+func TestPreviewFeedInfo(t *testing.T) {
+	setVar(t, &fetchFeedInfo, true)
+	setConfig(t, func(c *runtimeConfig) { c.FeedTimeout = 300 * time.Millisecond })
+	service := newService(t)
+	feeds := map[string]string{
+		"/rss.xml": `<?xml version="1.0"?>
+<rss version="2.0"><channel><title>Release &amp; notes</title><item><title>Not this</title></item></channel></rss>`,
+		"/atom.xml": "\uFEFF" + `<?xml version="1.0" encoding="utf-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom"><title type="text">Atom log</title><entry><title>Entry</title></entry></feed>`,
+		"/feed.json": `  {"version": "https://jsonfeed.org/version/1.1", "items": [{"title": "Item"}], "title": "JSON journal"}`,
+		// Items first and cut off by FEED_MAX_BYTES before any title
+		"/long.xml": `<rss version="2.0"><channel><item><description>` + strings.Repeat("x", 20*1024) + `</description></item><title>Too late</title></channel></rss>`,
+	}
+	upstream := newUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if feed, ok := feeds[r.URL.Path]; ok {
+			io.WriteString(w, feed)
+			return
+		}
+		if r.URL.Path == "/slow.xml" {
+			<-r.Context().Done()
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprintf(w, `<html><head><title>Blog</title>
+<link rel="alternate" type="application/rss+xml" href="%s"></head></html>`, r.URL.Query().Get("feed"))
+	}))
+
+	for _, tc := range []struct{ feed, title, kind string }{
+		{"/rss.xml", "Release & notes", "rss"},
+		{"/atom.xml", "Atom log", "atom"},
+		{"/feed.json", "JSON journal", "json-feed"},
+		{"/long.xml", "", "rss"},
+		{"/slow.xml", "", ""},
+	} {
+		start := time.Now()
+		preview := getPreview(t, service, upstream.URL+"/?feed="+url.QueryEscape(tc.feed))
+		if preview.Title != "Blog" || preview.FeedTitle != tc.title || preview.FeedType != tc.kind {
+			t.Errorf("%s: feed title %q, type %q, want %q, %q (%q)", tc.feed, preview.FeedTitle, preview.FeedType, tc.title, tc.kind, preview.Error)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("%s: took %s with a 300ms feed timeout", tc.feed, elapsed)
+		}
+	}
+}
+
+func TestPreviewKeepsLineEndings(t *testing.T) {
+	service := newService(t)
+	setVar(t, &debugMode, true)
+	head := "<html><head><title>Carriage\r\nreturns</title>\r\n" +
+		"<meta property=\"og:description\" content=\"One\r\ntwo\">\r\n</head>"
+	page := newPage(t, head+"<body>no trailing newline</body></html>")
+
+	// The scanned HTML is byte for byte what the page served, CRLFs included,
+	// not lines rejoined with bare newlines
+	preview := getPreview(t, service, page.URL+"/", "debug", "1")
+	if preview.Debug == nil || preview.Debug.RawHead != head {
+		t.Fatalf("raw head %+v, want %q", preview.Debug, head)
+	}
+	if preview.Title != "Carriage\r\nreturns" || preview.Description != "One\r\ntwo" {
+		t.Errorf("title %q, description %q", preview.Title, preview.Description)
+	}
+
+	// Tags that share a line keep no separator between them either
+	for _, src := range []string{head, strings.ReplaceAll(head, "\r\n", "")} {
+		meta := extractMetaTags(strings.NewReader(src), 1024, previewOptions{})
+		if want := strings.SplitN(strings.SplitN(src, "<title>", 2)[1], "</title>", 2)[0]; meta.Title != want {
+			t.Errorf("title %q, want %q", meta.Title, want)
+		}
+	}
+}
+
+func TestPreviewVerifyImage(t *testing.T) {
+	service := newService(t)
+	var hits hitCounter
+	upstream := newUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.add(r.Method + " " + r.URL.Path)
+		switch r.URL.Path {
+		case "/ok.png":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(pngImage(4, 4, color.White))
+		case "/missing.png":
+			http.NotFound(w, r)
+		default:
+			image := strings.TrimPrefix(r.URL.Path, "/page")
+			fmt.Fprintf(w, `<html><head><title>Verify</title><meta property="og:image" content="%s"></head></html>`, image)
+		}
+	}))
+
+	// Without verify_image nothing is checked
+	if preview := getPreview(t, service, upstream.URL+"/page/ok.png"); preview.ImageReachable != nil || hits.get("HEAD /ok.png") != 0 {
+		t.Errorf("unverified: reachable %v, %d HEADs", preview.ImageReachable, hits.get("HEAD /ok.png"))
+	}
+
+	preview := getPreview(t, service, upstream.URL+"/page/ok.png", "verify_image", "1")
+	if preview.ImageReachable == nil || !*preview.ImageReachable || preview.ImageContentType != "image/png" {
+		t.Errorf("reachable image: %v, %q", preview.ImageReachable, preview.ImageContentType)
+	}
+	if hits.get("HEAD /ok.png") != 1 || hits.get("GET /ok.png") != 0 {
+		t.Errorf("image checked with %d HEADs and %d GETs, want a single HEAD", hits.get("HEAD /ok.png"), hits.get("GET /ok.png"))
+	}
+
+	preview = getPreview(t, service, upstream.URL+"/page/missing.png", "verify_image", "1")
+	if preview.ImageReachable == nil || *preview.ImageReachable {
+		t.Errorf("missing image reported reachable: %v", preview.ImageReachable)
+	}
+
+	// The check is cached, so another page with the same image skips the HEAD
+	getPreview(t, service, upstream.URL+"/page/ok.png?again=1", "verify_image", "1")
+	if n := hits.get("HEAD /ok.png"); n != 1 {
+		t.Errorf("cached check repeated: %d HEADs", n)
+	}
+}
+
+func TestPreviewManifestColors(t *testing.T) {
+	setVar(t, &fetchManifest, true)
+	service := newService(t)
+	upstream := newUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/manifest.json":
+			w.Header().Set("Content-Type", "application/manifest+json")
+			w.Write([]byte(`{"name": "PWA", "theme_color": " #3367D6 ", "background_color": "rgb(255, 255, 255)",
+				"icons": [{"src": "/192.png", "sizes": "192x192"}]}`))
+		case "/plain.json":
+			w.Write([]byte(`{"name": "Colorless"}`))
+		case "/iconned":
+			w.Write([]byte(`<html><head><title>Iconned</title><link rel="icon" href="/inline.png"><link rel="manifest" href="/manifest.json"></head></html>`))
+		case "/colorless":
+			w.Write([]byte(`<html><head><title>Colorless</title><link rel="manifest" href="/plain.json"></head></html>`))
+		}
+	}))
+
+	// Colors come from the manifest even when the page has its own icon
+	preview := getPreview(t, service, upstream.URL+"/iconned")
+	if preview.ManifestThemeColor != "#3367D6" || preview.ManifestBackgroundColor != "rgb(255, 255, 255)" {
+		t.Errorf("colors %q and %q", preview.ManifestThemeColor, preview.ManifestBackgroundColor)
+	}
+	if preview.Favicon != upstream.URL+"/inline.png" {
+		t.Errorf("manifest icon replaced the page's: %q", preview.Favicon)
+	}
+	if preview := getPreview(t, service, upstream.URL+"/colorless"); preview.ManifestThemeColor != "" || preview.ManifestBackgroundColor != "" {
+		t.Errorf("colorless manifest: %q and %q", preview.ManifestThemeColor, preview.ManifestBackgroundColor)
+	}
+
+	setVar(t, &fetchManifest, false)
+	if preview := getPreview(t, service, upstream.URL+"/iconned?off=1"); preview.ManifestThemeColor != "" {
+		t.Errorf("FETCH_MANIFEST unset: theme color %q", preview.ManifestThemeColor)
+	}
+}
+
+func TestPreviewPrettyJSON(t *testing.T) {
+	service := newService(t)
+	page := newPage(t, `<html><head><title>Pretty</title></head></html>`)
+
+	read := func(path string, query url.Values) string {
+		t.Helper()
+		resp, err := http.Get(service.URL + path + "?" + query.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	compact := read("/preview", url.Values{"url": {page.URL + "/"}})
+	if strings.Count(compact, "\n") != 1 || !strings.Contains(compact, `{"url":`) {
+		t.Errorf("default response isn't compact: %q", compact)
+	}
+	pretty := read("/preview", url.Values{"url": {page.URL + "/"}, "pretty": {"1"}})
+	if !strings.HasPrefix(pretty, "{\n  \"url\": ") || !strings.Contains(pretty, "\n  \"title\": \"Pretty\",\n") {
+		t.Errorf("pretty response isn't indented: %q", pretty)
+	}
+	var a, b Preview
+	if err := json.Unmarshal([]byte(compact), &a); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(pretty), &b); err != nil {
+		t.Fatal(err)
+	}
+	if a.Title != b.Title || a.URL != b.URL {
+		t.Errorf("pretty and compact differ: %+v vs %+v", a, b)
+	}
+
+	// Other JSON endpoints honor it too
+	if root := read("/", url.Values{"pretty": {"true"}}); !strings.HasPrefix(root, "{\n  \"") {
+		t.Errorf("pretty root: %q", root)
+	}
+}
+
+func TestPreviewProbesIconPaths(t *testing.T) {
+	setVar(t, &probeIcons, true)
+	service := newService(t)
+	var hits hitCounter
+	upstream := newUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.add(r.Method + " " + r.URL.Path)
+		switch r.URL.Path {
+		case "/apple-touch-icon.png":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(pngImage(4, 4, color.White))
+		case "/", "/again":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(`<html><head><title>Iconless</title></head></html>`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+
+	preview := getPreview(t, service, upstream.URL+"/")
+	if want := upstream.URL + "/apple-touch-icon.png"; preview.Favicon != want || preview.Logo != want {
+		t.Errorf("favicon %q, logo %q, want %q", preview.Favicon, preview.Logo, want)
+	}
+	if hits.get("HEAD /favicon.ico") != 1 || hits.get("HEAD /apple-touch-icon.png") != 1 {
+		t.Errorf("probes: %v", hits.hits)
+	}
+	// Probing stops at the first hit
+	if n := hits.get("HEAD /favicon.png"); n != 0 {
+		t.Errorf("probed past the first icon: %d", n)
+	}
+	for path := range hits.hits {
+		if strings.HasPrefix(path, "GET /") && path != "GET /" {
+			t.Errorf("probe downloaded %s", path)
+		}
+	}
+
+	// A slow origin can't hold the preview past FaviconTimeout
+	setConfig(t, func(c *runtimeConfig) { c.FaviconTimeout = 200 * time.Millisecond })
+	slow := newUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(2 * time.Second):
+			}
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<html><head><title>Slow icons</title></head></html>`))
+	}))
+	start := time.Now()
+	preview = getPreview(t, service, slow.URL+"/")
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("probes took %v", elapsed)
+	}
+	if preview.Title != "Slow icons" || preview.Favicon != slow.URL+"/favicon.ico" {
+		t.Errorf("slow origin: title %q, favicon %q", preview.Title, preview.Favicon)
+	}
+
+	setVar(t, &probeIcons, false)
+	if preview := getPreview(t, service, upstream.URL+"/again"); preview.Favicon != upstream.URL+"/favicon.ico" {
+		t.Errorf("PROBE_ICONS unset: favicon %q", preview.Favicon)
+	}
+}
+
+func TestPreviewServerTiming(t *testing.T) {
+	service := newService(t)
+	upstream := newUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<html><head>`))
+		w.(http.Flusher).Flush()
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte(`<title>Timed</title></head></html>`))
+	}))
+
+	timing := func() (cache string, fetch, parse float64) {
+		t.Helper()
+		resp, err := http.Get(service.URL + "/preview?url=" + url.QueryEscape(upstream.URL+"/"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		header := resp.Header.Get("Server-Timing")
+		m := regexp.MustCompile(`^cache;desc=(hit|miss), fetch;dur=(\d+\.\d), parse;dur=(\d+\.\d)$`).FindStringSubmatch(header)
+		if m == nil {
+			t.Fatalf("Server-Timing %q", header)
+		}
+		fetch, _ = strconv.ParseFloat(m[2], 64)
+		parse, _ = strconv.ParseFloat(m[3], 64)
+		return m[1], fetch, parse
+	}
+
+	cache, fetch, parse := timing()
+	if cache != "miss" || fetch < 100 || parse < 50 || fetch+parse > 2000 {
+		t.Errorf("miss: cache %s, fetch %vms, parse %vms", cache, fetch, parse)
+	}
+	if cache, fetch, parse := timing(); cache != "hit" || fetch != 0 || parse != 0 {
+		t.Errorf("hit: cache %s, fetch %vms, parse %vms", cache, fetch, parse)
+	}
+}
+
+func TestProxyImageConcurrencyCap(t *testing.T) {
+	setVar(t, &proxyImageSlots, make(chan struct{}, 2))
+	setVar(t, &proxyImageQueueTimeout, 300*time.Millisecond)
+	service := newService(t)
+
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var running, peak int
+	upstream := newUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		running++
+		peak = max(peak, running)
+		mu.Unlock()
+		<-release
+		mu.Lock()
+		running--
+		mu.Unlock()
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(pngImage(4, 4, color.White))
+	}))
+
+	statuses := make(chan *http.Response, 5)
+	for i := range 5 {
+		go func() {
+			resp, err := http.Get(service.URL + "/proxy-image?url=" + url.QueryEscape(fmt.Sprintf("%s/%d.png", upstream.URL, i)))
+			if err != nil {
+				t.Error(err)
+				statuses <- nil
+				return
+			}
+			resp.Body.Close()
+			statuses <- resp
+		}()
+	}
+
+	// Three requests wait past the queue timeout while two hold the slots
+	var rejected []*http.Response
+	for range 3 {
+		rejected = append(rejected, <-statuses)
+	}
+	var m CacheMetrics
+	getJSON(t, service.URL+"/metrics", &m)
+	close(release)
+	for range 2 {
+		if resp := <-statuses; resp == nil || resp.StatusCode != 200 {
+			t.Errorf("admitted request: %v", resp)
+		}
+	}
+
+	for _, resp := range rejected {
+		if resp == nil || resp.StatusCode != 503 || resp.Header.Get("Retry-After") == "" {
+			t.Errorf("queued request: %v", resp)
+		}
+	}
+	if m.ImageProxyInFlight != 2 {
+		t.Errorf("in flight at the cap: %d, want 2", m.ImageProxyInFlight)
+	}
+	if peak != 2 {
+		t.Errorf("%d concurrent upstream fetches, want 2", peak)
+	}
+	getJSON(t, service.URL+"/metrics", &m)
+	if m.ImageProxyInFlight != 0 {
+		t.Errorf("in flight after the load: %d", m.ImageProxyInFlight)
+	}
+}
+
+func TestPreviewTextFormat(t *testing.T) {
+	service := newService(t)
+	page := newPage(t, `<html><head><title>Plain
+	text</title><meta name="description" content="One line, for shells"></head></html>`)
+	untitled := newPage(t, `<html><head><meta name="description" content="Just a description"></head></html>`)
+	domain := strings.TrimPrefix(page.URL, "http://")
+
+	read := func(target string) (*http.Response, string) {
+		t.Helper()
+		resp, err := http.Get(service.URL + "/preview?format=text&url=" + url.QueryEscape(target))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	resp, body := read(page.URL + "/")
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("content type %q", ct)
+	}
+	if want := "Plain text — One line, for shells (" + domain + ")\n"; body != want {
+		t.Errorf("text %q, want %q", body, want)
+	}
+
+	_, body = read(untitled.URL + "/")
+	if strings.Count(body, "\n") != 1 || !strings.Contains(body, "Just a description (") {
+		t.Errorf("untitled text %q", body)
+	}
+
+	// Failures stay JSON, with the error
+	var failed Preview
+	getJSON(t, service.URL+"/preview?format=text&url="+url.QueryEscape("http://host:22/"), &failed)
+	if failed.Error == "" {
+		t.Errorf("failed preview: %+v", failed)
+	}
+}